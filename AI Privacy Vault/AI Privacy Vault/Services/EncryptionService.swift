@@ -276,11 +276,38 @@ class EncryptionService {
         
         let jsonData = try JSONSerialization.data(withJSONObject: metadata)
         
-        let nonce = AES.GCM.Nonce()
-        let sealedBox = try AES.GCM.seal(jsonData, using: masterKey, nonce: nonce)
-        let encryptedData = sealedBox.combined!
+        return try sealEnvelope(jsonData, using: masterKey)
+    }
+    
+    // Envelope format shared with the sync server, which rejects anything
+    // else (see AIPrivacyVaultServer/utils/envelope.go):
+    // "AIPV" | version | algorithm | key ID length | key ID | nonce | ciphertext | tag
+    // The header up to the key ID is authenticated along with the ciphertext.
+    private let envelopeMagic = Data("AIPV".utf8)
+    private let envelopeVersion: UInt8 = 1
+    private let envelopeAlgorithmAESGCM: UInt8 = 1
+    
+    private func sealEnvelope(_ plaintext: Data, using key: SymmetricKey) throws -> String {
+        let keyID = Data(envelopeKeyID(for: key).utf8)
         
-        return encryptedData.base64EncodedString()
+        var header = envelopeMagic
+        header.append(contentsOf: [envelopeVersion, envelopeAlgorithmAESGCM, UInt8(keyID.count)])
+        header.append(keyID)
+        
+        let sealedBox = try AES.GCM.seal(plaintext, using: key, nonce: AES.GCM.Nonce(), authenticating: header)
+        
+        var envelope = header
+        envelope.append(sealedBox.combined!)
+        return envelope.base64EncodedString()
+    }
+    
+    // Names the key without revealing it, so envelopes sealed under an old
+    // vault password can be told apart.
+    private func envelopeKeyID(for key: SymmetricKey) -> String {
+        var hasher = SHA256()
+        hasher.update(data: Data("AIPV key id".utf8))
+        key.withUnsafeBytes { hasher.update(bufferPointer: $0) }
+        return hasher.finalize().prefix(8).map { String(format: "%02x", $0) }.joined()
     }
 }
 
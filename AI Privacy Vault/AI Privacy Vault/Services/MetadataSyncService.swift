@@ -1,5 +1,6 @@
 import Foundation
 import Network
+import CryptoKit
 
 class MetadataSyncService {
     static let shared = MetadataSyncService()
@@ -20,45 +21,55 @@ class MetadataSyncService {
     private var discoveredServers: [NWBrowser.Result] = []
     private var isDiscovering = false
     
+    private let trustDelegate = PinnedServerTrustDelegate()
+    private lazy var session = URLSession(configuration: .default, delegate: trustDelegate, delegateQueue: nil)
+    
     private init() {
     }
     
     
     func connectToLocalServer(completion: @escaping (Bool) -> Void) {
         let possiblePorts = [8080, 3000, 5000]
-        var portsToTry = possiblePorts
+        var candidates: [URL] = []
+        for port in possiblePorts {
+            candidates.append(URL(string: "https://localhost:\(port)")!)
+            // Plain HTTP is only tried against servers that have never been
+            // seen serving HTTPS, so a pinned server cannot be downgraded.
+            if !trustDelegate.hasPin(host: "localhost", port: port) {
+                candidates.append(URL(string: "http://localhost:\(port)")!)
+            }
+        }
         
-        func tryNextPort() {
-            guard !portsToTry.isEmpty else {
+        func tryNextURL() {
+            guard !candidates.isEmpty else {
                 print("Failed to connect to any local port")
                 completion(false)
                 return
             }
             
-            let port = portsToTry.removeFirst()
-            let url = URL(string: "http://localhost:\(port)")
-            self.serverURL = url
-            print("Attempting direct connection to \(url?.absoluteString ?? "unknown")")
+            let url = candidates.removeFirst()
+            print("Attempting direct connection to \(url.absoluteString)")
             
-            var request = URLRequest(url: url!.appendingPathComponent("api/status"))
+            var request = URLRequest(url: url.appendingPathComponent("api/status"))
             request.httpMethod = "GET"
             request.timeoutInterval = 3
             
-            URLSession.shared.dataTask(with: request) { data, response, error in
+            session.dataTask(with: request) { data, response, error in
                 if let httpResponse = response as? HTTPURLResponse, 
                    httpResponse.statusCode == 200 {
-                    print("Successfully connected to local server on port \(port)")
+                    print("Successfully connected to local server at \(url.absoluteString)")
+                    self.serverURL = url
                     DispatchQueue.main.async {
                         completion(true)
                     }
                 } else {
-                    print("Failed to connect on port \(port), trying next...")
-                    tryNextPort()
+                    print("Failed to connect to \(url.absoluteString), trying next...")
+                    tryNextURL()
                 }
             }.resume()
         }
         
-        tryNextPort()
+        tryNextURL()
     }
     
     func connectToServer(_ server: ServerInfo, completion: @escaping (Bool) -> Void) {
@@ -75,7 +86,7 @@ class MetadataSyncService {
         var request = URLRequest(url: url)
         request.httpMethod = "GET"
         
-        URLSession.shared.dataTask(with: request) { data, response, error in
+        session.dataTask(with: request) { data, response, error in
             if let error = error {
                 print("Server status error: \(error)")
                 completion(false)
@@ -124,7 +135,7 @@ class MetadataSyncService {
             let encoder = JSONEncoder()
             request.httpBody = try encoder.encode(credentials)
             
-            URLSession.shared.dataTask(with: request) { data, response, error in
+            session.dataTask(with: request) { data, response, error in
                 if let error = error {
                     completion(.failure(error))
                     return
@@ -183,7 +194,7 @@ class MetadataSyncService {
             let encoder = JSONEncoder()
             request.httpBody = try encoder.encode(credentials)
             
-            URLSession.shared.dataTask(with: request) { data, response, error in
+            session.dataTask(with: request) { data, response, error in
                 if let error = error {
                     completion(.failure(error))
                     return
@@ -239,7 +250,7 @@ class MetadataSyncService {
         request.httpMethod = "GET"
         request.addValue("Bearer \(authToken)", forHTTPHeaderField: "Authorization")
         
-        URLSession.shared.dataTask(with: request) { data, response, error in
+        session.dataTask(with: request) { data, response, error in
             if let error = error {
                 completion(.failure(error))
                 return
@@ -276,7 +287,7 @@ class MetadataSyncService {
         request.httpMethod = "GET"
         request.addValue("Bearer \(authToken)", forHTTPHeaderField: "Authorization")
         
-        URLSession.shared.dataTask(with: request) { data, response, error in
+        session.dataTask(with: request) { data, response, error in
             if let error = error {
                 completion(.failure(error))
                 return
@@ -319,7 +330,7 @@ class MetadataSyncService {
             encoder.dateEncodingStrategy = .iso8601
             request.httpBody = try encoder.encode(metadata)
             
-            URLSession.shared.dataTask(with: request) { data, response, error in
+            session.dataTask(with: request) { data, response, error in
                 if let error = error {
                     completion(.failure(error))
                     return
@@ -365,7 +376,7 @@ class MetadataSyncService {
             encoder.dateEncodingStrategy = .iso8601
             request.httpBody = try encoder.encode(metadata)
             
-            URLSession.shared.dataTask(with: request) { data, response, error in
+            session.dataTask(with: request) { data, response, error in
                 if let error = error {
                     completion(.failure(error))
                     return
@@ -405,7 +416,7 @@ class MetadataSyncService {
         request.httpMethod = "DELETE"
         request.addValue("Bearer \(authToken)", forHTTPHeaderField: "Authorization")
         
-        URLSession.shared.dataTask(with: request) { data, response, error in
+        session.dataTask(with: request) { data, response, error in
             if let error = error {
                 completion(.failure(error))
                 return
@@ -465,7 +476,7 @@ class MetadataSyncService {
             
             print("Sending sync request to \(url)")
             
-            URLSession.shared.dataTask(with: request) { data, response, error in
+            session.dataTask(with: request) { data, response, error in
                 let statusCode = (response as? HTTPURLResponse)?.statusCode ?? 0
                 print("Server response status: \(statusCode)")
                 
@@ -543,7 +554,7 @@ class MetadataSyncService {
         request.httpMethod = "GET"
         request.addValue("Bearer \(authToken)", forHTTPHeaderField: "Authorization")
         
-        URLSession.shared.dataTask(with: request) { data, response, error in
+        session.dataTask(with: request) { data, response, error in
             if let error = error {
                 completion(.failure(error))
                 return
@@ -567,6 +578,69 @@ class MetadataSyncService {
 }
 
 
+/// Accepts the server's self-signed certificate only if its SHA-256
+/// fingerprint matches the one pinned for that host and port. The first
+/// certificate seen is pinned (trust on first use); the server logs and
+/// advertises its fingerprint over Bonjour so it can be checked or pinned
+/// ahead of time with `pin(fingerprint:host:port:)`.
+final class PinnedServerTrustDelegate: NSObject, URLSessionDelegate {
+    private let defaultsKey = "pinned_server_fingerprints"
+    private let lock = NSLock()
+    
+    func hasPin(host: String, port: Int) -> Bool {
+        return pinnedFingerprint(for: "\(host):\(port)") != nil
+    }
+    
+    func pin(fingerprint: String, host: String, port: Int) {
+        var fingerprint = fingerprint.lowercased()
+        if fingerprint.hasPrefix("sha256:") {
+            fingerprint.removeFirst("sha256:".count)
+        }
+        setPinnedFingerprint(fingerprint, for: "\(host):\(port)")
+    }
+    
+    func urlSession(_ session: URLSession, didReceive challenge: URLAuthenticationChallenge, completionHandler: @escaping (URLSession.AuthChallengeDisposition, URLCredential?) -> Void) {
+        guard challenge.protectionSpace.authenticationMethod == NSURLAuthenticationMethodServerTrust,
+              let trust = challenge.protectionSpace.serverTrust,
+              let chain = SecTrustCopyCertificateChain(trust) as? [SecCertificate],
+              let leaf = chain.first else {
+            completionHandler(.performDefaultHandling, nil)
+            return
+        }
+        
+        let digest = SHA256.hash(data: SecCertificateCopyData(leaf) as Data)
+        let fingerprint = digest.map { String(format: "%02x", $0) }.joined()
+        let key = "\(challenge.protectionSpace.host):\(challenge.protectionSpace.port)"
+        
+        lock.lock()
+        defer { lock.unlock() }
+        
+        if let pinned = pinnedFingerprint(for: key) {
+            guard pinned == fingerprint else {
+                print("Certificate for \(key) does not match the pinned fingerprint, refusing connection")
+                completionHandler(.cancelAuthenticationChallenge, nil)
+                return
+            }
+        } else {
+            print("Pinning certificate for \(key): sha256:\(fingerprint)")
+            setPinnedFingerprint(fingerprint, for: key)
+        }
+        
+        completionHandler(.useCredential, URLCredential(trust: trust))
+    }
+    
+    private func pinnedFingerprint(for key: String) -> String? {
+        let pins = UserDefaults.standard.dictionary(forKey: defaultsKey) as? [String: String]
+        return pins?[key]
+    }
+    
+    private func setPinnedFingerprint(_ fingerprint: String, for key: String) {
+        var pins = UserDefaults.standard.dictionary(forKey: defaultsKey) as? [String: String] ?? [:]
+        pins[key] = fingerprint
+        UserDefaults.standard.set(pins, forKey: defaultsKey)
+    }
+}
+
 struct ServerInfo: Identifiable, Hashable {
     let id: String
     let name: String
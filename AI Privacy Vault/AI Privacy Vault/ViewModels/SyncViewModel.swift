@@ -146,15 +146,12 @@ class SyncViewModel: ObservableObject {
     }
     
     func prepareMetadataForSync(vaultFiles: [VaultFile], encryptionService: EncryptionService) -> [VaultFileMetadata] {
-        return vaultFiles.map { file in
-            let fileInfo = [
-                "filename": file.originalName,
-                "size": String(file.size), 
-                "date_added": String(file.dateAdded.timeIntervalSince1970) 
-            ]
-            
-            let jsonData = try? JSONSerialization.data(withJSONObject: fileInfo)
-            let encryptedData = jsonData?.base64EncodedString() ?? ""
+        return vaultFiles.compactMap { file in
+            // The server only accepts sealed envelopes, never plain metadata.
+            guard let encryptedData = try? encryptionService.encryptMetadata(file) else {
+                print("Skipping \(file.originalName): metadata could not be encrypted")
+                return nil
+            }
             
             return VaultFileMetadata(
                 id: file.id,
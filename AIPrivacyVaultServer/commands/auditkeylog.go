@@ -0,0 +1,437 @@
+package commands
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"AIPrivacyVaultServer/config"
+	"AIPrivacyVaultServer/models"
+	"AIPrivacyVaultServer/utils"
+)
+
+// AuditKeyLog checks a server's key transparency log from the outside. It
+// verifies the signed tree head, that the log still extends the head seen
+// by the previous audit, that the leaves hash to the signed root, and that
+// keys are only registered and revoked in order. Leaves name users only by
+// commitment, so -user looks up that user's key log salt to pick out their
+// leaves and checks the binding signatures of their current keys. Anyone
+// with an account can run it against a server they do not control.
+func AuditKeyLog(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("audit-keylog", flag.ContinueOnError)
+	server := flags.String("server", "https://localhost:"+cfg.ServicePort, "base URL of the server to audit")
+	token := flags.String("token", os.Getenv("AIPV_TOKEN"), "session token of any user (default: $AIPV_TOKEN)")
+	fingerprint := flags.String("fingerprint", "", "hex SHA-256 of the server's TLS certificate to pin instead of checking it against the system roots")
+	statePath := flags.String("state", filepath.Join(filepath.Dir(cfg.DatabasePath), "keylog_audit.json"), "file remembering the last verified tree head")
+	username := flags.String("user", "", "only list new entries for this user, and check their current keys")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *token == "" {
+		return errors.New("set -token or AIPV_TOKEN to a session token")
+	}
+
+	client := &keyLogClient{
+		base:  strings.TrimRight(*server, "/"),
+		token: *token,
+		http:  &http.Client{Timeout: 30 * time.Second},
+	}
+	if *fingerprint != "" {
+		client.http.Transport = pinnedTransport(*fingerprint)
+	}
+
+	previous, err := readAuditState(*statePath)
+	if err != nil {
+		return err
+	}
+
+	var signingKey struct {
+		PublicKey string `json:"public_key"`
+	}
+	if err := client.get("/api/server/signing-key", &signingKey); err != nil {
+		return err
+	}
+	if previous != nil && previous.SigningKey != signingKey.PublicKey {
+		return fmt.Errorf("server signing key changed since the last audit; if it was rotated on purpose, remove %s and audit again", *statePath)
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(signingKey.PublicKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return errors.New("server signing key is not a valid Ed25519 key")
+	}
+
+	var signed models.SignedTreeHead
+	if err := client.get("/api/keylog/head", &signed); err != nil {
+		return err
+	}
+	head, err := verifyTreeHead(publicKey, &signed)
+	if err != nil {
+		return err
+	}
+
+	if previous != nil {
+		if head.TreeSize < previous.TreeSize {
+			return fmt.Errorf("key log shrank from %d to %d leaves", previous.TreeSize, head.TreeSize)
+		}
+		var consistency struct {
+			Proof []string `json:"proof"`
+		}
+		query := url.Values{
+			"first":  {strconv.FormatInt(previous.TreeSize, 10)},
+			"second": {strconv.FormatInt(head.TreeSize, 10)},
+		}
+		if err := client.get("/api/keylog/consistency?"+query.Encode(), &consistency); err != nil {
+			return err
+		}
+		if err := verifyConsistency(previous, head, consistency.Proof); err != nil {
+			return err
+		}
+	}
+
+	entries, err := client.entries(head.TreeSize)
+	if err != nil {
+		return err
+	}
+	hashes := make([][]byte, len(entries))
+	for i, entry := range entries {
+		hashes[i] = utils.MerkleLeafHash([]byte(entry.Leaf))
+	}
+	if hex.EncodeToString(utils.MerkleRoot(hashes)) != head.RootHash {
+		return errors.New("key log leaves do not hash to the signed root")
+	}
+
+	var seen int64
+	if previous != nil {
+		seen = previous.TreeSize
+	}
+	var salt string
+	if *username != "" {
+		if salt, err = checkUserKeys(client, *username, entries); err != nil {
+			return err
+		}
+	}
+	if err := replayKeyLog(entries, seen, *username, salt); err != nil {
+		return err
+	}
+
+	if err := writeAuditState(*statePath, &auditState{
+		SigningKey: signingKey.PublicKey,
+		TreeSize:   head.TreeSize,
+		RootHash:   head.RootHash,
+		AuditedAt:  time.Now().UTC(),
+	}); err != nil {
+		return err
+	}
+
+	fmt.Printf("Key log verified: %d leaves, %d new, root %s\n", head.TreeSize, head.TreeSize-seen, head.RootHash)
+	return nil
+}
+
+// auditState is the tree head the last successful audit verified.
+type auditState struct {
+	SigningKey string    `json:"signing_key"`
+	TreeSize   int64     `json:"tree_size"`
+	RootHash   string    `json:"root_hash"`
+	AuditedAt  time.Time `json:"audited_at"`
+}
+
+func readAuditState(path string) (*auditState, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var state auditState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("%s is not an audit state file: %v", path, err)
+	}
+	return &state, nil
+}
+
+func writeAuditState(path string, state *auditState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	partial := path + ".partial"
+	if err := os.WriteFile(partial, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(partial, path)
+}
+
+// verifyTreeHead checks the signature on a tree head and returns what was
+// signed, ignoring the unsigned copy alongside it.
+func verifyTreeHead(publicKey ed25519.PublicKey, signed *models.SignedTreeHead) (*models.TreeHead, error) {
+	payload, err := base64.StdEncoding.DecodeString(signed.Payload)
+	if err != nil {
+		return nil, errors.New("tree head payload is not valid base64")
+	}
+	encoded, err := utils.OpenStatement(publicKey, utils.StatementTreeHead, payload, signed.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("tree head: %v", err)
+	}
+	var head models.TreeHead
+	if err := json.Unmarshal(encoded, &head); err != nil {
+		return nil, fmt.Errorf("tree head payload is not valid: %v", err)
+	}
+	return &head, nil
+}
+
+func verifyConsistency(previous *auditState, head *models.TreeHead, encoded []string) error {
+	root1, err1 := hex.DecodeString(previous.RootHash)
+	root2, err2 := hex.DecodeString(head.RootHash)
+	proof, err3 := decodeHashes(encoded)
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return fmt.Errorf("invalid consistency proof: %v", err)
+	}
+	if !utils.VerifyMerkleConsistency(previous.TreeSize, head.TreeSize, root1, root2, proof) {
+		return fmt.Errorf("key log of %d leaves does not extend the one of %d leaves seen by the last audit", head.TreeSize, previous.TreeSize)
+	}
+	return nil
+}
+
+func decodeHashes(encoded []string) ([][]byte, error) {
+	hashes := make([][]byte, len(encoded))
+	for i, value := range encoded {
+		hash, err := hex.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		hashes[i] = hash
+	}
+	return hashes, nil
+}
+
+// replayKeyLog checks that every leaf is well formed, that keys are only
+// registered for a device with none active and only active keys are
+// revoked, and lists the leaves from index seen on, only those of username
+// unless it is empty.
+func replayKeyLog(entries []models.KeyLogLeaf, seen int64, username, salt string) error {
+	active := make(map[string]models.KeyLogEntry)
+	// Revoking keys registered before leaves carried commitments logs a
+	// revocation with commitments, so those registrations are also found by
+	// their keys.
+	legacy := make(map[string]string)
+	var userCommitment string
+	if username != "" && salt != "" {
+		userCommitment = utils.KeyLogUserCommitment(salt, username)
+	}
+
+	for _, leaf := range entries {
+		var entry models.KeyLogEntry
+		if err := json.Unmarshal([]byte(leaf.Leaf), &entry); err != nil {
+			return fmt.Errorf("leaf %d is not valid: %v", leaf.Index, err)
+		}
+		if entry.User != "" && (len(entry.User) != 64 || len(entry.Device) != 64) {
+			return fmt.Errorf("leaf %d carries malformed commitments", leaf.Index)
+		}
+		device := keyLogDevice(&entry)
+		keys := entry.EncryptionKey + "/" + entry.SigningKey
+		current, isActive := active[device]
+		if !isActive && entry.User != "" && legacy[keys] != "" {
+			device = legacy[keys]
+			current, isActive = active[device]
+		}
+
+		switch entry.Action {
+		case models.KeyLogRegister:
+			if isActive {
+				return fmt.Errorf("leaf %d registers keys for %s over unrevoked ones", leaf.Index, device)
+			}
+			if entry.User == "" {
+				// Leaves from before commitments carry the binding signature.
+				if err := verifyKeyBinding(entry.Username, entry.DeviceID, entry.EncryptionKey, entry.SigningKey, entry.BindingSignature); err != nil {
+					return fmt.Errorf("leaf %d: %v", leaf.Index, err)
+				}
+				legacy[keys] = device
+			}
+			active[device] = entry
+		case models.KeyLogRevoke:
+			if !isActive || current.EncryptionKey != entry.EncryptionKey || current.SigningKey != entry.SigningKey {
+				return fmt.Errorf("leaf %d revokes keys for %s that are not registered", leaf.Index, device)
+			}
+			delete(active, device)
+			delete(legacy, keys)
+		default:
+			return fmt.Errorf("leaf %d has unknown action %q", leaf.Index, entry.Action)
+		}
+
+		owner := entry.Username
+		if entry.User != "" {
+			owner = "user:" + entry.User[:16]
+			if entry.User == userCommitment {
+				owner = username
+			}
+		}
+		deviceLabel := entry.DeviceID
+		if entry.Device != "" {
+			deviceLabel = "device:" + entry.Device[:16]
+		}
+		if leaf.Index >= seen && (username == "" || owner == username) {
+			fmt.Printf("%d\t%s\t%s\t%s\t%s\t%s\n", leaf.Index, entry.Timestamp.Format(time.RFC3339),
+				entry.Action, owner, deviceLabel, entry.SigningKey)
+		}
+	}
+	return nil
+}
+
+// keyLogDevice identifies the device a leaf is about.
+func keyLogDevice(entry *models.KeyLogEntry) string {
+	if entry.User != "" {
+		return "device " + entry.User + "/" + entry.Device
+	}
+	return "device " + strconv.FormatInt(entry.UserID, 10) + "/" + entry.DeviceID
+}
+
+// checkUserKeys fetches username's current keys and checks that each was
+// signed by its device and registered in the leaf it points to, which must
+// carry the commitments the user's salt opens. It returns the salt.
+func checkUserKeys(client *keyLogClient, username string, entries []models.KeyLogLeaf) (string, error) {
+	var directory struct {
+		Keys    []models.PublicKey `json:"keys"`
+		LogSalt string             `json:"log_salt"`
+	}
+	if err := client.get("/api/keys/"+url.PathEscape(username), &directory); err != nil {
+		return "", err
+	}
+
+	for _, key := range directory.Keys {
+		if key.LogIndex < 0 || key.LogIndex >= int64(len(entries)) || entries[key.LogIndex].Leaf != key.Leaf {
+			return "", fmt.Errorf("key of %s/%s points to a leaf that is not in the audited log", username, key.DeviceID)
+		}
+		var entry models.KeyLogEntry
+		if err := json.Unmarshal([]byte(key.Leaf), &entry); err != nil {
+			return "", fmt.Errorf("leaf %d is not valid: %v", key.LogIndex, err)
+		}
+		if entry.EncryptionKey != key.EncryptionKey || entry.SigningKey != key.SigningKey {
+			return "", fmt.Errorf("leaf %d does not register the keys served for %s/%s", key.LogIndex, username, key.DeviceID)
+		}
+
+		signature := key.BindingSignature
+		if entry.User == "" {
+			if entry.Username != username || entry.DeviceID != key.DeviceID {
+				return "", fmt.Errorf("leaf %d is not about %s/%s", key.LogIndex, username, key.DeviceID)
+			}
+			signature = entry.BindingSignature
+		} else if entry.User != utils.KeyLogUserCommitment(directory.LogSalt, username) ||
+			entry.Device != utils.KeyLogDeviceCommitment(directory.LogSalt, key.DeviceID) {
+			return "", fmt.Errorf("leaf %d is not about %s/%s", key.LogIndex, username, key.DeviceID)
+		}
+		if err := verifyKeyBinding(username, key.DeviceID, key.EncryptionKey, key.SigningKey, signature); err != nil {
+			return "", fmt.Errorf("key of %s/%s: %v", username, key.DeviceID, err)
+		}
+	}
+	return directory.LogSalt, nil
+}
+
+func verifyKeyBinding(username, deviceID, encryptionKey, signingKeyValue, bindingSignature string) error {
+	if _, err := utils.ParseEncryptionPublicKey(encryptionKey); err != nil {
+		return err
+	}
+	signingKey, err := utils.ParseDevicePublicKey(signingKeyValue)
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(bindingSignature)
+	message := utils.KeyBindingMessage(username, deviceID, encryptionKey, signingKeyValue)
+	if err != nil || !ed25519.Verify(signingKey, message, signature) {
+		return errors.New("binding signature is invalid")
+	}
+	return nil
+}
+
+// pinnedTransport accepts only the certificate with the given fingerprint,
+// as the app does for servers it found on the local network.
+func pinnedTransport(fingerprint string) *http.Transport {
+	pin := strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+	return &http.Transport{
+		TLSClientConfig: &tls.Config{
+			// The chain is not checked against any roots, only the pin.
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				if len(rawCerts) == 0 {
+					return errors.New("server sent no certificate")
+				}
+				sum := sha256.Sum256(rawCerts[0])
+				if hex.EncodeToString(sum[:]) != pin {
+					return errors.New("server certificate does not match the pinned fingerprint")
+				}
+				return nil
+			},
+		},
+	}
+}
+
+type keyLogClient struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+func (kc *keyLogClient) get(path string, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, kc.base+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+kc.token)
+
+	resp, err := kc.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		return fmt.Errorf("GET %s: %s %s", path, resp.Status, failure.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// entries fetches the first size leaves of the log, a page at a time.
+func (kc *keyLogClient) entries(size int64) ([]models.KeyLogLeaf, error) {
+	var entries []models.KeyLogLeaf
+	for int64(len(entries)) < size {
+		var page struct {
+			Entries []models.KeyLogLeaf `json:"entries"`
+		}
+		query := url.Values{
+			"start": {strconv.Itoa(len(entries))},
+			"end":   {strconv.FormatInt(size, 10)},
+		}
+		if err := kc.get("/api/keylog/entries?"+query.Encode(), &page); err != nil {
+			return nil, err
+		}
+		if len(page.Entries) == 0 {
+			return nil, fmt.Errorf("key log ends at %d leaves, but the tree head has %d", len(entries), size)
+		}
+		for _, entry := range page.Entries {
+			if entry.Index != int64(len(entries)) {
+				return nil, fmt.Errorf("expected leaf %d, got %d", len(entries), entry.Index)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries[:size], nil
+}
@@ -0,0 +1,64 @@
+package commands
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"AIPrivacyVaultServer/config"
+	"AIPrivacyVaultServer/utils"
+)
+
+// commands maps each subcommand name to its implementation. Running the
+// server with no arguments starts the API instead.
+var commands = map[string]func(cfg *config.Config, args []string) error{
+	"rotate-keys":     RotateKeys,
+	"reseal":          Reseal,
+	"keygen":          Keygen,
+	"init-passphrase": InitPassphrase,
+	"backup":          Backup,
+	"restore":         Restore,
+	"split-key":       SplitKey,
+	"combine-key":     CombineKey,
+	"transit-stub":    TransitStub,
+	"decrypt-vault":   DecryptVault,
+	"audit-keylog":    AuditKeyLog,
+}
+
+// Run executes the named subcommand.
+func Run(cfg *config.Config, name string, args []string) error {
+	command, ok := commands[name]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command, expected one of: %s", strings.Join(names, ", "))
+	}
+	return command(cfg, args)
+}
+
+// openEncryptedDatabase opens the database along with the configured master
+// keys for commands that re-encrypt stored data.
+func openEncryptedDatabase(cfg *config.Config) (*sql.DB, *utils.CryptoService, error) {
+	master, err := loadKeyring(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	db, err := utils.InitDatabase(cfg.DatabasePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return db, master, nil
+}
+
+func loadKeyring(cfg *config.Config) (*utils.CryptoService, error) {
+	if len(cfg.KeyProviders) == 0 {
+		return nil, errors.New("no encryption keys configured, " + config.MasterKeySources)
+	}
+	return utils.LoadKeyring(cfg.KeyProviders, cfg.EncryptKeyID)
+}
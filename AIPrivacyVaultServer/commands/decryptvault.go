@@ -0,0 +1,324 @@
+package commands
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"AIPrivacyVaultServer/config"
+	"AIPrivacyVaultServer/models"
+	"AIPrivacyVaultServer/utils"
+)
+
+// DecryptVault decrypts a user's synced metadata with their vault password,
+// for when no device holding the vault is left. It reads either a JSON
+// export (the body of GET /api/metadata or of a sync response) or the
+// server's metadata.db directly, and needs no running server.
+func DecryptVault(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("decrypt-vault", flag.ContinueOnError)
+	exportPath := flags.String("export", "", "JSON export of the user's metadata")
+	dbPath := flags.String("db", "", "metadata.db to read instead of an export")
+	username := flags.String("user", "", "user whose metadata to read from -db (default: the only user)")
+	passwordFile := flags.String("password-file", "", "file holding the vault password (default: read from stdin)")
+	format := flags.String("format", "json", "output format: json or csv")
+	out := flags.String("out", "", "write the decrypted metadata to this file instead of stdout")
+	includeDeleted := flags.Bool("include-deleted", false, "include items deleted in the app")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if (*exportPath == "") == (*dbPath == "") {
+		return errors.New("set exactly one of -export and -db")
+	}
+	if *format != "json" && *format != "csv" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	var items []models.FileMetadata
+	var err error
+	if *exportPath != "" {
+		items, err = readVaultExport(*exportPath)
+	} else {
+		items, err = readVaultDatabase(cfg, *dbPath, *username)
+	}
+	if err != nil {
+		return err
+	}
+
+	password, err := readVaultPassword(*passwordFile)
+	if err != nil {
+		return err
+	}
+	key := utils.DeriveVaultKey(password)
+	keyID := utils.VaultKeyID(key)
+	vault, err := utils.NewKeyring(map[string]string{keyID: string(key)}, keyID)
+	if err != nil {
+		return err
+	}
+
+	recovered := make([]recoveredItem, 0, len(items))
+	failed := 0
+	for _, item := range items {
+		if item.IsDeleted && !*includeDeleted {
+			continue
+		}
+		result := recoveredItem{
+			ID:             item.ID,
+			Version:        item.Version,
+			LastModifiedAt: item.LastModifiedAt,
+			IsDeleted:      item.IsDeleted,
+		}
+		result.Metadata, err = decryptVaultItem(vault, item.EncryptedData)
+		if err != nil {
+			result.Error = err.Error()
+			failed++
+		}
+		recovered = append(recovered, result)
+	}
+	if failed > 0 && failed == len(recovered) {
+		return fmt.Errorf("none of the %d items could be decrypted, check the vault password", failed)
+	}
+
+	writer := io.Writer(os.Stdout)
+	if *out != "" {
+		// The output is unencrypted, so it is only readable by its owner.
+		file, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		writer = file
+	}
+
+	if *format == "csv" {
+		err = writeRecoveredCSV(writer, recovered)
+	} else {
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(recovered)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Decrypted %d of %d items\n", len(recovered)-failed, len(recovered))
+	return nil
+}
+
+// recoveredItem is one decrypted item. Items that fail to decrypt are kept,
+// with Error set, so nothing is silently dropped from a recovery.
+type recoveredItem struct {
+	ID             string                `json:"id"`
+	Version        int                   `json:"version"`
+	LastModifiedAt time.Time             `json:"last_modified_at"`
+	IsDeleted      bool                  `json:"is_deleted"`
+	Metadata       *models.PlainMetadata `json:"metadata,omitempty"`
+	Error          string                `json:"error,omitempty"`
+}
+
+func readVaultExport(path string) ([]models.FileMetadata, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []models.FileMetadata
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "[") {
+		err = json.Unmarshal(data, &items)
+	} else {
+		var syncResp models.SyncResponse
+		err = json.Unmarshal(data, &syncResp)
+		items = syncResp.UpdatedItems
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a metadata export: %v", path, err)
+	}
+	return items, nil
+}
+
+func readVaultDatabase(cfg *config.Config, path, username string) ([]models.FileMetadata, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	// Read-only, so recovering from a copy of a damaged server cannot make
+	// things worse.
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var userID int64
+	if username != "" {
+		err = db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("user %q not found", username)
+		}
+	} else {
+		var count int
+		if err = db.QueryRow("SELECT COUNT(*), COALESCE(MIN(id), 0) FROM users").Scan(&count, &userID); err == nil && count != 1 {
+			return nil, fmt.Errorf("%s has %d users, choose one with -user", path, count)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(
+		"SELECT id, encrypted_data, version, last_modified_at, is_deleted FROM file_metadata WHERE user_id = ? AND vault_id IS NULL ORDER BY last_modified_at",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []models.FileMetadata
+	for rows.Next() {
+		var item models.FileMetadata
+		if err := rows.Scan(&item.ID, &item.EncryptedData, &item.Version, &item.LastModifiedAt, &item.IsDeleted); err != nil {
+			return nil, err
+		}
+		item.UserID = userID
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Values sealed at rest also need the server's master key. It is only
+	// loaded if there are any, so plain databases need no server keys.
+	var cipher *utils.UserCipher
+	for i, item := range items {
+		if !strings.HasPrefix(item.EncryptedData, "enc:") {
+			continue
+		}
+		if cipher == nil {
+			master, err := loadKeyring(cfg)
+			if err != nil {
+				return nil, fmt.Errorf("metadata is encrypted at rest: %v", err)
+			}
+			cipher, err = utils.NewFieldCipher(master).ForUser(db, userID)
+			if err != nil {
+				return nil, fmt.Errorf("load data key: %v", err)
+			}
+		}
+		items[i].EncryptedData, err = cipher.Open(utils.FileMetadataData, item.ID, item.EncryptedData)
+		if err != nil {
+			return nil, fmt.Errorf("item %s: %v", item.ID, err)
+		}
+	}
+	return items, nil
+}
+
+func readVaultPassword(path string) (string, error) {
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "Vault password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !(err == io.EOF && line != "") {
+		return "", errors.New("no vault password given")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// appMetadata is what the app encrypts for each file. Older versions wrote
+// numbers as strings.
+type appMetadata struct {
+	FileName       string      `json:"filename"`
+	Size           json.Number `json:"size"`
+	FileSize       json.Number `json:"file_size"`
+	DateAdded      json.Number `json:"date_added"`
+	Classification string      `json:"classification"`
+	RiskScore      int         `json:"risk_score"`
+	Keywords       []string    `json:"keywords"`
+	Category       string      `json:"category"`
+}
+
+func decryptVaultItem(vault *utils.CryptoService, encryptedData string) (*models.PlainMetadata, error) {
+	plaintext, err := vault.Decrypt(encryptedData)
+	if err != nil {
+		// Versions of the app before envelopes synced metadata unencrypted.
+		raw, decodeErr := base64.StdEncoding.DecodeString(encryptedData)
+		if decodeErr != nil || !json.Valid(raw) {
+			return nil, err
+		}
+		plaintext = raw
+	}
+
+	var app appMetadata
+	if err := json.Unmarshal(plaintext, &app); err != nil {
+		return nil, fmt.Errorf("decrypted metadata is not valid: %v", err)
+	}
+
+	plain := &models.PlainMetadata{
+		FileName:       app.FileName,
+		Classification: app.Classification,
+		RiskScore:      app.RiskScore,
+		Keywords:       app.Keywords,
+		Category:       app.Category,
+	}
+
+	size := app.Size
+	if size == "" {
+		size = app.FileSize
+	}
+	if size != "" {
+		if plain.FileSize, err = strconv.ParseInt(size.String(), 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid size %q", size)
+		}
+	}
+
+	if app.DateAdded != "" {
+		seconds, err := app.DateAdded.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("invalid date_added %q", app.DateAdded)
+		}
+		whole, fraction := math.Modf(seconds)
+		plain.DateAdded = time.Unix(int64(whole), int64(fraction*1e9)).UTC()
+	}
+	return plain, nil
+}
+
+func writeRecoveredCSV(w io.Writer, items []recoveredItem) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{
+		"id", "filename", "file_size", "date_added", "classification", "risk_score",
+		"category", "keywords", "version", "last_modified_at", "is_deleted", "error",
+	})
+	for _, item := range items {
+		record := []string{item.ID, "", "", "", "", "", "", "", strconv.Itoa(item.Version),
+			item.LastModifiedAt.UTC().Format(time.RFC3339), strconv.FormatBool(item.IsDeleted), item.Error}
+		if m := item.Metadata; m != nil {
+			record[1] = m.FileName
+			record[2] = strconv.FormatInt(m.FileSize, 10)
+			if !m.DateAdded.IsZero() {
+				record[3] = m.DateAdded.Format(time.RFC3339)
+			}
+			record[4] = m.Classification
+			record[5] = strconv.Itoa(m.RiskScore)
+			record[6] = m.Category
+			record[7] = strings.Join(m.Keywords, ";")
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+	return writer.Error()
+}
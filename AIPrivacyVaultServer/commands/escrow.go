@@ -0,0 +1,107 @@
+package commands
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"AIPrivacyVaultServer/config"
+	"AIPrivacyVaultServer/utils"
+)
+
+// SplitKey splits a master key into Shamir shares for escrow, so the key
+// can be rebuilt with combine-key if it is lost.
+func SplitKey(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("split-key", flag.ContinueOnError)
+	shares := flags.Int("shares", 5, "number of shares to create")
+	threshold := flags.Int("threshold", 3, "number of shares needed to rebuild the key")
+	keyID := flags.String("key-id", "", "key to split (default: the active key)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if len(cfg.KeyProviders) == 0 {
+		return errors.New("no encryption keys configured, " + config.MasterKeySources)
+	}
+	if *keyID == "" {
+		*keyID = cfg.EncryptKeyID
+	}
+	provider, ok := cfg.KeyProviders[*keyID]
+	if !ok {
+		return fmt.Errorf("key %q is not configured", *keyID)
+	}
+	key, err := provider.MasterKey()
+	if err != nil {
+		return err
+	}
+
+	split, err := utils.SplitSecret(key, *shares, *threshold)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Master key %q split into %d shares, any %d of which rebuild it.\n", *keyID, *shares, *threshold)
+	fmt.Println("Give each share to a different holder and keep none of them on this server.")
+	fmt.Println()
+	for _, share := range split {
+		fmt.Printf("Share %d of %d: %s\n", share.Index, *shares, share)
+	}
+	return nil
+}
+
+// CombineKey rebuilds a master key from shares created by split-key. Shares
+// are taken from the arguments, or read one per line from stdin when none
+// are given.
+func CombineKey(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("combine-key", flag.ContinueOnError)
+	format := flags.String("format", "base64", "output encoding: base64 or hex")
+	out := flags.String("out", "", "write the key to this file instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	lines := flags.Args()
+	if len(lines) == 0 {
+		fmt.Fprintln(os.Stderr, "Enter one share per line, then an empty line or end of input:")
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				if len(lines) > 0 {
+					break
+				}
+				continue
+			}
+			lines = append(lines, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	shares := make([]utils.Share, 0, len(lines))
+	for i, line := range lines {
+		share, err := utils.ParseShare(line)
+		if err != nil {
+			return fmt.Errorf("share %d: %v", i+1, err)
+		}
+		shares = append(shares, share)
+	}
+
+	key, err := utils.CombineShares(shares)
+	if err != nil {
+		return err
+	}
+	if err := utils.ValidateKeyLength(key); err != nil {
+		return err
+	}
+
+	encoded, err := encodeKey(key, *format)
+	if err != nil {
+		return err
+	}
+	return writeKey(*out, encoded)
+}
@@ -0,0 +1,32 @@
+package commands
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"AIPrivacyVaultServer/config"
+	"AIPrivacyVaultServer/utils"
+)
+
+// InitPassphrase creates the salt and cost parameters the ENCRYPT_PASSPHRASE
+// master key is derived with. The server will not start with a passphrase
+// until this has been run once, so a lost parameters file cannot quietly
+// turn into a new key.
+func InitPassphrase(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("init-passphrase", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	provider, ok := cfg.KeyProviders[config.DefaultEncryptKeyID].(utils.PassphraseKeyProvider)
+	if !ok {
+		return errors.New("ENCRYPT_PASSPHRASE is not set")
+	}
+	if err := provider.Init(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote passphrase parameters to %s\n", provider.ParamsPath)
+	return nil
+}
@@ -0,0 +1,73 @@
+package commands
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"AIPrivacyVaultServer/config"
+	"AIPrivacyVaultServer/utils"
+)
+
+// Keygen generates a random master key, printing it in a form ENCRYPT_KEY
+// and ENCRYPT_KEYS accept or writing it to a file for ENCRYPT_KEY_FILE.
+func Keygen(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	format := flags.String("format", "base64", "output encoding: base64 or hex")
+	out := flags.String("out", "", "write the key to this file instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	key, err := utils.GenerateKey()
+	if err != nil {
+		return err
+	}
+
+	encoded, err := encodeKey(key, *format)
+	if err != nil {
+		return err
+	}
+	return writeKey(*out, encoded)
+}
+
+func encodeKey(key []byte, format string) (string, error) {
+	switch format {
+	case "base64":
+		return utils.EncodeKey(key), nil
+	case "hex":
+		return "hex:" + hex.EncodeToString(key), nil
+	default:
+		return "", fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// writeKey prints an encoded key, or writes it to a new file when out is set.
+func writeKey(out, encoded string) error {
+	if out == "" {
+		fmt.Println(encoded)
+		return nil
+	}
+
+	// O_EXCL so an existing key, and the data sealed under it, is never
+	// overwritten by accident.
+	file, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%s already exists", out)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(file, encoded); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote master key to %s\n", out)
+	return nil
+}
@@ -0,0 +1,139 @@
+package commands
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+
+	"AIPrivacyVaultServer/config"
+	"AIPrivacyVaultServer/utils"
+)
+
+// Reseal migrates values written in an older at-rest format (enc:v1 under a
+// master key, enc:v2 without associated data), or before at-rest encryption
+// was enabled, to enc:v3, bound to their user, row and column. Like
+// RotateKeys it works in committed batches and can be re-run after an
+// interruption. Once every column is done it records that in the database,
+// and the server stops accepting anything but enc:v3 from then on.
+func Reseal(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("reseal", flag.ContinueOnError)
+	batchSize := flags.Int("batch-size", 500, "rows re-encrypted per transaction")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *batchSize <= 0 {
+		return errors.New("batch-size must be positive")
+	}
+
+	db, master, err := openEncryptedDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := resealColumns(db, utils.NewFieldCipher(master), *batchSize); err != nil {
+		return err
+	}
+	if err := utils.MarkAtRestResealed(db); err != nil {
+		return err
+	}
+
+	log.Printf("Reseal complete")
+	return nil
+}
+
+func resealColumns(db *sql.DB, atRest *utils.FieldCipher, batchSize int) error {
+	for _, column := range utils.AtRestColumns {
+		if err := resealColumn(db, atRest, column, batchSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func resealColumn(db *sql.DB, atRest *utils.FieldCipher, column utils.AtRestColumn, batchSize int) error {
+	name := column.Name()
+	pending := "FROM " + column.Table + " WHERE " + column.Column + " != '' AND substr(" + column.Column + ", 1, 7) != '" + utils.AtRestPrefixV3 + "'"
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) " + pending).Scan(&total); err != nil {
+		return err
+	}
+	log.Printf("%s: %d values in an older format or not sealed", name, total)
+
+	for done := 0; ; {
+		n, err := resealBatch(db, atRest, column, pending, batchSize)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if n == 0 {
+			return nil
+		}
+		done += n
+		log.Printf("%s: %d/%d resealed", name, done, total)
+	}
+}
+
+func resealBatch(db *sql.DB, atRest *utils.FieldCipher, column utils.AtRestColumn, pending string, batchSize int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	type sealedValue struct {
+		rowID  int64
+		userID int64
+		itemID string
+		value  string
+	}
+
+	rows, err := tx.Query(
+		"SELECT rowid, "+column.UserColumn+", "+column.ItemColumn+", "+column.Column+" "+pending+" ORDER BY rowid LIMIT ?",
+		batchSize,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var batch []sealedValue
+	for rows.Next() {
+		var value sealedValue
+		if err := rows.Scan(&value.rowID, &value.userID, &value.itemID, &value.value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, value)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	ciphers := make(map[int64]*utils.UserCipher)
+	for _, value := range batch {
+		cipher, ok := ciphers[value.userID]
+		if !ok {
+			cipher, err = atRest.ForUser(tx, value.userID)
+			if err != nil {
+				return 0, err
+			}
+			ciphers[value.userID] = cipher
+		}
+
+		plain, err := cipher.Open(column, value.itemID, value.value)
+		if err != nil {
+			return 0, fmt.Errorf("row %d: %v", value.rowID, err)
+		}
+		resealed, err := cipher.Seal(column, value.itemID, plain)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE "+column.Table+" SET "+column.Column+" = ? WHERE rowid = ?", resealed, value.rowID); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(batch), tx.Commit()
+}
@@ -0,0 +1,121 @@
+package commands
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+
+	"AIPrivacyVaultServer/config"
+	"AIPrivacyVaultServer/utils"
+)
+
+// RotateKeys moves everything sealed under a master key onto ENCRYPT_KEY_ID.
+// Data keys in user_keys are rewrapped, then legacy values are resealed as
+// Reseal does. Each batch is committed on its own and only unrotated rows are
+// selected, so an interrupted rotation resumes where it stopped when run
+// again. Keep the old key in ENCRYPT_KEYS until the command has finished.
+func RotateKeys(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("rotate-keys", flag.ContinueOnError)
+	batchSize := flags.Int("batch-size", 500, "rows re-encrypted per transaction")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *batchSize <= 0 {
+		return errors.New("batch-size must be positive")
+	}
+
+	db, master, err := openEncryptedDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	log.Printf("Rotating to encryption key %s", master.ActiveKeyID())
+
+	atRest := utils.NewFieldCipher(master)
+	if err := rewrapUserKeys(db, atRest, master.ActiveKeyID(), *batchSize); err != nil {
+		return err
+	}
+	if err := resealColumns(db, atRest, *batchSize); err != nil {
+		return err
+	}
+
+	log.Printf("Key rotation complete")
+	return nil
+}
+
+// pendingUserKeys selects data keys wrapped under another master key or
+// without their user bound in.
+const pendingUserKeys = "FROM user_keys WHERE key_id <> ? OR context_bound = 0"
+
+func rewrapUserKeys(db *sql.DB, atRest *utils.FieldCipher, activeID string, batchSize int) error {
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) "+pendingUserKeys, activeID).Scan(&total); err != nil {
+		return err
+	}
+	log.Printf("user_keys: %d data keys to rewrap", total)
+
+	for done := 0; ; {
+		n, err := rewrapUserKeyBatch(db, atRest, activeID, batchSize)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		done += n
+		log.Printf("user_keys: %d/%d rewrapped", done, total)
+	}
+}
+
+func rewrapUserKeyBatch(db *sql.DB, atRest *utils.FieldCipher, activeID string, batchSize int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	type userKey struct {
+		userID  int64
+		wrapped string
+		bound   bool
+	}
+
+	rows, err := tx.Query(
+		"SELECT user_id, wrapped_key, context_bound "+pendingUserKeys+" ORDER BY user_id LIMIT ?",
+		activeID, batchSize,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var batch []userKey
+	for rows.Next() {
+		var key userKey
+		if err := rows.Scan(&key.userID, &key.wrapped, &key.bound); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, key := range batch {
+		rewrapped, err := atRest.RewrapUserKey(key.userID, key.wrapped, key.bound)
+		if err != nil {
+			return 0, fmt.Errorf("data key of user %d: %v", key.userID, err)
+		}
+		if _, err := tx.Exec(
+			"UPDATE user_keys SET wrapped_key = ?, key_id = ?, context_bound = 1 WHERE user_id = ?",
+			rewrapped, activeID, key.userID,
+		); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(batch), tx.Commit()
+}
@@ -0,0 +1,61 @@
+package commands
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"AIPrivacyVaultServer/config"
+	"AIPrivacyVaultServer/utils"
+)
+
+// TransitStub serves a local stand-in for the Vault Transit API, for trying
+// out and testing VAULT_TRANSIT_KEY without a Vault server. Its own key is
+// kept unprotected in -key-file, so it is no substitute for a real KMS.
+func TransitStub(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("transit-stub", flag.ContinueOnError)
+	listen := flags.String("listen", "127.0.0.1:8200", "address to serve the transit API on")
+	token := flags.String("token", "", "token clients must send in X-Vault-Token (default: generated)")
+	keyFile := flags.String("key-file", filepath.Join(filepath.Dir(cfg.DatabasePath), "transit_stub.key"), "file holding the stub's wrapping key, created if missing")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	key, err := utils.LoadKeyFile(*keyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err = utils.GenerateKey()
+		if err == nil {
+			err = writeKeyFile(*keyFile, key)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if *token == "" {
+		raw := make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+			return err
+		}
+		*token = hex.EncodeToString(raw)
+	}
+
+	master := utils.NewCryptoService(string(key))
+	log.Printf("Transit stub listening on http://%s, for testing only", *listen)
+	fmt.Printf("VAULT_ADDR=http://%s\nVAULT_TOKEN=%s\n", *listen, *token)
+	return http.ListenAndServe(*listen, utils.NewTransitStub(master, *token))
+}
+
+func writeKeyFile(path string, key []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(utils.EncodeKey(key)+"\n"), 0600)
+}
@@ -1,20 +1,85 @@
 package config
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
+
+	"AIPrivacyVaultServer/utils"
+)
+
+// DefaultEncryptKeyID is the key ID given to ENCRYPT_KEY.
+const DefaultEncryptKeyID = "default"
+
+// Mutual TLS modes accepted by MTLS_MODE.
+const (
+	MTLSOff      = "off"
+	MTLSOptional = "optional"
+	MTLSRequire  = "require"
+)
+
+// Registration modes accepted by REGISTRATION_MODE.
+const (
+	RegistrationOpen   = "open"
+	RegistrationInvite = "invite"
+	RegistrationClosed = "closed"
 )
 
 type Config struct {
-	ServiceName  string
-	ServicePort  string
-	DatabasePath string
-	JWTSecret    string
-	EncryptKey   string
+	ServiceName      string
+	ServicePort      string
+	DatabasePath     string
+	JWTSecret        string
+	KeyProviders     map[string]utils.KeyProvider
+	EncryptKeyID     string
+	SigningKeyPath   string
+	RegistrationMode string
+	InviteTTL        time.Duration
+
+	ShareLinkTTL    time.Duration
+	ShareLinkMaxTTL time.Duration
+
+	AtRestEncryption bool
+
+	PasswordMinLength     int
+	PasswordMaxLength     int
+	PasswordRejectCommon  bool
+	BreachedPasswordsPath string
+
+	Argon2MemoryKiB   int
+	Argon2Iterations  int
+	Argon2Parallelism int
+
+	OIDCIssuerURL      string
+	OIDCClientID       string
+	OIDCClientSecret   string
+	OIDCRedirectURL    string
+	OIDCAppRedirectURL string
+	OIDCScopes         []string
+	OIDCUsernameClaim  string
+	OIDCAutoCreate     bool
+
+	RequireRequestSigning bool
+	RequestSignatureSkew  time.Duration
+	NonceCacheSize        int
+	NonceCachePerUser     int
+
+	MTLSMode           string
+	CADir              string
+	ClientCertValidity time.Duration
+
+	TLSEnabled  bool
+	TLSCertPath string
+	TLSKeyPath  string
+	TLSDir      string
 }
 
 func LoadConfig() *Config {
@@ -32,39 +97,216 @@ func LoadConfig() *Config {
 		log.Fatalf("Failed to get user home directory: %v", err)
 	}
 
-	defaultDBPath := filepath.Join(homeDir, ".aiprivacyvault", "metadata.db")
+	dataDir := filepath.Join(homeDir, ".aiprivacyvault")
+	defaultDBPath := filepath.Join(dataDir, "metadata.db")
 
 	log.Printf("Creating directory structure...")
-	err = os.MkdirAll(filepath.Dir(defaultDBPath), 0700)
+	err = os.MkdirAll(dataDir, 0700)
 	if err != nil {
 		log.Printf("Warning: Failed to create directory: %v", err)
 	}
 
 	jwtSecret := getEnvOrDefault("JWT_SECRET", "")
-	encryptKey := getEnvOrDefault("ENCRYPT_KEY", "")
 
 	if jwtSecret == "" {
 		log.Printf("Generating JWT secret key...")
 		jwtSecret = generateRandomKey(32)
 	}
 
-	if encryptKey == "" {
-		log.Printf("Generating encryption key...")
-		encryptKey = generateRandomKey(32)
+	registrationMode := strings.ToLower(getEnvOrDefault("REGISTRATION_MODE", RegistrationOpen))
+	switch registrationMode {
+	case RegistrationOpen, RegistrationInvite, RegistrationClosed:
+	default:
+		log.Printf("Warning: Unknown REGISTRATION_MODE %q, falling back to %s", registrationMode, RegistrationClosed)
+		registrationMode = RegistrationClosed
 	}
 
 	config := &Config{
-		ServiceName:  getEnvOrDefault("SERVICE_NAME", "AI Privacy Vault Sync"),
-		ServicePort:  getEnvOrDefault("SERVICE_PORT", "8080"),
-		DatabasePath: getEnvOrDefault("DATABASE_PATH", defaultDBPath),
-		JWTSecret:    jwtSecret,
-		EncryptKey:   encryptKey,
+		ServiceName:      getEnvOrDefault("SERVICE_NAME", "AI Privacy Vault Sync"),
+		ServicePort:      getEnvOrDefault("SERVICE_PORT", "8080"),
+		DatabasePath:     getEnvOrDefault("DATABASE_PATH", defaultDBPath),
+		JWTSecret:        jwtSecret,
+		SigningKeyPath:   getEnvOrDefault("SIGNING_KEY_PATH", filepath.Join(dataDir, "signing_key.pem")),
+		RegistrationMode: registrationMode,
+		InviteTTL:        time.Duration(getEnvIntOrDefault("INVITE_TTL_HOURS", 72)) * time.Hour,
+
+		ShareLinkTTL:    time.Duration(getEnvIntOrDefault("SHARE_LINK_TTL_HOURS", 24)) * time.Hour,
+		ShareLinkMaxTTL: time.Duration(getEnvIntOrDefault("SHARE_LINK_MAX_TTL_HOURS", 720)) * time.Hour,
+
+		AtRestEncryption: getEnvBoolOrDefault("AT_REST_ENCRYPTION", false),
+
+		PasswordMinLength:     getEnvIntOrDefault("PASSWORD_MIN_LENGTH", 10),
+		PasswordMaxLength:     getEnvIntOrDefault("PASSWORD_MAX_LENGTH", 72),
+		PasswordRejectCommon:  getEnvBoolOrDefault("PASSWORD_REJECT_COMMON", true),
+		BreachedPasswordsPath: getEnvOrDefault("BREACHED_PASSWORDS_PATH", filepath.Join(dataDir, "pwned-passwords-sha1.txt")),
+
+		Argon2MemoryKiB:   getEnvIntOrDefault("ARGON2_MEMORY_KIB", 64*1024),
+		Argon2Iterations:  getEnvIntOrDefault("ARGON2_ITERATIONS", 3),
+		Argon2Parallelism: getEnvIntOrDefault("ARGON2_PARALLELISM", 2),
+
+		OIDCIssuerURL:      getEnvOrDefault("OIDC_ISSUER_URL", ""),
+		OIDCClientID:       getEnvOrDefault("OIDC_CLIENT_ID", ""),
+		OIDCClientSecret:   getEnvOrDefault("OIDC_CLIENT_SECRET", ""),
+		OIDCRedirectURL:    getEnvOrDefault("OIDC_REDIRECT_URL", ""),
+		OIDCAppRedirectURL: getEnvOrDefault("OIDC_APP_REDIRECT_URL", ""),
+		OIDCScopes:         strings.Fields(getEnvOrDefault("OIDC_SCOPES", "openid profile email")),
+		OIDCUsernameClaim:  getEnvOrDefault("OIDC_USERNAME_CLAIM", "preferred_username"),
+		OIDCAutoCreate:     getEnvBoolOrDefault("OIDC_AUTO_CREATE", false),
+
+		RequireRequestSigning: getEnvBoolOrDefault("REQUIRE_REQUEST_SIGNING", false),
+		RequestSignatureSkew:  time.Duration(getEnvIntOrDefault("REQUEST_SIGNATURE_SKEW_SECONDS", 300)) * time.Second,
+		NonceCacheSize:        getEnvIntOrDefault("NONCE_CACHE_SIZE", 100000),
+		NonceCachePerUser:     getEnvIntOrDefault("NONCE_CACHE_PER_USER", 2000),
+
+		MTLSMode:           strings.ToLower(getEnvOrDefault("MTLS_MODE", MTLSOff)),
+		CADir:              getEnvOrDefault("CA_DIR", filepath.Join(dataDir, "ca")),
+		ClientCertValidity: time.Duration(getEnvIntOrDefault("CLIENT_CERT_VALIDITY_DAYS", 365)) * 24 * time.Hour,
+
+		TLSEnabled:  getEnvBoolOrDefault("TLS_ENABLED", true),
+		TLSCertPath: os.Getenv("TLS_CERT_PATH"),
+		TLSKeyPath:  os.Getenv("TLS_KEY_PATH"),
+		TLSDir:      getEnvOrDefault("TLS_DIR", filepath.Join(dataDir, "tls")),
+	}
+
+	switch config.MTLSMode {
+	case MTLSOff, MTLSOptional, MTLSRequire:
+	default:
+		log.Printf("Warning: Unknown MTLS_MODE %q, falling back to %s", config.MTLSMode, MTLSRequire)
+		config.MTLSMode = MTLSRequire
+	}
+
+	// argon2 panics on zero iterations or parallelism, and the casts to its
+	// unsigned parameters would turn negative values into huge ones.
+	if config.Argon2MemoryKiB < 1 || int64(config.Argon2MemoryKiB) > math.MaxUint32 {
+		log.Fatalf("Invalid ARGON2_MEMORY_KIB %d, must be between 1 and %d", config.Argon2MemoryKiB, uint32(math.MaxUint32))
+	}
+	if config.Argon2Iterations < 1 || int64(config.Argon2Iterations) > math.MaxUint32 {
+		log.Fatalf("Invalid ARGON2_ITERATIONS %d, must be between 1 and %d", config.Argon2Iterations, uint32(math.MaxUint32))
+	}
+	if config.Argon2Parallelism < 1 || config.Argon2Parallelism > math.MaxUint8 {
+		log.Fatalf("Invalid ARGON2_PARALLELISM %d, must be between 1 and %d", config.Argon2Parallelism, math.MaxUint8)
+	}
+
+	config.KeyProviders, config.EncryptKeyID = loadKeyProviders(dataDir, utils.Argon2Params{
+		Memory:      uint32(config.Argon2MemoryKiB),
+		Iterations:  uint32(config.Argon2Iterations),
+		Parallelism: uint8(config.Argon2Parallelism),
+	})
+	if config.AtRestEncryption && len(config.KeyProviders) == 0 {
+		// A generated key would be lost on restart along with everything
+		// sealed under it, so at-rest encryption needs an explicit key.
+		log.Fatalf("AT_REST_ENCRYPTION requires a master key, %s", MasterKeySources)
 	}
 
-	log.Printf("Configuration loaded: service=%s, port=%s", config.ServiceName, config.ServicePort)
+	if (config.TLSCertPath == "") != (config.TLSKeyPath == "") {
+		log.Fatalf("TLS_CERT_PATH and TLS_KEY_PATH must be set together")
+	}
+
+	if !config.TLSEnabled && config.MTLSMode != MTLSOff {
+		log.Printf("Warning: MTLS_MODE=%s requires TLS, ignoring TLS_ENABLED=false", config.MTLSMode)
+		config.TLSEnabled = true
+	}
+
+	if config.OIDCIssuerURL != "" && (config.OIDCClientID == "" || config.OIDCRedirectURL == "") {
+		log.Printf("Warning: OIDC_ISSUER_URL is set but OIDC_CLIENT_ID or OIDC_REDIRECT_URL is missing, OIDC login disabled")
+		config.OIDCIssuerURL = ""
+	}
+
+	log.Printf("Configuration loaded: service=%s, port=%s, registration=%s", config.ServiceName, config.ServicePort, config.RegistrationMode)
 	return config
 }
 
+// MasterKeySources lists the settings a master key can come from, for
+// error messages.
+const MasterKeySources = "set ENCRYPT_KEY, ENCRYPT_KEY_FILE, ENCRYPT_PASSPHRASE, VAULT_TRANSIT_KEY or ENCRYPT_KEYS"
+
+// loadKeyProviders works out where the master keys come from. The key named
+// DefaultEncryptKeyID comes from one of ENCRYPT_KEY, ENCRYPT_KEY_FILE,
+// ENCRYPT_PASSPHRASE (run through Argon2id with a salt kept next to the
+// database, created once with the init-passphrase command) or a Vault
+// Transit KMS (VAULT_ADDR, VAULT_TOKEN and VAULT_TRANSIT_KEY); ENCRYPT_KEYS
+// adds more as "id:key,id:key". Old keys stay listed after a rotation so
+// rows sealed under them can still be read; ENCRYPT_KEY_ID picks the one new
+// data is sealed with. Keys are given as "base64:..." or "hex:...", see
+// utils.ParseKey, and any malformed key stops the server. Keys from files,
+// passphrases and the KMS are fetched when the server starts, see main.
+func loadKeyProviders(dataDir string, kdfParams utils.Argon2Params) (map[string]utils.KeyProvider, string) {
+	providers := make(map[string]utils.KeyProvider)
+
+	keyValue := os.Getenv("ENCRYPT_KEY")
+	keyFile := os.Getenv("ENCRYPT_KEY_FILE")
+	passphrase := os.Getenv("ENCRYPT_PASSPHRASE")
+	transitKey := os.Getenv("VAULT_TRANSIT_KEY")
+
+	sources := 0
+	for _, source := range []string{keyValue, keyFile, passphrase, transitKey} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		log.Fatalf("Set only one of ENCRYPT_KEY, ENCRYPT_KEY_FILE, ENCRYPT_PASSPHRASE and VAULT_TRANSIT_KEY")
+	}
+
+	switch {
+	case keyValue != "":
+		key, err := utils.ParseKey(keyValue)
+		if err != nil {
+			log.Fatalf("Invalid ENCRYPT_KEY: %v", err)
+		}
+		providers[DefaultEncryptKeyID] = utils.StaticKeyProvider{Key: key}
+	case keyFile != "":
+		providers[DefaultEncryptKeyID] = utils.FileKeyProvider{Path: keyFile}
+	case passphrase != "":
+		providers[DefaultEncryptKeyID] = utils.PassphraseKeyProvider{
+			Passphrase: passphrase,
+			ParamsPath: getEnvOrDefault("ENCRYPT_PASSPHRASE_PARAMS_PATH", filepath.Join(dataDir, "master_key.params")),
+			Params:     kdfParams,
+		}
+	case transitKey != "":
+		address := os.Getenv("VAULT_ADDR")
+		if address == "" {
+			log.Fatalf("VAULT_TRANSIT_KEY requires VAULT_ADDR")
+		}
+		providers[DefaultEncryptKeyID] = &utils.TransitKeyProvider{
+			Address:        address,
+			Token:          os.Getenv("VAULT_TOKEN"),
+			Mount:          getEnvOrDefault("VAULT_TRANSIT_MOUNT", "transit"),
+			KeyName:        transitKey,
+			WrappedKeyPath: getEnvOrDefault("VAULT_WRAPPED_KEY_PATH", filepath.Join(dataDir, "master_key.vault")),
+		}
+	}
+
+	for _, entry := range strings.Split(os.Getenv("ENCRYPT_KEYS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, value, ok := strings.Cut(entry, ":")
+		if !ok || id == "" || value == "" {
+			log.Fatalf("Invalid ENCRYPT_KEYS entry %q, expected id:key", entry)
+		}
+		if _, dup := providers[id]; dup {
+			log.Fatalf("Duplicate encryption key ID %q", id)
+		}
+		key, err := utils.ParseKey(value)
+		if err != nil {
+			log.Fatalf("Invalid encryption key %q: %v", id, err)
+		}
+		providers[id] = utils.StaticKeyProvider{Key: key}
+	}
+
+	activeID := os.Getenv("ENCRYPT_KEY_ID")
+	if activeID == "" {
+		activeID = DefaultEncryptKeyID
+	}
+	if _, ok := providers[activeID]; !ok && len(providers) > 0 {
+		log.Fatalf("ENCRYPT_KEY_ID %q does not name a configured encryption key", activeID)
+	}
+
+	return providers, activeID
+}
+
 func getEnvOrDefault(key, defaultValue string) string {
 	value := os.Getenv(key)
 	if value == "" {
@@ -73,24 +315,38 @@ func getEnvOrDefault(key, defaultValue string) string {
 	return value
 }
 
-func generateRandomKey(length int) string {
-	keyStart := time.Now()
-	const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	result := make([]byte, length)
-
-	randomBytes, err := os.ReadFile("/dev/urandom")
+func getEnvIntOrDefault(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.Atoi(value)
 	if err != nil {
-		log.Printf("Using fallback key generation method")
-		for i := range result {
-			result[i] = chars[i%len(chars)]
-		}
-		return string(result)
+		log.Printf("Warning: Invalid value for %s (%q), using default %d", key, value, defaultValue)
+		return defaultValue
 	}
+	return parsed
+}
 
-	for i := range result {
-		result[i] = chars[randomBytes[i%len(randomBytes)]%byte(len(chars))]
+func getEnvBoolOrDefault(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Warning: Invalid value for %s (%q), using default %t", key, value, defaultValue)
+		return defaultValue
 	}
+	return parsed
+}
 
+func generateRandomKey(length int) string {
+	keyStart := time.Now()
+	key := make([]byte, length)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("Failed to generate key: %v", err)
+	}
 	log.Printf("Key generated in %v", time.Since(keyStart))
-	return string(result)
+	return hex.EncodeToString(key)
 }
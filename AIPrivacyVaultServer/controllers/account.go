@@ -0,0 +1,227 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"AIPrivacyVaultServer/models"
+	"AIPrivacyVaultServer/utils"
+)
+
+// accountData lists every table holding rows that belong to a user. Anything
+// that stores per-user data must be added here so account deletion purges it.
+var accountData = []struct {
+	table  string
+	column string
+}{
+	{"user_keys", "user_id"},
+	{"file_metadata", "user_id"},
+	{"sessions", "user_id"},
+	{"devices", "user_id"},
+	{"device_certificates", "user_id"},
+	{"oidc_identities", "user_id"},
+	{"recovery_codes", "user_id"},
+	{"audit_log", "user_id"},
+	{"vault_states", "user_id"},
+	{"public_keys", "user_id"},
+	{"item_share_keys", "owner_id"},
+	{"item_share_keys", "recipient_id"},
+	{"item_shares", "owner_id"},
+	{"item_shares", "recipient_id"},
+	{"shared_vault_keys", "user_id"},
+	{"shared_vault_keys", "owner_id"},
+	{"shared_vault_members", "user_id"},
+	{"shared_vault_members", "owner_id"},
+	{"shared_vaults", "owner_id"},
+	{"share_link_accesses", "owner_id"},
+	{"share_links", "owner_id"},
+	{"users", "id"},
+}
+
+// AccountController handles account lifecycle operations
+type AccountController struct {
+	db     *sql.DB
+	auth   *AuthController
+	signer *utils.SigningService
+}
+
+// NewAccountController creates a new account controller
+func NewAccountController(db *sql.DB, auth *AuthController, signer *utils.SigningService) *AccountController {
+	return &AccountController{
+		db:     db,
+		auth:   auth,
+		signer: signer,
+	}
+}
+
+// DeleteAccount removes the caller and everything they own, scrubs the freed
+// pages from the database file and returns a signed receipt of the purge.
+func (ac *AccountController) DeleteAccount(c *gin.Context) {
+	var req models.AccountDeleteRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+
+	userID := c.GetInt64("userID")
+	username := c.GetString("username")
+
+	problem, err := ac.auth.reauthenticate(userID, c.GetString("sessionID"), req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify password"})
+		return
+	}
+	if problem != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": problem})
+		return
+	}
+
+	receipt := models.DeletionReceipt{
+		ReceiptID:   uuid.New().String(),
+		UserID:      userID,
+		Username:    username,
+		RowsDeleted: make(map[string]int64),
+		RowsRemain:  make(map[string]int64),
+	}
+
+	tx, err := ac.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Checked inside the transaction, so two admins deleting their accounts
+	// at once cannot both go. The last account of all may go, as the next
+	// registration bootstraps a new admin.
+	lastAdmin, err := isLastAdmin(tx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if lastAdmin {
+		c.JSON(http.StatusConflict, gin.H{"error": "The only admin cannot delete their account while other accounts exist"})
+		return
+	}
+
+	// Invites this user redeemed belong to the admin who issued them, so only
+	// the link back to the deleted account is cleared.
+	if _, err := tx.Exec("UPDATE invites SET used_by = NULL WHERE used_by = ?", userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+		return
+	}
+
+	// Invites this user issued stay as the record of who let whom in, but
+	// the ones nobody has used yet stop working.
+	now := time.Now().UTC()
+	if _, err := tx.Exec(
+		"UPDATE invites SET revoked_at = ? WHERE created_by = ? AND used_at IS NULL AND revoked_at IS NULL",
+		now, userID,
+	); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+		return
+	}
+
+	// The key log is append-only, so the account's keys are revoked there
+	// before their rows are purged.
+	if _, err := revokePublicKeys(tx, userID, username, "", now); err != nil {
+		log.Printf("Failed to revoke keys for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+		return
+	}
+
+	// The account's vaults are left as tombstones for their other members
+	// before the purge below, which then finds none of their rows.
+	if err := tombstoneOwnedVaults(tx, userID, now); err != nil {
+		log.Printf("Failed to delete vaults of user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+		return
+	}
+
+	for _, data := range accountData {
+		result, err := tx.Exec("DELETE FROM "+data.table+" WHERE "+data.column+" = ?", userID)
+		if err != nil {
+			log.Printf("Failed to purge %s for user %d: %v", data.table, userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+			return
+		}
+		deleted, _ := result.RowsAffected()
+		receipt.RowsDeleted[data.table] += deleted
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	for _, data := range accountData {
+		var remaining int64
+		if err := ac.db.QueryRow("SELECT COUNT(*) FROM "+data.table+" WHERE "+data.column+" = ?", userID).Scan(&remaining); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify deletion"})
+			return
+		}
+		receipt.RowsRemain[data.table] += remaining
+	}
+
+	var secureDelete int
+	if err := ac.db.QueryRow("PRAGMA secure_delete").Scan(&secureDelete); err != nil {
+		log.Printf("Warning: Failed to read secure_delete pragma: %v", err)
+	}
+	receipt.SecureDelete = secureDelete != 0
+
+	// VACUUM rebuilds the file so no free page still holds the old rows.
+	if _, err := ac.db.Exec("VACUUM"); err != nil {
+		log.Printf("Warning: VACUUM after deleting user %d failed: %v", userID, err)
+	} else {
+		receipt.Vacuumed = true
+	}
+
+	receipt.DeletedAt = time.Now().UTC()
+
+	payload, signature, err := ac.signer.SignStatement(utils.StatementDeletionReceipt, receipt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build receipt"})
+		return
+	}
+
+	log.Printf("Deleted account %d (receipt %s)", userID, receipt.ReceiptID)
+
+	c.JSON(http.StatusOK, models.SignedDeletionReceipt{
+		Receipt:   receipt,
+		Payload:   base64.StdEncoding.EncodeToString(payload),
+		Signature: signature,
+		KeyID:     ac.signer.KeyID(),
+		Algorithm: "Ed25519",
+	})
+}
+
+// isLastAdmin reports whether userID is the only admin while other
+// accounts exist, which would leave nobody able to manage the server.
+func isLastAdmin(db utils.DBTX, userID int64) (bool, error) {
+	var isAdmin bool
+	if err := db.QueryRow("SELECT is_admin FROM users WHERE id = ?", userID).Scan(&isAdmin); err != nil || !isAdmin {
+		return false, err
+	}
+	var otherAdmins, otherUsers int
+	err := db.QueryRow(
+		"SELECT COALESCE(SUM(is_admin), 0), COUNT(*) FROM users WHERE id != ?", userID,
+	).Scan(&otherAdmins, &otherUsers)
+	return otherAdmins == 0 && otherUsers > 0, err
+}
+
+// SigningKey publishes the server's public signing key for verifying receipts.
+func (ac *AccountController) SigningKey(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"key_id":     ac.signer.KeyID(),
+		"public_key": base64.StdEncoding.EncodeToString(ac.signer.PublicKey()),
+		"algorithm":  "Ed25519",
+	})
+}
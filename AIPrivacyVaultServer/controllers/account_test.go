@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"AIPrivacyVaultServer/config"
+	"AIPrivacyVaultServer/models"
+	"AIPrivacyVaultServer/utils"
+)
+
+func TestLastAdminCannotDeleteAccount(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice := s.register("alice")
+	s.register("bob")
+
+	w := s.request(http.MethodDelete, "/api/account", alice, gin.H{"password": testPassword})
+	expectStatus(t, w, http.StatusConflict)
+
+	if _, err := s.db.Exec("UPDATE users SET is_admin = 1 WHERE username = 'bob'"); err != nil {
+		t.Fatal(err)
+	}
+	w = s.request(http.MethodDelete, "/api/account", alice, gin.H{"password": testPassword})
+	expectStatus(t, w, http.StatusOK)
+}
+
+func TestOnlyAccountCanBeDeleted(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice := s.register("alice")
+
+	w := s.request(http.MethodDelete, "/api/account", alice, gin.H{"password": testPassword})
+	expectStatus(t, w, http.StatusOK)
+
+	var signed models.SignedDeletionReceipt
+	decodeBody(t, w, &signed)
+	payload, err := base64.StdEncoding.DecodeString(signed.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := utils.OpenStatement(s.signer.PublicKey(), utils.StatementDeletionReceipt, payload, signed.Signature)
+	if err != nil {
+		t.Fatalf("receipt does not verify: %v", err)
+	}
+	var receipt models.DeletionReceipt
+	if err := json.Unmarshal(encoded, &receipt); err != nil || receipt.Username != "alice" || receipt.RowsRemain["users"] != 0 {
+		t.Fatalf("receipt is %+v (err %v)", receipt, err)
+	}
+
+	// The server is back to its first start, so the next account is admin.
+	s.register("bob")
+	var isAdmin bool
+	if err := s.db.QueryRow("SELECT is_admin FROM users WHERE username = 'bob'").Scan(&isAdmin); err != nil || !isAdmin {
+		t.Fatalf("next account is not an admin (err %v)", err)
+	}
+}
+
+func TestDeleteAccountRevokesUnusedInvites(t *testing.T) {
+	s := newTestServer(t, func(cfg *config.Config) { cfg.RegistrationMode = config.RegistrationInvite })
+	alice := s.register("alice")
+
+	newInvite := func() string {
+		t.Helper()
+		var invite struct {
+			Code string `json:"code"`
+		}
+		w := s.request(http.MethodPost, "/api/admin/invites", alice, nil)
+		expectStatus(t, w, http.StatusCreated)
+		decodeBody(t, w, &invite)
+		return invite.Code
+	}
+	used, unused := newInvite(), newInvite()
+	expectStatus(t, s.request(http.MethodPost, "/api/auth/register", "", registration("bob", used)), http.StatusCreated)
+	if _, err := s.db.Exec("UPDATE users SET is_admin = 1 WHERE username = 'bob'"); err != nil {
+		t.Fatal(err)
+	}
+
+	w := s.request(http.MethodDelete, "/api/account", alice, gin.H{"password": testPassword})
+	expectStatus(t, w, http.StatusOK)
+
+	var total, revoked, redeemed int
+	err := s.db.QueryRow(
+		"SELECT COUNT(*), COUNT(revoked_at), COUNT(used_by) FROM invites",
+	).Scan(&total, &revoked, &redeemed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || revoked != 1 || redeemed != 1 {
+		t.Fatalf("%d invites left, %d revoked and %d redeemed, want 2, 1 and 1", total, revoked, redeemed)
+	}
+
+	expectStatus(t, s.request(http.MethodPost, "/api/auth/register", "", registration("carol", unused)), http.StatusForbidden)
+}
@@ -0,0 +1,60 @@
+package controllers
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"AIPrivacyVaultServer/utils"
+)
+
+// Audit events written to audit_log.
+const (
+	auditRecoveryCodeUsed        = "recovery_code_used"
+	auditRecoveryCodeFailed      = "recovery_code_failed"
+	auditRecoveryCodesRegenerate = "recovery_codes_regenerated"
+)
+
+// recordAudit writes an audit record. The detail and IP address identify the
+// user's devices and network, so they are sealed like other at-rest data.
+func recordAudit(tx *sql.Tx, atRest *utils.FieldCipher, userID int64, event, detail, ipAddress string) error {
+	err := insertAudit(tx, atRest, userID, event, detail, ipAddress)
+	if err != nil {
+		log.Printf("Failed to write audit record %s for user %d: %v", event, userID, err)
+	}
+	return err
+}
+
+// insertAudit writes the record in two steps, so it takes a transaction that
+// keeps them from being seen apart.
+func insertAudit(tx *sql.Tx, atRest *utils.FieldCipher, userID int64, event, detail, ipAddress string) error {
+	cipher, err := atRest.ForUser(tx, userID)
+	if err != nil {
+		return err
+	}
+
+	// The sealed values are bound to the record's ID, which is only known
+	// once the row exists.
+	result, err := tx.Exec(
+		"INSERT INTO audit_log (user_id, event, created_at) VALUES (?, ?, ?)",
+		userID, event, time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	itemID := utils.FormatItemID(id)
+	if detail, err = cipher.Seal(utils.AuditDetail, itemID, detail); err != nil {
+		return err
+	}
+	if ipAddress, err = cipher.Seal(utils.AuditIPAddress, itemID, ipAddress); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE audit_log SET detail = ?, ip_address = ? WHERE id = ?", detail, ipAddress, id)
+	return err
+}
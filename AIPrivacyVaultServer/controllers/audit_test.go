@@ -0,0 +1,27 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestFailedRecoveryIsAudited(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.register("alice")
+
+	w := s.request(http.MethodPost, "/api/auth/recover", "", gin.H{
+		"username": "alice", "recovery_code": "not-a-code", "new_password": testPassword + "!", "device_id": "device-alice",
+	})
+	expectStatus(t, w, http.StatusUnauthorized)
+
+	var event, ipAddress string
+	err := s.db.QueryRow("SELECT event, ip_address FROM audit_log WHERE user_id = (SELECT id FROM users WHERE username = 'alice')").Scan(&event, &ipAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event != auditRecoveryCodeFailed || ipAddress == "" {
+		t.Fatalf("audit record is %q from %q", event, ipAddress)
+	}
+}
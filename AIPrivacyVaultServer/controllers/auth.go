@@ -1,27 +1,84 @@
 package controllers
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/google/uuid"
 
+	"AIPrivacyVaultServer/config"
 	"AIPrivacyVaultServer/models"
+	"AIPrivacyVaultServer/utils"
 )
 
 type AuthController struct {
-	db        *sql.DB
-	jwtSecret string
+	db               *sql.DB
+	jwtSecret        string
+	registrationMode string
+	passwordPolicy   *utils.PasswordPolicy
+	passwordHasher   *utils.PasswordHasher
+	atRest           *utils.FieldCipher
+
+	requireSigning bool
+	signatureSkew  time.Duration
+	nonces         *utils.NonceCache
 }
 
-func NewAuthController(db *sql.DB, jwtSecret string) *AuthController {
+// How a session was signed in, recorded so that sensitive operations can
+// ask for fresh proof of the same kind.
+const (
+	sessionAuthPassword     = "password"
+	sessionAuthOIDC         = "oidc"
+	sessionAuthRecoveryCode = "recovery_code"
+)
+
+// reauthWindow is how recent an identity provider sign-in must be to
+// stand in for a password on accounts that don't have one.
+const reauthWindow = 5 * time.Minute
+
+// maxSignedBodySize bounds how much of a request body is buffered to verify
+// its signature.
+const maxSignedBodySize = 32 << 20
+
+func NewAuthController(db *sql.DB, cfg *config.Config, atRest *utils.FieldCipher) *AuthController {
+	// A list that is configured but unreadable stops the server rather than
+	// silently turning the breach check off.
+	breached, err := utils.OpenBreachedPasswordList(cfg.BreachedPasswordsPath)
+	if err != nil {
+		log.Fatalf("Failed to open breached password list: %v", err)
+	}
+
 	return &AuthController{
-		db:        db,
-		jwtSecret: jwtSecret,
+		db:               db,
+		jwtSecret:        cfg.JWTSecret,
+		registrationMode: cfg.RegistrationMode,
+		passwordPolicy:   utils.NewPasswordPolicy(cfg.PasswordMinLength, cfg.PasswordMaxLength, cfg.PasswordRejectCommon, breached),
+		passwordHasher: utils.NewPasswordHasher(utils.Argon2Params{
+			Memory:      uint32(cfg.Argon2MemoryKiB),
+			Iterations:  uint32(cfg.Argon2Iterations),
+			Parallelism: uint8(cfg.Argon2Parallelism),
+		}),
+		atRest:         atRest,
+		requireSigning: cfg.RequireRequestSigning,
+		signatureSkew:  cfg.RequestSignatureSkew,
+		// A nonce only has to be remembered while its timestamp is still
+		// accepted, i.e. for the skew window on either side of now. Nonces
+		// are kept per user rather than per device key, since a user can
+		// register as many keys as they like; this way one account cannot
+		// take more than its share whatever number of devices it signs from.
+		nonces: utils.NewNonceCache(cfg.NonceCacheSize, cfg.NonceCachePerUser, 2*cfg.RequestSignatureSkew),
 	}
 }
 
@@ -32,23 +89,68 @@ func (ac *AuthController) Register(c *gin.Context) {
 		return
 	}
 
+	if err := ac.checkDeviceKey(req.DevicePublicKey); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	bootstrap, err := isBootstrap(ac.db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !bootstrap {
+		if problem := ac.registrationRefused(req.InviteCode); problem != "" {
+			c.JSON(http.StatusForbidden, gin.H{"error": problem})
+			return
+		}
+	}
+
 	var exists bool
-	err := ac.db.QueryRow("SELECT 1 FROM users WHERE username = ?", req.Username).Scan(&exists)
+	err = ac.db.QueryRow("SELECT 1 FROM users WHERE username = ?", req.Username).Scan(&exists)
 	if err != sql.ErrNoRows {
 		c.JSON(http.StatusConflict, gin.H{"error": "Username already exists"})
 		return
 	}
 
-	passwordHash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err := ac.passwordPolicy.Validate(req.Password, req.Username); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	passwordHash, err := ac.passwordHasher.Hash(req.Password)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
 		return
 	}
 
+	tx, err := ac.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Checked again inside the transaction, so two concurrent first
+	// registrations can't both become admin; the loser is held to the
+	// registration mode like any later account.
+	if bootstrap {
+		if bootstrap, err = isBootstrap(tx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if !bootstrap {
+			if problem := ac.registrationRefused(req.InviteCode); problem != "" {
+				c.JSON(http.StatusForbidden, gin.H{"error": problem})
+				return
+			}
+		}
+	}
+
 	now := time.Now()
-	result, err := ac.db.Exec(
-		"INSERT INTO users (username, password_hash, device_id, created_at, last_sync_at) VALUES (?, ?, ?, ?, ?)",
-		req.Username, passwordHash, req.DeviceID, now, now,
+	result, err := tx.Exec(
+		"INSERT INTO users (username, password_hash, device_id, created_at, last_sync_at, is_admin) VALUES (?, ?, '', ?, ?, ?)",
+		req.Username, passwordHash, now, now, bootstrap,
 	)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
@@ -57,19 +159,87 @@ func (ac *AuthController) Register(c *gin.Context) {
 
 	userID, _ := result.LastInsertId()
 
-	token, expiresAt, err := ac.generateToken(userID, req.Username)
+	if err := ac.setDeviceID(tx, userID, req.DeviceID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store device ID"})
+		return
+	}
+
+	recoveryCodes, err := createRecoveryCodes(tx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create recovery codes"})
+		return
+	}
+
+	if !bootstrap && ac.registrationMode == config.RegistrationInvite {
+		redeemed, err := redeemInvite(tx, req.InviteCode, userID, now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to redeem invite"})
+			return
+		}
+		if !redeemed {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or expired invite code"})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	token, expiresAt, err := ac.issueToken(userID, req.Username, req.DeviceID, req.DevicePublicKey, sessionAuthPassword)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
 	c.JSON(http.StatusCreated, models.AuthResponse{
-		Token:     token,
-		ExpiresAt: expiresAt,
-		UserID:    userID,
+		Token:         token,
+		ExpiresAt:     expiresAt,
+		UserID:        userID,
+		RecoveryCodes: recoveryCodes,
 	})
 }
 
+// isBootstrap reports whether no account exists yet. The very first account
+// is always allowed and becomes the admin, so a fresh server in invite-only
+// or closed mode can still be bootstrapped.
+func isBootstrap(db utils.DBTX) (bool, error) {
+	var userCount int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&userCount); err != nil {
+		return false, err
+	}
+	return userCount == 0, nil
+}
+
+// registrationRefused reports why the registration mode refuses a new
+// account, or "" if it allows one. Invite codes are redeemed separately.
+func (ac *AuthController) registrationRefused(inviteCode string) string {
+	switch ac.registrationMode {
+	case config.RegistrationClosed:
+		return "Registration is closed"
+	case config.RegistrationInvite:
+		if strings.TrimSpace(inviteCode) == "" {
+			return "Invite code required"
+		}
+	}
+	return ""
+}
+
+// redeemInvite marks an unused, unexpired invite as used by userID and
+// reports whether there was one.
+func redeemInvite(tx *sql.Tx, inviteCode string, userID int64, now time.Time) (bool, error) {
+	result, err := tx.Exec(
+		"UPDATE invites SET used_at = ?, used_by = ? WHERE code_hash = ? AND used_at IS NULL AND revoked_at IS NULL AND expires_at > ?",
+		now, userID, utils.HashCode(inviteCode), now,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n == 1, nil
+}
+
 func (ac *AuthController) Login(c *gin.Context) {
 	var req models.AuthRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -77,6 +247,11 @@ func (ac *AuthController) Login(c *gin.Context) {
 		return
 	}
 
+	if err := ac.checkDeviceKey(req.DevicePublicKey); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	var user models.User
 	err := ac.db.QueryRow(
 		"SELECT id, username, password_hash FROM users WHERE username = ?",
@@ -91,18 +266,32 @@ func (ac *AuthController) Login(c *gin.Context) {
 		return
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+	match, needsRehash, err := ac.passwordHasher.Verify(req.Password, user.PasswordHash)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify password"})
+		return
+	}
+	if !match {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
-	_, err = ac.db.Exec("UPDATE users SET device_id = ? WHERE id = ?", req.DeviceID, user.ID)
+	// Upgrade bcrypt or outdated Argon2 hashes now that we hold the plaintext.
+	if needsRehash {
+		if rehashed, err := ac.passwordHasher.Hash(req.Password); err != nil {
+			log.Printf("Warning: Failed to rehash password for user %d: %v", user.ID, err)
+		} else if _, err := ac.db.Exec("UPDATE users SET password_hash = ? WHERE id = ?", rehashed, user.ID); err != nil {
+			log.Printf("Warning: Failed to store rehashed password for user %d: %v", user.ID, err)
+		}
+	}
+
+	err = ac.setDeviceID(ac.db, user.ID, req.DeviceID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update device ID"})
 		return
 	}
 
-	token, expiresAt, err := ac.generateToken(user.ID, user.Username)
+	token, expiresAt, err := ac.issueToken(user.ID, user.Username, req.DeviceID, req.DevicePublicKey, sessionAuthPassword)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
@@ -117,6 +306,13 @@ func (ac *AuthController) Login(c *gin.Context) {
 
 func (ac *AuthController) AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// A client certificate verified by the TLS stack against the device CA
+		// identifies the user and device on its own.
+		if c.Request.TLS != nil && len(c.Request.TLS.VerifiedChains) > 0 {
+			ac.authenticateClientCertificate(c)
+			return
+		}
+
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
@@ -145,25 +341,648 @@ func (ac *AuthController) AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			c.Set("userID", int64(claims["user_id"].(float64)))
-			c.Set("username", claims["username"].(string))
-			c.Next()
-		} else {
+		claims, ok := token.Claims.(jwt.MapClaims)
+		if !ok || !token.Valid {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+			c.Abort()
+			return
+		}
+
+		userIDClaim, okUser := claims["user_id"].(float64)
+		username, okName := claims["username"].(string)
+		sessionID, okSession := claims["sid"].(string)
+		if !okUser || !okName || !okSession {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
 			c.Abort()
 			return
 		}
+		userID := int64(userIDClaim)
+
+		var revokedAt sql.NullTime
+		var deviceID, devicePublicKey string
+		err = ac.db.QueryRow(
+			"SELECT revoked_at, device_id, device_public_key FROM sessions WHERE id = ? AND user_id = ?",
+			sessionID, userID,
+		).Scan(&revokedAt, &deviceID, &devicePublicKey)
+		if err == sql.ErrNoRows || (err == nil && revokedAt.Valid) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has been revoked"})
+			c.Abort()
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			c.Abort()
+			return
+		}
+
+		if !ac.checkDeviceSignature(c, userID, devicePublicKey) {
+			return
+		}
+
+		cipher, err := ac.atRest.ForUser(ac.db, userID)
+		if err == nil {
+			deviceID, err = cipher.Open(utils.SessionDeviceID, sessionID, deviceID)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt device ID"})
+			c.Abort()
+			return
+		}
+
+		c.Set("userID", userID)
+		c.Set("username", username)
+		c.Set("deviceID", deviceID)
+		c.Set("sessionID", sessionID)
+		c.Next()
+	}
+}
+
+func (ac *AuthController) authenticateClientCertificate(c *gin.Context) {
+	leaf := c.Request.TLS.VerifiedChains[0][0]
+
+	certUserID, certDeviceID, err := utils.ParseClientIdentity(leaf)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Client certificate has no vault identity"})
+		c.Abort()
+		return
+	}
+
+	var certID, userID int64
+	var deviceID, username string
+	err = ac.db.QueryRow(
+		"SELECT dc.id, dc.user_id, dc.device_id, u.username FROM device_certificates dc JOIN users u ON u.id = dc.user_id WHERE dc.serial = ? AND dc.status = 'issued'",
+		leaf.SerialNumber.Text(16),
+	).Scan(&certID, &userID, &deviceID, &username)
+	if err == sql.ErrNoRows || (err == nil && userID != certUserID) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Client certificate is not valid"})
+		c.Abort()
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		c.Abort()
+		return
+	}
+
+	cipher, err := ac.atRest.ForUser(ac.db, userID)
+	if err == nil {
+		deviceID, err = cipher.Open(utils.CertDeviceID, utils.FormatItemID(certID), deviceID)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt device ID"})
+		c.Abort()
+		return
+	}
+	if deviceID != certDeviceID {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Client certificate is not valid"})
+		c.Abort()
+		return
+	}
+
+	// A device that registered a signing key at login has to sign its
+	// requests whichever way it authenticates.
+	devicePublicKey, err := deviceSigningKey(ac.db, cipher, userID, deviceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		c.Abort()
+		return
+	}
+	if !ac.checkDeviceSignature(c, userID, devicePublicKey) {
+		return
+	}
+
+	c.Set("userID", userID)
+	c.Set("username", username)
+	c.Set("deviceID", deviceID)
+	c.Set("certSerial", leaf.SerialNumber.Text(16))
+	c.Next()
+}
+
+// checkDeviceSignature verifies the request signature when the device has
+// a signing key, and insists on one when signing is required. It aborts the
+// request and returns false when the request may not proceed.
+func (ac *AuthController) checkDeviceSignature(c *gin.Context, userID int64, devicePublicKey string) bool {
+	if devicePublicKey != "" {
+		if err := ac.verifyRequestSignature(c, userID, devicePublicKey); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			c.Abort()
+			return false
+		}
+	} else if ac.requireSigning {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Request signing is required, log in again with a device key"})
+		c.Abort()
+		return false
+	}
+	return true
+}
+
+// ChangePassword replaces the caller's password after re-checking the current
+// one, then revokes every other session and device certificate so stolen
+// tokens and certificates stop working.
+func (ac *AuthController) ChangePassword(c *gin.Context) {
+	var req models.PasswordChangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	userID := c.GetInt64("userID")
+	username := c.GetString("username")
+
+	match, err := ac.verifyPassword(userID, req.CurrentPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify password"})
+		return
+	}
+	if !match {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+
+	if err := ac.passwordPolicy.Validate(req.NewPassword, username); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	newHash, err := ac.passwordHasher.Hash(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	tx, err := ac.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE users SET password_hash = ? WHERE id = ?", newHash, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password"})
+		return
+	}
+
+	result, err := tx.Exec(
+		"UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND id != ? AND revoked_at IS NULL",
+		time.Now(), userID, c.GetString("sessionID"),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+
+	revokedCerts, err := revokeDeviceCertificates(tx, userID, c.GetString("certSerial"), time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke device certificates"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	revoked, _ := result.RowsAffected()
+	c.JSON(http.StatusOK, gin.H{
+		"message":              "Password changed",
+		"revoked_sessions":     revoked,
+		"revoked_certificates": revokedCerts,
+	})
+}
+
+// AdminMiddleware must run after AuthMiddleware and only lets admins through.
+func (ac *AuthController) AdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var isAdmin bool
+		err := ac.db.QueryRow("SELECT is_admin FROM users WHERE id = ?", c.GetInt64("userID")).Scan(&isAdmin)
+		if err != nil && err != sql.ErrNoRows {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			c.Abort()
+			return
+		}
+		if !isAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			c.Abort()
+			return
+		}
+		c.Next()
 	}
 }
 
-func (ac *AuthController) generateToken(userID int64, username string) (string, int64, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
+// RegistrationMode reports the active registration policy for clients.
+func (ac *AuthController) RegistrationMode() string {
+	return ac.registrationMode
+}
+
+// Recover resets a forgotten password with a single-use recovery code. All
+// existing sessions and device certificates are revoked and a fresh session
+// is issued for this device.
+func (ac *AuthController) Recover(c *gin.Context) {
+	var req models.RecoveryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if err := ac.checkDeviceKey(req.DevicePublicKey); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var userID int64
+	err := ac.db.QueryRow("SELECT id FROM users WHERE username = ?", req.Username).Scan(&userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or recovery code"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var codeID int64
+	err = ac.db.QueryRow(
+		"SELECT id FROM recovery_codes WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		userID, utils.HashCode(req.RecoveryCode),
+	).Scan(&codeID)
+	if err == sql.ErrNoRows {
+		utils.WithTx(ac.db, func(tx *sql.Tx) error {
+			return recordAudit(tx, ac.atRest, userID, auditRecoveryCodeFailed, "", c.ClientIP())
+		})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or recovery code"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if err := ac.passwordPolicy.Validate(req.NewPassword, req.Username); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	newHash, err := ac.passwordHasher.Hash(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	tx, err := ac.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	used, err := tx.Exec("UPDATE recovery_codes SET used_at = ? WHERE id = ? AND used_at IS NULL", now, codeID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to redeem recovery code"})
+		return
+	}
+	if n, _ := used.RowsAffected(); n != 1 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or recovery code"})
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE users SET password_hash = ? WHERE id = ?", newHash, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password"})
+		return
+	}
+
+	if err := ac.setDeviceID(tx, userID, req.DeviceID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update device ID"})
+		return
+	}
+
+	revoked, err := tx.Exec("UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL", now, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+	revokedCount, _ := revoked.RowsAffected()
+
+	revokedCerts, err := revokeDeviceCertificates(tx, userID, "", now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke device certificates"})
+		return
+	}
+
+	var remaining int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL", userID).Scan(&remaining); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	detail := fmt.Sprintf("device=%s revoked_sessions=%d revoked_certificates=%d remaining_codes=%d", req.DeviceID, revokedCount, revokedCerts, remaining)
+	if err := recordAudit(tx, ac.atRest, userID, auditRecoveryCodeUsed, detail, c.ClientIP()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write audit record"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	token, expiresAt, err := ac.issueToken(userID, req.Username, req.DeviceID, req.DevicePublicKey, sessionAuthRecoveryCode)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":                    token,
+		"expires_at":               expiresAt,
+		"user_id":                  userID,
+		"recovery_codes_remaining": remaining,
+	})
+}
+
+// RegenerateRecoveryCodes replaces all of the caller's recovery codes.
+func (ac *AuthController) RegenerateRecoveryCodes(c *gin.Context) {
+	var req models.RecoveryCodesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	userID := c.GetInt64("userID")
+
+	match, err := ac.verifyPassword(userID, req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify password"})
+		return
+	}
+	if !match {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Password is incorrect"})
+		return
+	}
+
+	tx, err := ac.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to replace recovery codes"})
+		return
+	}
+
+	codes, err := createRecoveryCodes(tx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create recovery codes"})
+		return
+	}
+
+	if err := recordAudit(tx, ac.atRest, userID, auditRecoveryCodesRegenerate, "", c.ClientIP()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write audit record"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+const recoveryCodeCount = 10
+
+// createRecoveryCodes stores hashes of a fresh set of codes and returns the
+// plaintext codes, which are shown to the user exactly once.
+func createRecoveryCodes(tx *sql.Tx, userID int64) ([]string, error) {
+	now := time.Now()
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := utils.GenerateCode(10)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(
+			"INSERT INTO recovery_codes (user_id, code_hash, created_at) VALUES (?, ?, ?)",
+			userID, utils.HashCode(code), now,
+		)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+var errDeviceKeyRequired = errors.New("device_public_key is required")
+
+// checkDeviceKey validates the device key sent at login, if any.
+func (ac *AuthController) checkDeviceKey(encoded string) error {
+	if encoded == "" {
+		if ac.requireSigning {
+			return errDeviceKeyRequired
+		}
+		return nil
+	}
+	_, err := utils.ParseDevicePublicKey(encoded)
+	return err
+}
+
+// verifyRequestSignature checks that the request was signed by the session's
+// device key, is recent, and does not reuse a nonce.
+func (ac *AuthController) verifyRequestSignature(c *gin.Context, userID int64, encodedKey string) error {
+	publicKey, err := utils.ParseDevicePublicKey(encodedKey)
+	if err != nil {
+		return err
+	}
+
+	timestamp := c.GetHeader(utils.HeaderRequestTimestamp)
+	nonce := c.GetHeader(utils.HeaderRequestNonce)
+	signature := c.GetHeader(utils.HeaderRequestSignature)
+	if timestamp == "" || nonce == "" || signature == "" {
+		return errors.New("Request signature headers missing")
+	}
+	if len(nonce) < 16 || len(nonce) > 128 {
+		return errors.New("Invalid request nonce")
+	}
+
+	unixSeconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("Invalid request timestamp")
+	}
+	skew := time.Since(time.Unix(unixSeconds, 0))
+	if skew > ac.signatureSkew || skew < -ac.signatureSkew {
+		return errors.New("Request timestamp is stale")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errors.New("Invalid request signature")
+	}
+
+	var body []byte
+	if c.Request.Body != nil {
+		body, err = io.ReadAll(io.LimitReader(c.Request.Body, maxSignedBodySize+1))
+		if err != nil {
+			return errors.New("Failed to read request body")
+		}
+		if len(body) > maxSignedBodySize {
+			return errors.New("Request body too large")
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	message := utils.RequestSigningString(c.Request.Method, c.Request.URL.RequestURI(), body, timestamp, nonce)
+	if !ed25519.Verify(publicKey, message, sig) {
+		return errors.New("Invalid request signature")
+	}
+
+	// Only remember nonces of correctly signed requests, so forged traffic
+	// cannot use up the cache.
+	seen, err := ac.nonces.Seen(strconv.FormatInt(userID, 10), encodedKey+"\x00"+nonce)
+	if err == utils.ErrNonceCacheFull {
+		return errors.New("Too many recent requests, try again shortly")
+	} else if seen {
+		return errors.New("Request nonce has already been used")
+	}
+
+	return nil
+}
+
+// setDeviceID records the user's current device, sealed under their data key.
+func (ac *AuthController) setDeviceID(db utils.DBTX, userID int64, deviceID string) error {
+	cipher, err := ac.atRest.ForUser(db, userID)
+	if err != nil {
+		return err
+	}
+	sealed, err := cipher.Seal(utils.UserDeviceID, utils.FormatItemID(userID), deviceID)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE users SET device_id = ? WHERE id = ?", sealed, userID)
+	return err
+}
+
+// upsertDevice records the signing key a device logged in with. Devices are
+// stored under a blind index of their ID, which is all lookups need.
+func upsertDevice(db utils.DBTX, cipher *utils.UserCipher, userID int64, deviceID, publicKey string, now time.Time) error {
+	_, err := db.Exec(
+		`INSERT INTO devices (user_id, device_id, public_key, created_at, last_seen_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, device_id) DO UPDATE SET public_key = excluded.public_key, last_seen_at = excluded.last_seen_at`,
+		userID, cipher.Index(utils.DeviceIndex, deviceID), publicKey, now, now,
+	)
+	if err != nil || cipher == nil {
+		return err
+	}
+	// Rows written before device IDs were indexed are replaced on the
+	// device's next login.
+	_, err = db.Exec("DELETE FROM devices WHERE user_id = ? AND device_id = ?", userID, deviceID)
+	return err
+}
+
+// deviceSigningKey returns the signing key the device last logged in with,
+// or "" if it has none.
+func deviceSigningKey(db utils.DBTX, cipher *utils.UserCipher, userID int64, deviceID string) (string, error) {
+	var publicKey string
+	err := db.QueryRow(
+		"SELECT public_key FROM devices WHERE user_id = ? AND device_id IN (?, ?) ORDER BY last_seen_at DESC LIMIT 1",
+		userID, cipher.Index(utils.DeviceIndex, deviceID), deviceID,
+	).Scan(&publicKey)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return publicKey, err
+}
+
+// reauthenticate checks that the caller of a sensitive operation is the
+// account holder right now, not just someone holding their token. Accounts
+// with a password must give it; accounts created through an identity
+// provider have none, so their session must come from a sign-in within
+// reauthWindow. It returns the message to show when the check fails.
+func (ac *AuthController) reauthenticate(userID int64, sessionID, password string) (string, error) {
+	var passwordHash string
+	err := ac.db.QueryRow("SELECT password_hash FROM users WHERE id = ?", userID).Scan(&passwordHash)
+	if err != nil {
+		return "", err
+	}
+
+	if passwordHash != utils.UnusablePasswordHash {
+		if password == "" {
+			return "Password is required", nil
+		}
+		match, _, err := ac.passwordHasher.Verify(password, passwordHash)
+		if err != nil {
+			return "", err
+		}
+		if !match {
+			return "Password is incorrect", nil
+		}
+		return "", nil
+	}
+
+	var authMethod string
+	var createdAt time.Time
+	err = ac.db.QueryRow(
+		"SELECT auth_method, created_at FROM sessions WHERE id = ? AND user_id = ?",
+		sessionID, userID,
+	).Scan(&authMethod, &createdAt)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	if err == sql.ErrNoRows || authMethod != sessionAuthOIDC || time.Since(createdAt) > reauthWindow {
+		return "Sign in with your identity provider again to confirm", nil
+	}
+	return "", nil
+}
+
+// verifyPassword re-checks the password of an already authenticated user
+// before sensitive operations.
+func (ac *AuthController) verifyPassword(userID int64, password string) (bool, error) {
+	var passwordHash string
+	err := ac.db.QueryRow("SELECT password_hash FROM users WHERE id = ?", userID).Scan(&passwordHash)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	match, _, err := ac.passwordHasher.Verify(password, passwordHash)
+	return match, err
+}
+
+// issueToken records a new session for the device and returns a JWT bound to
+// it. When a device public key is given, every request made with the token
+// must be signed by that key. authMethod records how the user signed in.
+func (ac *AuthController) issueToken(userID int64, username, deviceID, devicePublicKey, authMethod string) (string, int64, error) {
+	now := time.Now()
+	expirationTime := now.Add(24 * time.Hour)
 	expiresAt := expirationTime.Unix()
+	sessionID := uuid.New().String()
+
+	cipher, err := ac.atRest.ForUser(ac.db, userID)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if devicePublicKey != "" {
+		if err := upsertDevice(ac.db, cipher, userID, deviceID, devicePublicKey, now); err != nil {
+			return "", 0, err
+		}
+	}
+
+	sealedDeviceID, err := cipher.Seal(utils.SessionDeviceID, sessionID, deviceID)
+	if err != nil {
+		return "", 0, err
+	}
+	_, err = ac.db.Exec(
+		"INSERT INTO sessions (id, user_id, device_id, device_public_key, auth_method, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		sessionID, userID, sealedDeviceID, devicePublicKey, authMethod, now, expirationTime,
+	)
+	if err != nil {
+		return "", 0, err
+	}
 
 	claims := jwt.MapClaims{
 		"user_id":  userID,
 		"username": username,
+		"sid":      sessionID,
 		"exp":      expiresAt,
 	}
 
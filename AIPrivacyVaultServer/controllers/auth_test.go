@@ -0,0 +1,324 @@
+package controllers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+
+	"AIPrivacyVaultServer/config"
+	"AIPrivacyVaultServer/utils"
+)
+
+func registration(username, inviteCode string) gin.H {
+	return gin.H{"username": username, "password": testPassword, "device_id": "device-" + username, "invite_code": inviteCode}
+}
+
+func TestRegistrationModes(t *testing.T) {
+	tests := []struct {
+		mode       string
+		secondCode int
+	}{
+		{config.RegistrationOpen, http.StatusCreated},
+		{config.RegistrationInvite, http.StatusForbidden},
+		{config.RegistrationClosed, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			s := newTestServer(t, func(cfg *config.Config) { cfg.RegistrationMode = tt.mode })
+
+			// The first account bootstraps the server in every mode.
+			w := s.request(http.MethodPost, "/api/auth/register", "", registration("alice", ""))
+			expectStatus(t, w, http.StatusCreated)
+			var isAdmin bool
+			if err := s.db.QueryRow("SELECT is_admin FROM users WHERE username = 'alice'").Scan(&isAdmin); err != nil || !isAdmin {
+				t.Fatalf("first account is not an admin (err %v)", err)
+			}
+
+			w = s.request(http.MethodPost, "/api/auth/register", "", registration("bob", ""))
+			expectStatus(t, w, tt.secondCode)
+			if err := s.db.QueryRow("SELECT is_admin FROM users WHERE username = 'bob'").Scan(&isAdmin); err == nil && isAdmin {
+				t.Fatal("second account became an admin")
+			}
+		})
+	}
+}
+
+func TestClosedRegistrationIgnoresInvites(t *testing.T) {
+	s := newTestServer(t, func(cfg *config.Config) { cfg.RegistrationMode = config.RegistrationClosed })
+	admin := s.register("alice")
+
+	var invite struct {
+		Code string `json:"code"`
+	}
+	w := s.request(http.MethodPost, "/api/admin/invites", admin, nil)
+	expectStatus(t, w, http.StatusCreated)
+	decodeBody(t, w, &invite)
+
+	w = s.request(http.MethodPost, "/api/auth/register", "", registration("bob", invite.Code))
+	expectStatus(t, w, http.StatusForbidden)
+}
+
+func TestInvitesAreSingleUse(t *testing.T) {
+	s := newTestServer(t, func(cfg *config.Config) { cfg.RegistrationMode = config.RegistrationInvite })
+	admin := s.register("alice")
+
+	newInvite := func() (int64, string) {
+		t.Helper()
+		var invite struct {
+			ID   int64  `json:"id"`
+			Code string `json:"code"`
+		}
+		w := s.request(http.MethodPost, "/api/admin/invites", admin, nil)
+		expectStatus(t, w, http.StatusCreated)
+		decodeBody(t, w, &invite)
+		return invite.ID, invite.Code
+	}
+
+	_, code := newInvite()
+
+	// A registration the password policy refuses does not use the invite up.
+	weak := registration("bob", code)
+	weak["password"] = "password"
+	expectStatus(t, s.request(http.MethodPost, "/api/auth/register", "", weak), http.StatusBadRequest)
+
+	expectStatus(t, s.request(http.MethodPost, "/api/auth/register", "", registration("bob", "not-an-invite")), http.StatusForbidden)
+	expectStatus(t, s.request(http.MethodPost, "/api/auth/register", "", registration("bob", code)), http.StatusCreated)
+	expectStatus(t, s.request(http.MethodPost, "/api/auth/register", "", registration("carol", code)), http.StatusForbidden)
+
+	var used int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM invites WHERE used_by IS NOT NULL").Scan(&used); err != nil || used != 1 {
+		t.Fatalf("%d invites were marked used (err %v)", used, err)
+	}
+
+	// Nor can an invite be used once it has expired or been revoked.
+	expiredID, expired := newInvite()
+	if _, err := s.db.Exec("UPDATE invites SET expires_at = ? WHERE id = ?", time.Now().Add(-time.Minute), expiredID); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, s.request(http.MethodPost, "/api/auth/register", "", registration("carol", expired)), http.StatusForbidden)
+
+	revokedID, revoked := newInvite()
+	expectStatus(t, s.request(http.MethodDelete, "/api/admin/invites/"+strconv.FormatInt(revokedID, 10), admin, nil), http.StatusOK)
+	expectStatus(t, s.request(http.MethodPost, "/api/auth/register", "", registration("carol", revoked)), http.StatusForbidden)
+
+	var count int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM users WHERE username = 'carol'").Scan(&count); err != nil || count != 0 {
+		t.Fatalf("refused registration left %d accounts behind (err %v)", count, err)
+	}
+}
+
+func (s *testServer) passwordHash(username string) string {
+	s.t.Helper()
+	var hash string
+	if err := s.db.QueryRow("SELECT password_hash FROM users WHERE username = ?", username).Scan(&hash); err != nil {
+		s.t.Fatal(err)
+	}
+	return hash
+}
+
+func login(username, password string) gin.H {
+	return gin.H{"username": username, "password": password, "device_id": "device-" + username}
+}
+
+func TestRegisterStoresArgon2idHash(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.register("alice")
+
+	if hash := s.passwordHash("alice"); !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("password stored as %q", hash)
+	}
+	expectStatus(t, s.request(http.MethodPost, "/api/auth/login", "", login("alice", testPassword)), http.StatusOK)
+	expectStatus(t, s.request(http.MethodPost, "/api/auth/login", "", login("alice", testPassword+"x")), http.StatusUnauthorized)
+}
+
+func TestLoginRehashesOldPasswordHashes(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outdated, err := utils.NewPasswordHasher(utils.Argon2Params{Memory: 32, Iterations: 2, Parallelism: 1}).Hash(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, stored := range map[string]string{"bcrypt": string(bcryptHash), "outdated argon2id": outdated} {
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t, nil)
+			s.register("alice")
+			if _, err := s.db.Exec("UPDATE users SET password_hash = ? WHERE username = 'alice'", stored); err != nil {
+				t.Fatal(err)
+			}
+
+			// A wrong password leaves the old hash alone.
+			expectStatus(t, s.request(http.MethodPost, "/api/auth/login", "", login("alice", "wrong password")), http.StatusUnauthorized)
+			if s.passwordHash("alice") != stored {
+				t.Fatal("hash was replaced after a failed login")
+			}
+
+			expectStatus(t, s.request(http.MethodPost, "/api/auth/login", "", login("alice", testPassword)), http.StatusOK)
+			rehashed := s.passwordHash("alice")
+			if !strings.HasPrefix(rehashed, "$argon2id$v=19$m=64,t=1,p=1$") {
+				t.Fatalf("hash was not upgraded, got %q", rehashed)
+			}
+
+			expectStatus(t, s.request(http.MethodPost, "/api/auth/login", "", login("alice", testPassword)), http.StatusOK)
+			if s.passwordHash("alice") != rehashed {
+				t.Fatal("a current hash was rehashed again")
+			}
+		})
+	}
+}
+
+// breachedPassword passes every other check of the default policy.
+const breachedPassword = "Correct-Horse-Battery-7"
+
+// writeBreachedPasswordList writes a full hash list holding breachedPassword
+// and a few others, sorted as the downloader writes them.
+func writeBreachedPasswordList(t *testing.T) string {
+	t.Helper()
+	var lines []string
+	for _, password := range []string{breachedPassword, "another leaked one", "and a third"} {
+		lines = append(lines, fmt.Sprintf("%X:%d", sha1.Sum([]byte(password)), len(password)))
+	}
+	sort.Strings(lines)
+
+	path := filepath.Join(t.TempDir(), "pwned-passwords-sha1.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\r\n")+"\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBreachedPasswordsAreRejected(t *testing.T) {
+	list := writeBreachedPasswordList(t)
+	s := newTestServer(t, func(cfg *config.Config) { cfg.BreachedPasswordsPath = list })
+
+	w := s.request(http.MethodPost, "/api/auth/register", "", gin.H{
+		"username": "alice", "password": breachedPassword, "device_id": "device-alice",
+	})
+	expectStatus(t, w, http.StatusBadRequest)
+	if !strings.Contains(w.Body.String(), "breach") {
+		t.Fatalf("unexpected refusal %s", w.Body)
+	}
+
+	token := s.register("alice")
+	w = s.request(http.MethodPost, "/api/auth/password", token, gin.H{
+		"current_password": testPassword, "new_password": breachedPassword,
+	})
+	expectStatus(t, w, http.StatusBadRequest)
+	expectStatus(t, s.request(http.MethodPost, "/api/auth/login", "", login("alice", testPassword)), http.StatusOK)
+}
+
+func TestMissingBreachedPasswordListSkipsCheck(t *testing.T) {
+	s := newTestServer(t, func(cfg *config.Config) {
+		cfg.BreachedPasswordsPath = filepath.Join(t.TempDir(), "absent.txt")
+	})
+
+	w := s.request(http.MethodPost, "/api/auth/register", "", gin.H{
+		"username": "alice", "password": breachedPassword, "device_id": "device-alice",
+	})
+	expectStatus(t, w, http.StatusCreated)
+}
+
+// signingDevice is a session whose device registered a signing key.
+type signingDevice struct {
+	token string
+	key   ed25519.PrivateKey
+}
+
+func (s *testServer) loginSigned(username, deviceID string) *signingDevice {
+	s.t.Helper()
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	w := s.request(http.MethodPost, "/api/auth/login", "", gin.H{
+		"username": username, "password": testPassword, "device_id": deviceID,
+		"device_public_key": base64.StdEncoding.EncodeToString(publicKey),
+	})
+	expectStatus(s.t, w, http.StatusOK)
+	var resp struct {
+		Token string `json:"token"`
+	}
+	decodeBody(s.t, w, &resp)
+	return &signingDevice{token: resp.Token, key: privateKey}
+}
+
+// signedGet sends a GET request signed by device at the given time.
+func (s *testServer) signedGet(device *signingDevice, path, nonce string, at time.Time) *httptest.ResponseRecorder {
+	s.t.Helper()
+	req := s.newRequest(http.MethodGet, path, device.token, nil)
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	signature := ed25519.Sign(device.key, utils.RequestSigningString(http.MethodGet, path, nil, timestamp, nonce))
+	req.Header.Set(utils.HeaderRequestTimestamp, timestamp)
+	req.Header.Set(utils.HeaderRequestNonce, nonce)
+	req.Header.Set(utils.HeaderRequestSignature, base64.StdEncoding.EncodeToString(signature))
+	return s.send(req)
+}
+
+func TestSignedRequestsCannotBeReplayed(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.register("alice")
+	device := s.loginSigned("alice", "laptop")
+
+	expectStatus(t, s.signedGet(device, "/api/metadata", "0123456789abcdef", time.Now()), http.StatusOK)
+	w := s.signedGet(device, "/api/metadata", "0123456789abcdef", time.Now())
+	expectStatus(t, w, http.StatusUnauthorized)
+	if !strings.Contains(w.Body.String(), "already been used") {
+		t.Fatalf("replay refused with %s", w.Body)
+	}
+
+	expectStatus(t, s.signedGet(device, "/api/metadata", "fedcba9876543210", time.Now().Add(-time.Hour)), http.StatusUnauthorized)
+	expectStatus(t, s.request(http.MethodGet, "/api/metadata", device.token, nil), http.StatusUnauthorized)
+
+	// The signature covers the path, so it cannot be moved to another one.
+	req := s.newRequest(http.MethodGet, "/api/metadata?all=1", device.token, nil)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := ed25519.Sign(device.key, utils.RequestSigningString(http.MethodGet, "/api/metadata", nil, timestamp, "aaaaaaaaaaaaaaaa"))
+	req.Header.Set(utils.HeaderRequestTimestamp, timestamp)
+	req.Header.Set(utils.HeaderRequestNonce, "aaaaaaaaaaaaaaaa")
+	req.Header.Set(utils.HeaderRequestSignature, base64.StdEncoding.EncodeToString(signature))
+	expectStatus(t, s.send(req), http.StatusUnauthorized)
+}
+
+func TestOneUserCannotExhaustNonceCache(t *testing.T) {
+	s := newTestServer(t, func(cfg *config.Config) {
+		cfg.NonceCacheSize = 30
+		cfg.NonceCachePerUser = 10
+	})
+	s.register("alice")
+	s.register("bob")
+
+	// However many device keys alice signs with, they share her quota.
+	accepted := 0
+	for d := 0; d < 6; d++ {
+		device := s.loginSigned("alice", fmt.Sprintf("device-%d", d))
+		for i := 0; i < 5; i++ {
+			if s.signedGet(device, "/api/metadata", fmt.Sprintf("alice-%02d-%02d-nonce", d, i), time.Now()).Code == http.StatusOK {
+				accepted++
+			}
+		}
+	}
+	if accepted != 10 {
+		t.Fatalf("alice got %d signed requests through, want 10", accepted)
+	}
+
+	bob := s.loginSigned("bob", "phone")
+	for i := 0; i < 10; i++ {
+		expectStatus(t, s.signedGet(bob, "/api/metadata", fmt.Sprintf("bob-nonce-%08d", i), time.Now()), http.StatusOK)
+	}
+}
@@ -0,0 +1,253 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"AIPrivacyVaultServer/config"
+	"AIPrivacyVaultServer/utils"
+)
+
+// testPassword satisfies the default password policy.
+const testPassword = "Tr0ub4dor&3horse-battery"
+
+// testConfig is the configuration tests start from. Argon2 is made cheap,
+// everything else keeps the defaults of config.LoadConfig.
+func testConfig() *config.Config {
+	return &config.Config{
+		JWTSecret:        "test-secret",
+		RegistrationMode: config.RegistrationOpen,
+		InviteTTL:        72 * time.Hour,
+
+		ShareLinkTTL:    24 * time.Hour,
+		ShareLinkMaxTTL: 720 * time.Hour,
+
+		PasswordMinLength:    10,
+		PasswordMaxLength:    72,
+		PasswordRejectCommon: true,
+
+		Argon2MemoryKiB:   64,
+		Argon2Iterations:  1,
+		Argon2Parallelism: 1,
+
+		RequestSignatureSkew: 300 * time.Second,
+		NonceCacheSize:       100000,
+		NonceCachePerUser:    2000,
+	}
+}
+
+// testServer serves the API the way main does, over a fresh database.
+type testServer struct {
+	t      *testing.T
+	db     *sql.DB
+	auth   *AuthController
+	signer *utils.SigningService
+	router *gin.Engine
+}
+
+// newTestServer starts a server with testConfig, changed by configure if
+// it is not nil.
+func newTestServer(t *testing.T, configure func(cfg *config.Config)) *testServer {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	cfg := testConfig()
+	if configure != nil {
+		configure(cfg)
+	}
+
+	dir := t.TempDir()
+	db, err := utils.InitDatabase(filepath.Join(dir, "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	signer, err := utils.LoadOrCreateSigningKey(filepath.Join(dir, "signing_key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authController := NewAuthController(db, cfg, nil)
+	metadataController := NewMetadataController(db, nil, signer)
+	inviteController := NewInviteController(db, cfg.InviteTTL)
+	accountController := NewAccountController(db, authController, signer)
+	sharingController := NewSharingController(db, nil)
+	sharedVaultController := NewSharedVaultController(db, nil)
+	shareLinkController := NewShareLinkController(db, nil, cfg)
+	keyDirectoryController := NewKeyDirectoryController(db, signer)
+
+	router := gin.New()
+	router.POST("/api/auth/register", authController.Register)
+	router.POST("/api/auth/login", authController.Login)
+	router.POST("/api/auth/recover", authController.Recover)
+	router.POST("/api/links/open", shareLinkController.OpenLink)
+
+	authorized := router.Group("/api")
+	authorized.Use(authController.AuthMiddleware())
+	authorized.POST("/auth/password", authController.ChangePassword)
+	authorized.DELETE("/account", accountController.DeleteAccount)
+	authorized.GET("/metadata", metadataController.GetAllMetadata)
+	authorized.POST("/metadata/:id/shares", sharingController.ShareItem)
+	authorized.GET("/metadata/:id/shares", sharingController.ListShares)
+	authorized.POST("/metadata/:id/links", shareLinkController.CreateLink)
+	authorized.GET("/metadata/:id/links/:link_id/accesses", shareLinkController.ListLinkAccesses)
+	authorized.POST("/vaults", sharedVaultController.CreateVault)
+	authorized.DELETE("/vaults/:id/members/:username", sharedVaultController.RemoveMember)
+	authorized.PUT("/vaults/:id/members/:username", sharedVaultController.SetMember)
+	authorized.POST("/sync", metadataController.SyncMetadata)
+	authorized.POST("/keys", keyDirectoryController.RegisterKeys)
+
+	admin := router.Group("/api/admin")
+	admin.Use(authController.AuthMiddleware(), authController.AdminMiddleware())
+	admin.POST("/invites", inviteController.CreateInvite)
+	admin.DELETE("/invites/:id", inviteController.RevokeInvite)
+
+	return &testServer{t: t, db: db, auth: authController, signer: signer, router: router}
+}
+
+// request sends body, marshalled to JSON unless it is nil, with token as
+// the bearer token unless it is "".
+func (s *testServer) request(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	s.t.Helper()
+	return s.send(s.newRequest(method, path, token, body))
+}
+
+func (s *testServer) newRequest(method, path, token string, body interface{}) *http.Request {
+	s.t.Helper()
+	var encoded []byte
+	if body != nil {
+		var err error
+		if encoded, err = json.Marshal(body); err != nil {
+			s.t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(encoded))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+func (s *testServer) send(req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+// register creates an account and returns its token.
+func (s *testServer) register(username string) string {
+	s.t.Helper()
+	w := s.request(http.MethodPost, "/api/auth/register", "", gin.H{
+		"username": username, "password": testPassword, "device_id": "device-" + username,
+	})
+	if w.Code != http.StatusCreated {
+		s.t.Fatalf("registering %s: %d %s", username, w.Code, w.Body)
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	decodeBody(s.t, w, &resp)
+	return resp.Token
+}
+
+// publishKeys registers keys for the device username registered with and
+// returns its encryption key.
+func (s *testServer) publishKeys(token, username string) string {
+	s.t.Helper()
+	encryptionKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	signingKey, signingPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	encodedEncryption := base64.StdEncoding.EncodeToString(encryptionKey.PublicKey().Bytes())
+	encodedSigning := base64.StdEncoding.EncodeToString(signingKey)
+	binding := ed25519.Sign(signingPrivateKey, utils.KeyBindingMessage(username, "device-"+username, encodedEncryption, encodedSigning))
+
+	w := s.request(http.MethodPost, "/api/keys", token, gin.H{
+		"encryption_key": encodedEncryption,
+		"signing_key":    encodedSigning,
+		"signature":      base64.StdEncoding.EncodeToString(binding),
+	})
+	expectStatus(s.t, w, http.StatusCreated)
+	return encodedEncryption
+}
+
+func wrappedKeys(username, encryptionKey string) []gin.H {
+	return []gin.H{{"device_id": "device-" + username, "encryption_key": encryptionKey, "wrapped_key": "AAAA"}}
+}
+
+// createVault creates a vault owned by username and returns its ID.
+func (s *testServer) createVault(token, username, encryptionKey string) string {
+	s.t.Helper()
+	w := s.request(http.MethodPost, "/api/vaults", token, gin.H{
+		"name": testEnvelope(), "wrapped_keys": wrappedKeys(username, encryptionKey),
+	})
+	expectStatus(s.t, w, http.StatusCreated)
+	var vault struct {
+		ID string `json:"id"`
+	}
+	decodeBody(s.t, w, &vault)
+	return vault.ID
+}
+
+func (s *testServer) setVaultMember(token, vaultID, username, role, encryptionKey string) {
+	s.t.Helper()
+	w := s.request(http.MethodPut, "/api/vaults/"+vaultID+"/members/"+username, token, gin.H{
+		"role": role, "wrapped_keys": wrappedKeys(username, encryptionKey),
+	})
+	if w.Code != http.StatusOK && w.Code != http.StatusCreated {
+		s.t.Fatalf("adding %s to vault: %d %s", username, w.Code, w.Body)
+	}
+}
+
+// testEnvelope is encrypted_data a client could have sent.
+func testEnvelope() string {
+	envelope := utils.Envelope{
+		Version:    utils.EnvelopeVersion,
+		Algorithm:  utils.AlgorithmAESGCM,
+		KeyID:      "device",
+		Nonce:      bytes.Repeat([]byte{1}, 12),
+		Ciphertext: bytes.Repeat([]byte{2}, 32),
+	}
+	return envelope.Encode()
+}
+
+// syncItem is a sync request for one item at version in vaultID, or in
+// the caller's own vault if vaultID is "".
+func syncItem(id string, version int, vaultID string) gin.H {
+	return gin.H{"items": []gin.H{{
+		"id": id, "encrypted_data": testEnvelope(), "version": version,
+		"last_modified_at": time.Now().UTC(), "is_deleted": false, "vault_id": vaultID,
+	}}}
+}
+
+func decodeBody(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body, err)
+	}
+}
+
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, want int) {
+	t.Helper()
+	if w.Code != want {
+		t.Fatalf("got status %d (%s), want %d", w.Code, w.Body, want)
+	}
+}
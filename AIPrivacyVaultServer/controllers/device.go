@@ -0,0 +1,357 @@
+package controllers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"AIPrivacyVaultServer/models"
+	"AIPrivacyVaultServer/utils"
+)
+
+// Device certificate lifecycle states.
+const (
+	certStatusPending  = "pending"
+	certStatusIssued   = "issued"
+	certStatusRejected = "rejected"
+	certStatusRevoked  = "revoked"
+)
+
+// revokeDeviceCertificates revokes the user's issued certificates other
+// than keepSerial and rejects their pending requests, so certificates, like
+// sessions, don't outlive a password change or reset. It returns how many
+// issued certificates were revoked.
+func revokeDeviceCertificates(db utils.DBTX, userID int64, keepSerial string, now time.Time) (int64, error) {
+	result, err := db.Exec(
+		"UPDATE device_certificates SET status = ?, revoked_at = ? WHERE user_id = ? AND status = ? AND serial != ?",
+		certStatusRevoked, now, userID, certStatusIssued, keepSerial,
+	)
+	if err != nil {
+		return 0, err
+	}
+	revoked, _ := result.RowsAffected()
+
+	_, err = db.Exec(
+		"UPDATE device_certificates SET status = ?, revoked_at = ? WHERE user_id = ? AND status = ?",
+		certStatusRejected, now, userID, certStatusPending,
+	)
+	return revoked, err
+}
+
+// DeviceCertificateController lets devices request mutual TLS client
+// certificates, which an admin approves before the CA signs them.
+type DeviceCertificateController struct {
+	db       *sql.DB
+	atRest   *utils.FieldCipher
+	ca       *utils.CertificateAuthority
+	validity time.Duration
+}
+
+// NewDeviceCertificateController creates a new device certificate controller
+func NewDeviceCertificateController(db *sql.DB, atRest *utils.FieldCipher, ca *utils.CertificateAuthority, validity time.Duration) *DeviceCertificateController {
+	return &DeviceCertificateController{
+		db:       db,
+		atRest:   atRest,
+		ca:       ca,
+		validity: validity,
+	}
+}
+
+func (dc *DeviceCertificateController) CACertificate(c *gin.Context) {
+	c.Data(http.StatusOK, "application/x-pem-file", dc.ca.CertificatePEM())
+}
+
+func (dc *DeviceCertificateController) RequestCertificate(c *gin.Context) {
+	var req models.DeviceCertificateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if _, err := utils.ParseCSR(req.CSR); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	cert := models.DeviceCertificate{
+		UserID:    c.GetInt64("userID"),
+		DeviceID:  c.GetString("deviceID"),
+		Status:    certStatusPending,
+		CreatedAt: time.Now(),
+	}
+
+	id, err := dc.insertRequest(cert, req.CSR)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store certificate request"})
+		return
+	}
+	cert.ID = id
+
+	c.JSON(http.StatusAccepted, cert)
+}
+
+// insertRequest stores a pending request with its device ID and CSR sealed
+// under the user's data key.
+func (dc *DeviceCertificateController) insertRequest(cert models.DeviceCertificate, csrPEM string) (int64, error) {
+	tx, err := dc.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	cipher, err := dc.atRest.ForUser(tx, cert.UserID)
+	if err != nil {
+		return 0, err
+	}
+
+	// The sealed values are bound to the request's ID, which is only known
+	// once the row exists.
+	result, err := tx.Exec(
+		"INSERT INTO device_certificates (user_id, device_id, csr_pem, status, created_at) VALUES (?, '', '', ?, ?)",
+		cert.UserID, cert.Status, cert.CreatedAt,
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	itemID := utils.FormatItemID(id)
+	deviceID, err := cipher.Seal(utils.CertDeviceID, itemID, cert.DeviceID)
+	if err != nil {
+		return 0, err
+	}
+	if csrPEM, err = cipher.Seal(utils.CertCSR, itemID, csrPEM); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("UPDATE device_certificates SET device_id = ?, csr_pem = ? WHERE id = ?", deviceID, csrPEM, id); err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+func (dc *DeviceCertificateController) GetCertificate(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid certificate ID"})
+		return
+	}
+
+	cert, err := dc.loadCertificate("WHERE id = ? AND user_id = ?", id, c.GetInt64("userID"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Certificate request not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if cert.Status == certStatusIssued {
+		cert.CAPEM = string(dc.ca.CertificatePEM())
+	}
+	c.JSON(http.StatusOK, cert)
+}
+
+func (dc *DeviceCertificateController) ListCertificates(c *gin.Context) {
+	query := "SELECT id, user_id, device_id, status, serial, cert_pem, created_at, issued_at, expires_at, revoked_at FROM device_certificates"
+	var args []interface{}
+	if status := c.Query("status"); status != "" {
+		query += " WHERE status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY created_at DESC"
+
+	rows, err := dc.db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	certs := []models.DeviceCertificate{}
+	for rows.Next() {
+		cert, err := scanDeviceCertificate(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning rows"})
+			return
+		}
+		cert.CertificatePEM = ""
+		certs = append(certs, *cert)
+	}
+	rows.Close()
+
+	// Requests span users, so each is opened with its owner's data key.
+	ciphers := make(map[int64]*utils.UserCipher)
+	for i := range certs {
+		cipher, ok := ciphers[certs[i].UserID]
+		if !ok {
+			if cipher, err = dc.atRest.ForUser(dc.db, certs[i].UserID); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt device ID"})
+				return
+			}
+			ciphers[certs[i].UserID] = cipher
+		}
+		if certs[i].DeviceID, err = cipher.Open(utils.CertDeviceID, utils.FormatItemID(certs[i].ID), certs[i].DeviceID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt device ID"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, certs)
+}
+
+func (dc *DeviceCertificateController) ApproveCertificate(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid certificate ID"})
+		return
+	}
+
+	var userID int64
+	var deviceID, csrPEM, status, username string
+	err = dc.db.QueryRow(
+		"SELECT dc.user_id, dc.device_id, dc.csr_pem, dc.status, u.username FROM device_certificates dc JOIN users u ON u.id = dc.user_id WHERE dc.id = ?",
+		id,
+	).Scan(&userID, &deviceID, &csrPEM, &status, &username)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Certificate request not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if status != certStatusPending {
+		c.JSON(http.StatusConflict, gin.H{"error": "Certificate request is " + status})
+		return
+	}
+
+	itemID := utils.FormatItemID(id)
+	cipher, err := dc.atRest.ForUser(dc.db, userID)
+	if err == nil {
+		deviceID, err = cipher.Open(utils.CertDeviceID, itemID, deviceID)
+	}
+	if err == nil {
+		csrPEM, err = cipher.Open(utils.CertCSR, itemID, csrPEM)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt certificate request"})
+		return
+	}
+
+	csr, err := utils.ParseCSR(csrPEM)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	certPEM, serial, err := dc.ca.IssueClientCertificate(csr, userID, username, deviceID, dc.validity)
+	if err != nil {
+		log.Printf("Failed to issue certificate %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue certificate"})
+		return
+	}
+
+	sealedPEM, err := cipher.Seal(utils.CertPEM, itemID, string(certPEM))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt certificate"})
+		return
+	}
+
+	now := time.Now()
+	_, err = dc.db.Exec(
+		"UPDATE device_certificates SET status = ?, serial = ?, cert_pem = ?, issued_at = ?, expires_at = ? WHERE id = ? AND status = ?",
+		certStatusIssued, serial, sealedPEM, now, now.Add(dc.validity), id, certStatusPending,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store certificate"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Certificate issued", "serial": serial})
+}
+
+func (dc *DeviceCertificateController) RejectCertificate(c *gin.Context) {
+	dc.setStatus(c, certStatusRejected, certStatusPending)
+}
+
+func (dc *DeviceCertificateController) RevokeCertificate(c *gin.Context) {
+	dc.setStatus(c, certStatusRevoked, certStatusIssued)
+}
+
+func (dc *DeviceCertificateController) setStatus(c *gin.Context, newStatus, fromStatus string) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid certificate ID"})
+		return
+	}
+
+	result, err := dc.db.Exec(
+		"UPDATE device_certificates SET status = ?, revoked_at = ? WHERE id = ? AND status = ?",
+		newStatus, time.Now(), id, fromStatus,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update certificate"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No " + fromStatus + " certificate with that ID"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Certificate " + newStatus})
+}
+
+func (dc *DeviceCertificateController) loadCertificate(where string, args ...interface{}) (*models.DeviceCertificate, error) {
+	row := dc.db.QueryRow(
+		"SELECT id, user_id, device_id, status, serial, cert_pem, created_at, issued_at, expires_at, revoked_at FROM device_certificates "+where,
+		args...,
+	)
+	cert, err := scanDeviceCertificate(row)
+	if err != nil {
+		return nil, err
+	}
+
+	cipher, err := dc.atRest.ForUser(dc.db, cert.UserID)
+	if err != nil {
+		return nil, err
+	}
+	itemID := utils.FormatItemID(cert.ID)
+	if cert.DeviceID, err = cipher.Open(utils.CertDeviceID, itemID, cert.DeviceID); err != nil {
+		return nil, err
+	}
+	if cert.CertificatePEM, err = cipher.Open(utils.CertPEM, itemID, cert.CertificatePEM); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanDeviceCertificate(row rowScanner) (*models.DeviceCertificate, error) {
+	var cert models.DeviceCertificate
+	var serial sql.NullString
+	var issuedAt, expiresAt, revokedAt sql.NullTime
+	if err := row.Scan(&cert.ID, &cert.UserID, &cert.DeviceID, &cert.Status, &serial, &cert.CertificatePEM, &cert.CreatedAt, &issuedAt, &expiresAt, &revokedAt); err != nil {
+		return nil, err
+	}
+	cert.Serial = serial.String
+	if issuedAt.Valid {
+		cert.IssuedAt = &issuedAt.Time
+	}
+	if expiresAt.Valid {
+		cert.ExpiresAt = &expiresAt.Time
+	}
+	if revokedAt.Valid {
+		cert.RevokedAt = &revokedAt.Time
+	}
+	return &cert, nil
+}
@@ -0,0 +1,127 @@
+package controllers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"AIPrivacyVaultServer/models"
+	"AIPrivacyVaultServer/utils"
+)
+
+// InviteController lets admins issue and revoke single-use invite codes
+type InviteController struct {
+	db         *sql.DB
+	defaultTTL time.Duration
+}
+
+// NewInviteController creates a new invite controller
+func NewInviteController(db *sql.DB, defaultTTL time.Duration) *InviteController {
+	return &InviteController{
+		db:         db,
+		defaultTTL: defaultTTL,
+	}
+}
+
+func (ic *InviteController) CreateInvite(c *gin.Context) {
+	var req models.InviteRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+
+	ttl := ic.defaultTTL
+	if req.TTLHours > 0 {
+		ttl = time.Duration(req.TTLHours) * time.Hour
+	}
+
+	code, err := utils.GenerateCode(10)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate invite code"})
+		return
+	}
+
+	now := time.Now()
+	invite := models.Invite{
+		Code:      code,
+		CreatedBy: c.GetInt64("userID"),
+		Note:      req.Note,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+
+	result, err := ic.db.Exec(
+		"INSERT INTO invites (code_hash, created_by, note, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		utils.HashCode(code), invite.CreatedBy, invite.Note, invite.CreatedAt, invite.ExpiresAt,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invite"})
+		return
+	}
+	invite.ID, _ = result.LastInsertId()
+
+	// The plaintext code is only ever returned here; the database keeps a hash.
+	c.JSON(http.StatusCreated, invite)
+}
+
+func (ic *InviteController) ListInvites(c *gin.Context) {
+	rows, err := ic.db.Query(
+		"SELECT id, created_by, note, created_at, expires_at, used_at, used_by, revoked_at FROM invites ORDER BY created_at DESC",
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	invites := []models.Invite{}
+	for rows.Next() {
+		var invite models.Invite
+		var usedAt, revokedAt sql.NullTime
+		var usedBy sql.NullInt64
+		if err := rows.Scan(&invite.ID, &invite.CreatedBy, &invite.Note, &invite.CreatedAt, &invite.ExpiresAt, &usedAt, &usedBy, &revokedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning rows"})
+			return
+		}
+		if usedAt.Valid {
+			invite.UsedAt = &usedAt.Time
+		}
+		if usedBy.Valid {
+			invite.UsedBy = &usedBy.Int64
+		}
+		if revokedAt.Valid {
+			invite.RevokedAt = &revokedAt.Time
+		}
+		invites = append(invites, invite)
+	}
+
+	c.JSON(http.StatusOK, invites)
+}
+
+func (ic *InviteController) RevokeInvite(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invite ID"})
+		return
+	}
+
+	result, err := ic.db.Exec(
+		"UPDATE invites SET revoked_at = ? WHERE id = ? AND used_at IS NULL AND revoked_at IS NULL",
+		time.Now(), id,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke invite"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invite not found or already used"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invite revoked"})
+}
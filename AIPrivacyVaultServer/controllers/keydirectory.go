@@ -0,0 +1,572 @@
+package controllers
+
+import (
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"AIPrivacyVaultServer/models"
+	"AIPrivacyVaultServer/utils"
+)
+
+// maxKeyLogEntries caps how many leaves one request for log entries returns.
+const maxKeyLogEntries = 1000
+
+// KeyDirectoryController publishes each device's X25519 encryption key and
+// Ed25519 signing key so other users can share items with it. Every change
+// to the directory is appended to a Merkle transparency log, and responses
+// carry proofs against a signed tree head, so a server that hands out a key
+// it has not also logged for everyone to see can be caught. Leaves name
+// users and devices only by salted commitments, so the log itself does not
+// list who has an account.
+type KeyDirectoryController struct {
+	db     *sql.DB
+	signer *utils.SigningService
+}
+
+// NewKeyDirectoryController creates a new key directory controller
+func NewKeyDirectoryController(db *sql.DB, signer *utils.SigningService) *KeyDirectoryController {
+	return &KeyDirectoryController{
+		db:     db,
+		signer: signer,
+	}
+}
+
+// appendKeyLog adds entry as the next leaf of the key log and returns its
+// index. Call it in the transaction that changes public_keys.
+func appendKeyLog(db utils.DBTX, entry models.KeyLogEntry) (int64, error) {
+	leaf, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+
+	tree, err := utils.KeyLogTree(db)
+	if err != nil {
+		return 0, err
+	}
+	leafHash := utils.MerkleLeafHash(leaf)
+
+	_, err = db.Exec(
+		"INSERT INTO key_log (leaf_index, leaf, leaf_hash, created_at) VALUES (?, ?, ?, ?)",
+		tree.Size, string(leaf), hex.EncodeToString(leafHash), entry.Timestamp,
+	)
+	if err != nil {
+		return 0, err
+	}
+	if err := utils.StoreKeyLogNodes(db, tree, leafHash); err != nil {
+		return 0, err
+	}
+	return tree.Size, nil
+}
+
+// keyLogSalt returns the salt userID's key log commitments are keyed with,
+// giving them one if they have none yet.
+func keyLogSalt(db utils.DBTX, userID int64) (string, error) {
+	var salt string
+	if err := db.QueryRow("SELECT key_log_salt FROM users WHERE id = ?", userID).Scan(&salt); err != nil {
+		return "", err
+	}
+	if salt != "" {
+		return salt, nil
+	}
+
+	salt, err := utils.NewKeyLogSalt()
+	if err != nil {
+		return "", err
+	}
+	if _, err := db.Exec("UPDATE users SET key_log_salt = ? WHERE id = ?", salt, userID); err != nil {
+		return "", err
+	}
+	return salt, nil
+}
+
+// revokePublicKeys logs the revocation of userID's active keys, only those
+// of deviceID unless it is empty, and marks them revoked. It returns how
+// many were revoked.
+func revokePublicKeys(db utils.DBTX, userID int64, username, deviceID string, now time.Time) (int, error) {
+	query := "SELECT id, device_id, encryption_key, signing_key FROM public_keys WHERE user_id = ? AND revoked_at IS NULL"
+	args := []interface{}{userID}
+	if deviceID != "" {
+		query += " AND device_id = ?"
+		args = append(args, deviceID)
+	}
+
+	salt, err := keyLogSalt(db, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	type activeKey struct {
+		id    int64
+		entry models.KeyLogEntry
+	}
+	var active []activeKey
+	for rows.Next() {
+		key := activeKey{entry: models.KeyLogEntry{
+			Action:    models.KeyLogRevoke,
+			User:      utils.KeyLogUserCommitment(salt, username),
+			Timestamp: now,
+		}}
+		var keyDeviceID string
+		if err := rows.Scan(&key.id, &keyDeviceID, &key.entry.EncryptionKey, &key.entry.SigningKey); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		key.entry.Device = utils.KeyLogDeviceCommitment(salt, keyDeviceID)
+		active = append(active, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, key := range active {
+		index, err := appendKeyLog(db, key.entry)
+		if err != nil {
+			return 0, err
+		}
+		_, err = db.Exec(
+			"UPDATE public_keys SET revoked_at = ?, revoked_log_index = ? WHERE id = ?",
+			now, index, key.id,
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(active), nil
+}
+
+func (kc *KeyDirectoryController) signTreeHead(tree *utils.MerkleTree) (*models.SignedTreeHead, error) {
+	root, err := tree.Root()
+	if err != nil {
+		return nil, err
+	}
+	head := models.TreeHead{
+		TreeSize:  tree.Size,
+		RootHash:  hex.EncodeToString(root),
+		Timestamp: time.Now().UTC(),
+	}
+	payload, signature, err := kc.signer.SignStatement(utils.StatementTreeHead, head)
+	if err != nil {
+		return nil, err
+	}
+	return &models.SignedTreeHead{
+		TreeHead:  head,
+		Payload:   base64.StdEncoding.EncodeToString(payload),
+		Signature: signature,
+		KeyID:     kc.signer.KeyID(),
+		Algorithm: "Ed25519",
+	}, nil
+}
+
+// loadPublicKeys returns userID's active keys, only those of deviceID
+// unless it is empty, each with its inclusion proof in tree.
+func loadPublicKeys(db utils.DBTX, tree *utils.MerkleTree, userID int64, deviceID string) ([]models.PublicKey, error) {
+	query := `SELECT u.username, p.device_id, p.encryption_key, p.signing_key, p.binding_signature,
+			p.created_at, p.log_index, l.leaf
+		FROM public_keys p
+		JOIN users u ON u.id = p.user_id
+		JOIN key_log l ON l.leaf_index = p.log_index
+		WHERE p.user_id = ? AND p.revoked_at IS NULL`
+	args := []interface{}{userID}
+	if deviceID != "" {
+		query += " AND p.device_id = ?"
+		args = append(args, deviceID)
+	}
+
+	rows, err := db.Query(query+" ORDER BY p.device_id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []models.PublicKey{}
+	for rows.Next() {
+		key := models.PublicKey{UserID: userID}
+		err := rows.Scan(&key.Username, &key.DeviceID, &key.EncryptionKey, &key.SigningKey, &key.BindingSignature,
+			&key.CreatedAt, &key.LogIndex, &key.Leaf)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i := range keys {
+		proof, err := tree.InclusionProof(keys[i].LogIndex, tree.Size)
+		if err != nil {
+			return nil, err
+		}
+		keys[i].InclusionProof = hexHashes(proof)
+	}
+	return keys, nil
+}
+
+func hexHashes(hashes [][]byte) []string {
+	encoded := make([]string, len(hashes))
+	for i, hash := range hashes {
+		encoded[i] = hex.EncodeToString(hash)
+	}
+	return encoded
+}
+
+// RegisterKeys publishes the calling device's keys, replacing any it
+// published before. The response carries the caller's key log salt, which
+// opens the commitments in the leaf.
+func (kc *KeyDirectoryController) RegisterKeys(c *gin.Context) {
+	var req models.PublicKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	userID := c.GetInt64("userID")
+	username := c.GetString("username")
+	deviceID := c.GetString("deviceID")
+
+	if _, err := utils.ParseEncryptionPublicKey(req.EncryptionKey); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	signingKey, err := utils.ParseDevicePublicKey(req.SigningKey)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	signature, err := base64.StdEncoding.DecodeString(req.Signature)
+	if err != nil || !ed25519.Verify(signingKey, utils.KeyBindingMessage(username, deviceID, req.EncryptionKey, req.SigningKey), signature) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid key binding signature"})
+		return
+	}
+
+	tx, err := kc.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Publishing the same keys again changes nothing, so retries do not
+	// grow the log.
+	var unchanged int
+	err = tx.QueryRow(
+		"SELECT COUNT(*) FROM public_keys WHERE user_id = ? AND device_id = ? AND encryption_key = ? AND signing_key = ? AND revoked_at IS NULL",
+		userID, deviceID, req.EncryptionKey, req.SigningKey,
+	).Scan(&unchanged)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	salt, err := keyLogSalt(tx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	status := http.StatusOK
+	if unchanged == 0 {
+		now := time.Now().UTC()
+		if _, err := revokePublicKeys(tx, userID, username, deviceID, now); err != nil {
+			log.Printf("Failed to revoke keys of device %s for user %d: %v", deviceID, userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register keys"})
+			return
+		}
+
+		// The binding signature stays out of the leaf: anyone could test
+		// guessed usernames and device IDs against it.
+		index, err := appendKeyLog(tx, models.KeyLogEntry{
+			Action:        models.KeyLogRegister,
+			User:          utils.KeyLogUserCommitment(salt, username),
+			Device:        utils.KeyLogDeviceCommitment(salt, deviceID),
+			EncryptionKey: req.EncryptionKey,
+			SigningKey:    req.SigningKey,
+			Timestamp:     now,
+		})
+		if err != nil {
+			log.Printf("Failed to append to key log for user %d: %v", userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register keys"})
+			return
+		}
+
+		_, err = tx.Exec(
+			"INSERT INTO public_keys (user_id, device_id, encryption_key, signing_key, binding_signature, log_index, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			userID, deviceID, req.EncryptionKey, req.SigningKey, req.Signature, index, now,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register keys"})
+			return
+		}
+		status = http.StatusCreated
+	}
+
+	tree, err := utils.KeyLogTree(tx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load key log"})
+		return
+	}
+	keys, err := loadPublicKeys(tx, tree, userID, deviceID)
+	if err != nil || len(keys) != 1 {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load keys"})
+		return
+	}
+	head, err := kc.signTreeHead(tree)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign tree head"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(status, gin.H{
+		"key":       keys[0],
+		"log_salt":  salt,
+		"tree_head": head,
+	})
+}
+
+// RevokeKeys withdraws the keys of one of the caller's devices, such as a
+// lost one, from the directory.
+func (kc *KeyDirectoryController) RevokeKeys(c *gin.Context) {
+	userID := c.GetInt64("userID")
+	username := c.GetString("username")
+	deviceID := c.Param("device_id")
+
+	tx, err := kc.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	revoked, err := revokePublicKeys(tx, userID, username, deviceID, time.Now().UTC())
+	if err != nil {
+		log.Printf("Failed to revoke keys of device %s for user %d: %v", deviceID, userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke keys"})
+		return
+	}
+	if revoked == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No keys registered for device"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Keys revoked"})
+}
+
+// GetKeys returns the active keys of every device of a user, with proofs
+// that each is in the log and the salt that opens the commitments in their
+// leaves.
+func (kc *KeyDirectoryController) GetKeys(c *gin.Context) {
+	tx, err := kc.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	var userID int64
+	var salt string
+	err = tx.QueryRow("SELECT id, key_log_salt FROM users WHERE username = ?", c.Param("username")).Scan(&userID, &salt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	tree, err := utils.KeyLogTree(tx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load key log"})
+		return
+	}
+	keys, err := loadPublicKeys(tx, tree, userID, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load keys"})
+		return
+	}
+	head, err := kc.signTreeHead(tree)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign tree head"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"keys":      keys,
+		"log_salt":  salt,
+		"tree_head": head,
+	})
+}
+
+// GetTreeHead returns the signed head of the key log as it is now.
+func (kc *KeyDirectoryController) GetTreeHead(c *gin.Context) {
+	tree, err := utils.KeyLogTree(kc.db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load key log"})
+		return
+	}
+
+	head, err := kc.signTreeHead(tree)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign tree head"})
+		return
+	}
+	c.JSON(http.StatusOK, head)
+}
+
+// GetLogEntries returns the leaves from start up to but excluding end, at
+// most maxKeyLogEntries at a time.
+func (kc *KeyDirectoryController) GetLogEntries(c *gin.Context) {
+	start, err := strconv.ParseInt(c.DefaultQuery("start", "0"), 10, 64)
+	if err != nil || start < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start"})
+		return
+	}
+	end := start + maxKeyLogEntries
+	if value := c.Query("end"); value != "" {
+		end, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || end < start {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end"})
+			return
+		}
+		if end > start+maxKeyLogEntries {
+			end = start + maxKeyLogEntries
+		}
+	}
+
+	rows, err := kc.db.Query(
+		"SELECT leaf_index, leaf FROM key_log WHERE leaf_index >= ? AND leaf_index < ? ORDER BY leaf_index",
+		start, end,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	entries := []models.KeyLogLeaf{}
+	for rows.Next() {
+		var entry models.KeyLogLeaf
+		if err := rows.Scan(&entry.Index, &entry.Leaf); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning rows"})
+			return
+		}
+		entries = append(entries, entry)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
+
+// treeSizeQuery reads a tree size from the query, defaulting to the
+// current size of the log.
+func treeSizeQuery(c *gin.Context, name string, size int64) (int64, bool) {
+	value := c.Query(name)
+	if value == "" {
+		return size, true
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || parsed < 0 || parsed > size {
+		return 0, false
+	}
+	return parsed, true
+}
+
+// GetInclusionProof returns the audit path for the leaf at index in the
+// tree of tree_size leaves, by default the whole log.
+func (kc *KeyDirectoryController) GetInclusionProof(c *gin.Context) {
+	tree, err := utils.KeyLogTree(kc.db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load key log"})
+		return
+	}
+
+	treeSize, ok := treeSizeQuery(c, "tree_size", tree.Size)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tree_size"})
+		return
+	}
+	index, err := strconv.ParseInt(c.Query("index"), 10, 64)
+	if err != nil || index < 0 || index >= treeSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid index"})
+		return
+	}
+
+	leafHash, err := tree.Node(0, index)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load key log"})
+		return
+	}
+	proof, err := tree.InclusionProof(index, treeSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build proof"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"index":      index,
+		"tree_size":  treeSize,
+		"leaf_hash":  hex.EncodeToString(leafHash),
+		"audit_path": hexHashes(proof),
+	})
+}
+
+// GetConsistencyProof returns the proof that the tree of first leaves is a
+// prefix of the tree of second leaves, by default the whole log.
+func (kc *KeyDirectoryController) GetConsistencyProof(c *gin.Context) {
+	tree, err := utils.KeyLogTree(kc.db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load key log"})
+		return
+	}
+
+	second, ok := treeSizeQuery(c, "second", tree.Size)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid second"})
+		return
+	}
+	first, ok := treeSizeQuery(c, "first", second)
+	if !ok || c.Query("first") == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid first"})
+		return
+	}
+
+	proof, err := tree.ConsistencyProof(first, second)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build proof"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"first":  first,
+		"second": second,
+		"proof":  hexHashes(proof),
+	})
+}
@@ -2,7 +2,6 @@ package controllers
 
 import (
 	"database/sql"
-	"fmt"
 	"net/http"
 	"time"
 
@@ -15,21 +14,33 @@ import (
 
 // MetadataController handles file metadata operations
 type MetadataController struct {
-	db *sql.DB
+	db     *sql.DB
+	atRest *utils.FieldCipher
+	signer *utils.SigningService
 }
 
 // NewMetadataController creates a new metadata controller
-func NewMetadataController(db *sql.DB) *MetadataController {
+func NewMetadataController(db *sql.DB, atRest *utils.FieldCipher, signer *utils.SigningService) *MetadataController {
 	return &MetadataController{
-		db: db,
+		db:     db,
+		atRest: atRest,
+		signer: signer,
 	}
 }
 
 func (mc *MetadataController) GetAllMetadata(c *gin.Context) {
 	userID := c.GetInt64("userID")
 
+	// Load the data key first: creating it writes to user_keys, which must
+	// not happen while the query below still holds a connection.
+	cipher, err := mc.atRest.ForUser(mc.db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load data key"})
+		return
+	}
+
 	rows, err := mc.db.Query(
-		"SELECT id, encrypted_data, version, last_modified_at, is_deleted FROM file_metadata WHERE user_id = ?",
+		"SELECT id, encrypted_data, version, last_modified_at, is_deleted FROM file_metadata WHERE user_id = ? AND vault_id IS NULL",
 		userID,
 	)
 	if err != nil {
@@ -45,6 +56,10 @@ func (mc *MetadataController) GetAllMetadata(c *gin.Context) {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning rows"})
 			return
 		}
+		if err := openItem(cipher, &item); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt metadata"})
+			return
+		}
 		item.UserID = userID
 		items = append(items, item)
 	}
@@ -58,7 +73,7 @@ func (mc *MetadataController) GetMetadata(c *gin.Context) {
 
 	var item models.FileMetadata
 	err := mc.db.QueryRow(
-		"SELECT id, encrypted_data, version, last_modified_at, is_deleted FROM file_metadata WHERE id = ? AND user_id = ?",
+		"SELECT id, encrypted_data, version, last_modified_at, is_deleted FROM file_metadata WHERE id = ? AND user_id = ? AND vault_id IS NULL",
 		id, userID,
 	).Scan(&item.ID, &item.EncryptedData, &item.Version, &item.LastModifiedAt, &item.IsDeleted)
 
@@ -70,6 +85,16 @@ func (mc *MetadataController) GetMetadata(c *gin.Context) {
 		return
 	}
 
+	cipher, err := mc.atRest.ForUser(mc.db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load data key"})
+		return
+	}
+	if err := openItem(cipher, &item); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt metadata"})
+		return
+	}
+
 	item.UserID = userID
 	c.JSON(http.StatusOK, item)
 }
@@ -80,6 +105,10 @@ func (mc *MetadataController) AddMetadata(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 		return
 	}
+	if err := utils.ValidateClientPayload(item.EncryptedData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid encrypted_data: " + err.Error()})
+		return
+	}
 
 	userID := c.GetInt64("userID")
 	item.UserID = userID
@@ -88,15 +117,38 @@ func (mc *MetadataController) AddMetadata(c *gin.Context) {
 	item.LastModifiedAt = time.Now()
 	item.IsDeleted = false
 
-	_, err := mc.db.Exec(
+	tx, err := mc.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	cipher, err := mc.atRest.ForUser(tx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load data key"})
+		return
+	}
+	sealed, err := cipher.Seal(utils.FileMetadataData, item.ID, item.EncryptedData)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt metadata"})
+		return
+	}
+
+	_, err = tx.Exec(
 		"INSERT INTO file_metadata (id, encrypted_data, user_id, version, last_modified_at, is_deleted) VALUES (?, ?, ?, ?, ?, ?)",
-		item.ID, item.EncryptedData, item.UserID, item.Version, item.LastModifiedAt, item.IsDeleted,
+		item.ID, sealed, item.UserID, item.Version, item.LastModifiedAt, item.IsDeleted,
 	)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add metadata"})
 		return
 	}
 
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
 	c.JSON(http.StatusCreated, item)
 }
 
@@ -109,9 +161,20 @@ func (mc *MetadataController) UpdateMetadata(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 		return
 	}
+	if err := utils.ValidateClientPayload(item.EncryptedData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid encrypted_data: " + err.Error()})
+		return
+	}
+
+	tx, err := mc.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback()
 
 	var currentVersion int
-	err := mc.db.QueryRow("SELECT version FROM file_metadata WHERE id = ? AND user_id = ?", id, userID).Scan(&currentVersion)
+	err = tx.QueryRow("SELECT version FROM file_metadata WHERE id = ? AND user_id = ? AND vault_id IS NULL", id, userID).Scan(&currentVersion)
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Metadata not found"})
 		return
@@ -124,15 +187,31 @@ func (mc *MetadataController) UpdateMetadata(c *gin.Context) {
 	item.LastModifiedAt = time.Now()
 	item.UserID = userID
 
-	_, err = mc.db.Exec(
+	cipher, err := mc.atRest.ForUser(tx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load data key"})
+		return
+	}
+	sealed, err := cipher.Seal(utils.FileMetadataData, id, item.EncryptedData)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt metadata"})
+		return
+	}
+
+	_, err = tx.Exec(
 		"UPDATE file_metadata SET encrypted_data = ?, version = ?, last_modified_at = ?, is_deleted = ? WHERE id = ? AND user_id = ?",
-		item.EncryptedData, item.Version, item.LastModifiedAt, item.IsDeleted, id, userID,
+		sealed, item.Version, item.LastModifiedAt, item.IsDeleted, id, userID,
 	)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update metadata"})
 		return
 	}
 
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
 	c.JSON(http.StatusOK, item)
 }
 
@@ -140,8 +219,15 @@ func (mc *MetadataController) DeleteMetadata(c *gin.Context) {
 	id := c.Param("id")
 	userID := c.GetInt64("userID")
 
+	tx, err := mc.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback()
+
 	var currentVersion int
-	err := mc.db.QueryRow("SELECT version FROM file_metadata WHERE id = ? AND user_id = ?", id, userID).Scan(&currentVersion)
+	err = tx.QueryRow("SELECT version FROM file_metadata WHERE id = ? AND user_id = ? AND vault_id IS NULL", id, userID).Scan(&currentVersion)
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Metadata not found"})
 		return
@@ -150,7 +236,7 @@ func (mc *MetadataController) DeleteMetadata(c *gin.Context) {
 		return
 	}
 
-	_, err = mc.db.Exec(
+	_, err = tx.Exec(
 		"UPDATE file_metadata SET version = ?, last_modified_at = ?, is_deleted = ? WHERE id = ? AND user_id = ?",
 		currentVersion+1, time.Now(), true, id, userID,
 	)
@@ -159,6 +245,11 @@ func (mc *MetadataController) DeleteMetadata(c *gin.Context) {
 		return
 	}
 
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{"message": "Metadata deleted"})
 }
 
@@ -170,6 +261,14 @@ func (mc *MetadataController) SyncMetadata(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 		return
 	}
+	// One bad item rejects the whole sync, so nothing from a misbehaving
+	// client is stored.
+	for _, clientItem := range syncReq.Items {
+		if err := utils.ValidateClientPayload(clientItem.EncryptedData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid encrypted_data: " + err.Error(), "id": clientItem.ID})
+			return
+		}
+	}
 
 	tx, err := mc.db.Begin()
 	if err != nil {
@@ -178,33 +277,117 @@ func (mc *MetadataController) SyncMetadata(c *gin.Context) {
 	}
 	defer tx.Rollback()
 
+	cipher, err := mc.atRest.ForUser(tx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load data key"})
+		return
+	}
+
 	var updatedItems []models.FileMetadata
 	var deletedIDs []string
+	var vaultItems []utils.VaultItem
+
+	ciphers := newOwnerCiphers(tx, mc.atRest)
 
 	for _, clientItem := range syncReq.Items {
 		var serverItem models.FileMetadata
 		err := tx.QueryRow(
-			"SELECT id, encrypted_data, version, last_modified_at, is_deleted FROM file_metadata WHERE id = ? AND user_id = ?",
-			clientItem.ID, userID,
-		).Scan(&serverItem.ID, &serverItem.EncryptedData, &serverItem.Version, &serverItem.LastModifiedAt, &serverItem.IsDeleted)
-		fmt.Printf("Processing client item: %v\n", clientItem)
+			"SELECT id, encrypted_data, user_id, version, last_modified_at, is_deleted, COALESCE(vault_id, '') FROM file_metadata WHERE id = ?",
+			clientItem.ID,
+		).Scan(&serverItem.ID, &serverItem.EncryptedData, &serverItem.UserID, &serverItem.Version, &serverItem.LastModifiedAt, &serverItem.IsDeleted, &serverItem.VaultID)
+		if err != nil && err != sql.ErrNoRows {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error checking item"})
+			return
+		}
+
+		// Items in shared vaults are checked against the caller's role.
+		if clientItem.VaultID != "" || (err == nil && serverItem.VaultID != "") {
+			var existing *models.FileMetadata
+			if err == nil {
+				existing = &serverItem
+			}
+			status, denied, err := syncSharedVaultItem(tx, ciphers, userID, clientItem, existing)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sync shared vault item"})
+				return
+			}
+			if denied != "" {
+				c.JSON(status, gin.H{"error": denied, "id": clientItem.ID})
+				return
+			}
+			continue
+		}
+
+		// An item of another user's can only come from a share, and only a
+		// write share lets a newer version through. An ID that was never
+		// shared with the caller gets the same conflict as any other taken
+		// ID, so sync does not reveal whose it is.
+		if err == nil && serverItem.UserID != userID {
+			shared, revoked, err := itemShareStatus(tx, userID, clientItem.ID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error checking item"})
+				return
+			}
+			if !shared {
+				c.JSON(http.StatusConflict, gin.H{"error": "Item ID conflict", "id": clientItem.ID})
+				return
+			}
+			// After a revocation the item is listed in unshared_ids, which
+			// tells the client to drop its copy.
+			if revoked || clientItem.Version <= serverItem.Version {
+				continue
+			}
+			denied, err := sharedWritePermission(tx, userID, clientItem.ID, clientItem.IsDeleted)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error checking item"})
+				return
+			}
+			if denied != "" {
+				c.JSON(http.StatusForbidden, gin.H{"error": denied, "id": clientItem.ID})
+				return
+			}
+
+			ownerCipher, err := ciphers.forUser(serverItem.UserID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load data key"})
+				return
+			}
+			sealed, err := ownerCipher.Seal(utils.FileMetadataData, clientItem.ID, clientItem.EncryptedData)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt metadata"})
+				return
+			}
+			_, err = tx.Exec(
+				"UPDATE file_metadata SET encrypted_data = ?, version = ?, last_modified_at = ? WHERE id = ? AND user_id = ?",
+				sealed, clientItem.Version, clientItem.LastModifiedAt, clientItem.ID, serverItem.UserID,
+			)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update shared item"})
+				return
+			}
+			continue
+		}
+
+		sealed, sealErr := cipher.Seal(utils.FileMetadataData, clientItem.ID, clientItem.EncryptedData)
+		if sealErr != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt metadata"})
+			return
+		}
+
 		if err == sql.ErrNoRows {
 			_, err = tx.Exec(
 				"INSERT INTO file_metadata (id, encrypted_data, user_id, version, last_modified_at, is_deleted) VALUES (?, ?, ?, ?, ?, ?)",
-				clientItem.ID, clientItem.EncryptedData, userID, clientItem.Version, clientItem.LastModifiedAt, clientItem.IsDeleted,
+				clientItem.ID, sealed, userID, clientItem.Version, clientItem.LastModifiedAt, clientItem.IsDeleted,
 			)
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to insert client item"})
 				return
 			}
-		} else if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error checking item"})
-			return
 		} else {
 			if clientItem.Version > serverItem.Version {
 				_, err = tx.Exec(
 					"UPDATE file_metadata SET encrypted_data = ?, version = ?, last_modified_at = ?, is_deleted = ? WHERE id = ? AND user_id = ?",
-					clientItem.EncryptedData, clientItem.Version, clientItem.LastModifiedAt, clientItem.IsDeleted, clientItem.ID, userID,
+					sealed, clientItem.Version, clientItem.LastModifiedAt, clientItem.IsDeleted, clientItem.ID, userID,
 				)
 				if err != nil {
 					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update server item"})
@@ -215,7 +398,7 @@ func (mc *MetadataController) SyncMetadata(c *gin.Context) {
 	}
 
 	rows, err := tx.Query(
-		"SELECT id, encrypted_data, version, last_modified_at, is_deleted FROM file_metadata WHERE user_id = ?",
+		"SELECT id, encrypted_data, version, last_modified_at, is_deleted FROM file_metadata WHERE user_id = ? AND vault_id IS NULL",
 		userID,
 	)
 	if err != nil {
@@ -230,7 +413,12 @@ func (mc *MetadataController) SyncMetadata(c *gin.Context) {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning rows"})
 			return
 		}
+		if err := openItem(cipher, &item); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt metadata"})
+			return
+		}
 		item.UserID = userID
+		vaultItems = append(vaultItems, utils.VaultItem{ID: item.ID, Version: item.Version, Deleted: item.IsDeleted, Data: item.EncryptedData})
 
 		if item.IsDeleted {
 			deletedIDs = append(deletedIDs, item.ID)
@@ -239,6 +427,31 @@ func (mc *MetadataController) SyncMetadata(c *gin.Context) {
 		}
 	}
 
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning rows"})
+		return
+	}
+	rows.Close()
+
+	sharedItems, unsharedIDs, err := loadSharedItems(tx, ciphers, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load shared items"})
+		return
+	}
+
+	vaults, removedVaultIDs, err := loadSharedVaults(tx, ciphers, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load shared vaults"})
+		return
+	}
+
+	vaultItems = append(vaultItems, sharedStateItems(vaults, sharedItems)...)
+	state, err := advanceVaultState(tx, userID, vaultItems)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update vault state"})
+		return
+	}
+
 	now := time.Now()
 	_, err = tx.Exec("UPDATE users SET last_sync_at = ? WHERE id = ?", now, userID)
 	if err != nil {
@@ -251,13 +464,24 @@ func (mc *MetadataController) SyncMetadata(c *gin.Context) {
 		return
 	}
 
+	signedState, err := signVaultState(mc.signer, state)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign vault state"})
+		return
+	}
+
 	syncToken := utils.GenerateSyncToken(userID, now)
 
 	c.JSON(http.StatusOK, models.SyncResponse{
-		UpdatedItems: updatedItems,
-		DeletedIDs:   deletedIDs,
-		SyncToken:    syncToken,
-		Timestamp:    now,
+		UpdatedItems:    updatedItems,
+		DeletedIDs:      deletedIDs,
+		SyncToken:       syncToken,
+		Timestamp:       now,
+		State:           signedState,
+		SharedItems:     sharedItems,
+		UnsharedIDs:     unsharedIDs,
+		Vaults:          vaults,
+		RemovedVaultIDs: removedVaultIDs,
 	})
 }
 
@@ -273,8 +497,17 @@ func (mc *MetadataController) SyncStatus(c *gin.Context) {
 		return
 	}
 
+	cipher, err := mc.atRest.ForUser(mc.db, userID)
+	if err == nil {
+		deviceID, err = cipher.Open(utils.UserDeviceID, utils.FormatItemID(userID), deviceID)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt device ID"})
+		return
+	}
+
 	var itemCount int
-	err = mc.db.QueryRow("SELECT COUNT(*) FROM file_metadata WHERE user_id = ? AND is_deleted = 0", userID).Scan(&itemCount)
+	err = mc.db.QueryRow("SELECT COUNT(*) FROM file_metadata WHERE user_id = ? AND vault_id IS NULL AND is_deleted = 0", userID).Scan(&itemCount)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count items"})
 		return
@@ -287,3 +520,13 @@ func (mc *MetadataController) SyncStatus(c *gin.Context) {
 		"sync_token":   utils.GenerateSyncToken(userID, lastSyncAt),
 	})
 }
+
+// openItem replaces the stored encrypted_data with the client's envelope.
+func openItem(cipher *utils.UserCipher, item *models.FileMetadata) error {
+	data, err := cipher.Open(utils.FileMetadataData, item.ID, item.EncryptedData)
+	if err != nil {
+		return err
+	}
+	item.EncryptedData = data
+	return nil
+}
@@ -0,0 +1,332 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"AIPrivacyVaultServer/config"
+	"AIPrivacyVaultServer/models"
+	"AIPrivacyVaultServer/utils"
+)
+
+const oidcStateTTL = 10 * time.Minute
+
+// OIDCController signs users in through an external OpenID Connect provider
+// and then issues the usual vault JWT. Password login is left untouched.
+type OIDCController struct {
+	db             *sql.DB
+	auth           *AuthController
+	provider       *utils.OIDCProvider
+	appRedirectURL string
+	usernameClaim  string
+	autoCreate     bool
+
+	mu     sync.Mutex
+	states map[string]oidcLoginState
+}
+
+type oidcLoginState struct {
+	codeVerifier    string
+	nonce           string
+	deviceID        string
+	devicePublicKey string
+	inviteCode      string
+	createdAt       time.Time
+}
+
+// NewOIDCController returns nil when no OIDC provider is configured
+func NewOIDCController(db *sql.DB, auth *AuthController, cfg *config.Config) *OIDCController {
+	if cfg.OIDCIssuerURL == "" {
+		return nil
+	}
+
+	return &OIDCController{
+		db:             db,
+		auth:           auth,
+		provider:       utils.NewOIDCProvider(cfg.OIDCIssuerURL, cfg.OIDCClientID, cfg.OIDCClientSecret, cfg.OIDCRedirectURL, cfg.OIDCScopes),
+		appRedirectURL: cfg.OIDCAppRedirectURL,
+		usernameClaim:  cfg.OIDCUsernameClaim,
+		autoCreate:     cfg.OIDCAutoCreate,
+		states:         make(map[string]oidcLoginState),
+	}
+}
+
+func (oc *OIDCController) Login(c *gin.Context) {
+	deviceID := c.Query("device_id")
+	if deviceID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "device_id is required"})
+		return
+	}
+
+	devicePublicKey := c.Query("device_public_key")
+	if err := oc.auth.checkDeviceKey(devicePublicKey); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	state, errState := randomURLToken()
+	nonce, errNonce := randomURLToken()
+	verifier, challenge, errPKCE := utils.GeneratePKCE()
+	if errState != nil || errNonce != nil || errPKCE != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+
+	authURL, err := oc.provider.AuthCodeURL(c.Request.Context(), state, nonce, challenge)
+	if err != nil {
+		log.Printf("OIDC login failed: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider unavailable"})
+		return
+	}
+
+	oc.mu.Lock()
+	oc.pruneStatesLocked()
+	oc.states[state] = oidcLoginState{
+		codeVerifier:    verifier,
+		nonce:           nonce,
+		deviceID:        deviceID,
+		devicePublicKey: devicePublicKey,
+		inviteCode:      c.Query("invite_code"),
+		createdAt:       time.Now(),
+	}
+	oc.mu.Unlock()
+
+	c.Redirect(http.StatusFound, authURL)
+}
+
+func (oc *OIDCController) Callback(c *gin.Context) {
+	if idpError := c.Query("error"); idpError != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Identity provider denied login: " + idpError})
+		return
+	}
+
+	stateParam := c.Query("state")
+	code := c.Query("code")
+	if stateParam == "" || code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing code or state"})
+		return
+	}
+
+	oc.mu.Lock()
+	state, ok := oc.states[stateParam]
+	delete(oc.states, stateParam)
+	oc.mu.Unlock()
+	if !ok || time.Since(state.createdAt) > oidcStateTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Login session expired, please try again"})
+		return
+	}
+
+	rawIDToken, err := oc.provider.Exchange(c.Request.Context(), code, state.codeVerifier)
+	if err != nil {
+		log.Printf("OIDC code exchange failed: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to exchange authorization code"})
+		return
+	}
+
+	claims, err := oc.provider.VerifyIDToken(c.Request.Context(), rawIDToken, state.nonce)
+	if err != nil {
+		log.Printf("OIDC ID token rejected: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid ID token"})
+		return
+	}
+
+	var refused oidcRegistrationRefused
+	userID, username, err := oc.findOrCreateUser(claims, state.inviteCode)
+	if err == errOIDCUserNotProvisioned {
+		c.JSON(http.StatusForbidden, gin.H{"error": "No vault account is linked to this identity"})
+		return
+	} else if errors.As(err, &refused) {
+		c.JSON(http.StatusForbidden, gin.H{"error": string(refused)})
+		return
+	} else if err != nil {
+		log.Printf("OIDC user mapping failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to map identity to a user"})
+		return
+	}
+
+	if err := oc.auth.setDeviceID(oc.db, userID, state.deviceID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update device ID"})
+		return
+	}
+
+	token, expiresAt, err := oc.auth.issueToken(userID, username, state.deviceID, state.devicePublicKey, sessionAuthOIDC)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	// Native clients finish the flow in a web view and pick the token up from
+	// the fragment of their custom-scheme redirect.
+	if oc.appRedirectURL != "" {
+		fragment := url.Values{}
+		fragment.Set("token", token)
+		fragment.Set("expires_at", strconv.FormatInt(expiresAt, 10))
+		fragment.Set("user_id", strconv.FormatInt(userID, 10))
+		c.Redirect(http.StatusFound, oc.appRedirectURL+"#"+fragment.Encode())
+		return
+	}
+
+	c.JSON(http.StatusOK, models.AuthResponse{
+		Token:     token,
+		ExpiresAt: expiresAt,
+		UserID:    userID,
+	})
+}
+
+var errOIDCUserNotProvisioned = errors.New("oidc identity is not linked to a user")
+
+// oidcRegistrationRefused is why the registration mode refused to create an
+// account for a new identity, for showing to the user.
+type oidcRegistrationRefused string
+
+func (e oidcRegistrationRefused) Error() string {
+	return string(e)
+}
+
+// findOrCreateUser returns the user linked to the identity. New identities
+// get an account when auto-creation is on, under the same registration mode
+// as password sign-ups; inviteCode is redeemed in invite-only mode.
+func (oc *OIDCController) findOrCreateUser(claims *utils.OIDCClaims, inviteCode string) (int64, string, error) {
+	issuer := oc.provider.Issuer()
+
+	var userID int64
+	var username string
+	err := oc.db.QueryRow(
+		"SELECT u.id, u.username FROM oidc_identities i JOIN users u ON u.id = i.user_id WHERE i.issuer = ? AND i.subject = ?",
+		issuer, claims.Subject,
+	).Scan(&userID, &username)
+	if err == nil {
+		return userID, username, nil
+	} else if err != sql.ErrNoRows {
+		return 0, "", err
+	}
+
+	if !oc.autoCreate {
+		return 0, "", errOIDCUserNotProvisioned
+	}
+
+	tx, err := oc.db.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	// Anyone the IdP vouches for could be first here, so the admin account
+	// has to be bootstrapped through password registration.
+	bootstrap, err := isBootstrap(tx)
+	if err != nil {
+		return 0, "", err
+	}
+	if bootstrap {
+		return 0, "", oidcRegistrationRefused("The server has not been set up yet")
+	}
+	if problem := oc.auth.registrationRefused(inviteCode); problem != "" {
+		return 0, "", oidcRegistrationRefused(problem)
+	}
+
+	username, err = availableUsername(tx, oc.preferredUsername(claims))
+	if err != nil {
+		return 0, "", err
+	}
+
+	// Callback stores the sealed device ID once the user's data key exists.
+	now := time.Now()
+	result, err := tx.Exec(
+		"INSERT INTO users (username, password_hash, device_id, created_at, last_sync_at, is_admin) VALUES (?, ?, '', ?, ?, 0)",
+		username, utils.UnusablePasswordHash, now, now,
+	)
+	if err != nil {
+		return 0, "", err
+	}
+	userID, _ = result.LastInsertId()
+
+	if oc.auth.registrationMode == config.RegistrationInvite {
+		redeemed, err := redeemInvite(tx, inviteCode, userID, now)
+		if err != nil {
+			return 0, "", err
+		}
+		if !redeemed {
+			return 0, "", oidcRegistrationRefused("Invalid or expired invite code")
+		}
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO oidc_identities (issuer, subject, user_id, created_at) VALUES (?, ?, ?, ?)",
+		issuer, claims.Subject, userID, now,
+	)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, "", err
+	}
+
+	log.Printf("Created user %q for OIDC subject %s", username, claims.Subject)
+	return userID, username, nil
+}
+
+func (oc *OIDCController) preferredUsername(claims *utils.OIDCClaims) string {
+	var candidate string
+	switch oc.usernameClaim {
+	case "email":
+		candidate = claims.Email
+	case "name":
+		candidate = claims.Name
+	case "sub":
+		candidate = claims.Subject
+	default:
+		candidate = claims.PreferredUsername
+	}
+
+	candidate = strings.TrimSpace(candidate)
+	if candidate == "" {
+		candidate = claims.Subject
+	}
+	return candidate
+}
+
+// availableUsername appends a numeric suffix when the IdP username is
+// already taken by a local account.
+func availableUsername(tx *sql.Tx, base string) (string, error) {
+	candidate := base
+	for i := 2; i < 1000; i++ {
+		var exists bool
+		err := tx.QueryRow("SELECT 1 FROM users WHERE username = ?", candidate).Scan(&exists)
+		if err == sql.ErrNoRows {
+			return candidate, nil
+		} else if err != nil {
+			return "", err
+		}
+		candidate = fmt.Sprintf("%s-%d", base, i)
+	}
+	return "", fmt.Errorf("no free username for %q", base)
+}
+
+func (oc *OIDCController) pruneStatesLocked() {
+	for key, state := range oc.states {
+		if time.Since(state.createdAt) > oidcStateTTL {
+			delete(oc.states, key)
+		}
+	}
+}
+
+func randomURLToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
@@ -0,0 +1,673 @@
+package controllers
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"AIPrivacyVaultServer/models"
+	"AIPrivacyVaultServer/utils"
+)
+
+// SharedVaultController manages vaults several users sync into. Like a
+// shared item, a shared vault has its own key, which the server only sees
+// wrapped for each member's devices. The server enforces members' roles
+// when they sync.
+type SharedVaultController struct {
+	db     *sql.DB
+	atRest *utils.FieldCipher
+}
+
+// NewSharedVaultController creates a new shared vault controller
+func NewSharedVaultController(db *sql.DB, atRest *utils.FieldCipher) *SharedVaultController {
+	return &SharedVaultController{
+		db:     db,
+		atRest: atRest,
+	}
+}
+
+// vaultMembership returns userID's role in a vault and the vault's owner,
+// or sql.ErrNoRows if they are not a member or the vault was deleted.
+func vaultMembership(db utils.DBTX, vaultID string, userID int64) (string, int64, error) {
+	var role string
+	var ownerID int64
+	err := db.QueryRow(
+		`SELECT m.role, v.owner_id FROM shared_vault_members m
+		JOIN shared_vaults v ON v.id = m.vault_id
+		WHERE m.vault_id = ? AND m.user_id = ? AND m.removed_at IS NULL AND v.deleted_at IS NULL`,
+		vaultID, userID,
+	).Scan(&role, &ownerID)
+	return role, ownerID, err
+}
+
+// loadVaultKeys returns the vault key as wrapped for userID's devices,
+// leaving out those for device keys revoked from the directory since.
+func loadVaultKeys(db utils.DBTX, vaultID string, userID int64) ([]models.WrappedItemKey, error) {
+	rows, err := db.Query(
+		`SELECT k.device_id, k.encryption_key, k.wrapped_key
+		FROM shared_vault_keys k
+		JOIN public_keys p ON p.user_id = k.user_id AND p.device_id = k.device_id
+			AND p.encryption_key = k.encryption_key AND p.revoked_at IS NULL
+		WHERE k.vault_id = ? AND k.user_id = ?
+		ORDER BY k.device_id`,
+		vaultID, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []models.WrappedItemKey{}
+	for rows.Next() {
+		var key models.WrappedItemKey
+		if err := rows.Scan(&key.DeviceID, &key.EncryptionKey, &key.WrappedKey); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// storeVaultKeys replaces the vault key wrapped for userID's devices.
+func storeVaultKeys(db utils.DBTX, vaultID string, userID, ownerID int64, keys []models.WrappedItemKey) error {
+	if _, err := db.Exec("DELETE FROM shared_vault_keys WHERE vault_id = ? AND user_id = ?", vaultID, userID); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		_, err := db.Exec(
+			"INSERT INTO shared_vault_keys (vault_id, user_id, owner_id, device_id, encryption_key, wrapped_key) VALUES (?, ?, ?, ?, ?, ?)",
+			vaultID, userID, ownerID, key.DeviceID, key.EncryptionKey, key.WrappedKey,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadVaultMemberships returns the shared vaults userID is a member of,
+// and the IDs of those they were removed from or that were deleted.
+func loadVaultMemberships(db utils.DBTX, userID int64) ([]models.SharedVault, []string, error) {
+	rows, err := db.Query(
+		`SELECT v.id, v.name, COALESCE(u.username, ''), m.role, v.created_at, v.deleted_at, m.removed_at
+		FROM shared_vault_members m
+		JOIN shared_vaults v ON v.id = m.vault_id
+		LEFT JOIN users u ON u.id = v.owner_id
+		WHERE m.user_id = ?
+		ORDER BY v.created_at`,
+		userID,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var vaults []models.SharedVault
+	var removedIDs []string
+	for rows.Next() {
+		var vault models.SharedVault
+		var deletedAt, removedAt sql.NullTime
+		if err := rows.Scan(&vault.ID, &vault.Name, &vault.Owner, &vault.Role, &vault.CreatedAt, &deletedAt, &removedAt); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		if deletedAt.Valid || removedAt.Valid {
+			removedIDs = append(removedIDs, vault.ID)
+			continue
+		}
+		vaults = append(vaults, vault)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	for i := range vaults {
+		if vaults[i].WrappedKeys, err = loadVaultKeys(db, vaults[i].ID, userID); err != nil {
+			return nil, nil, err
+		}
+	}
+	return vaults, removedIDs, nil
+}
+
+// loadSharedVaults returns the items of every shared vault userID is a
+// member of, and the IDs of the vaults they no longer are.
+func loadSharedVaults(db utils.DBTX, ciphers *ownerCiphers, userID int64) ([]models.VaultSync, []string, error) {
+	vaults, removedIDs, err := loadVaultMemberships(db, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var synced []models.VaultSync
+	for _, vault := range vaults {
+		rows, err := db.Query(
+			"SELECT id, encrypted_data, user_id, version, last_modified_at, is_deleted FROM file_metadata WHERE vault_id = ?",
+			vault.ID,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var items []models.FileMetadata
+		for rows.Next() {
+			item := models.FileMetadata{VaultID: vault.ID}
+			if err := rows.Scan(&item.ID, &item.EncryptedData, &item.UserID, &item.Version, &item.LastModifiedAt, &item.IsDeleted); err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		vaultSync := models.VaultSync{
+			Vault:        vault,
+			UpdatedItems: []models.FileMetadata{},
+			DeletedIDs:   []string{},
+		}
+		for _, item := range items {
+			cipher, err := ciphers.forUser(item.UserID)
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := openItem(cipher, &item); err != nil {
+				return nil, nil, err
+			}
+			if item.IsDeleted {
+				vaultSync.DeletedIDs = append(vaultSync.DeletedIDs, item.ID)
+			} else {
+				vaultSync.UpdatedItems = append(vaultSync.UpdatedItems, item)
+			}
+		}
+		synced = append(synced, vaultSync)
+	}
+	return synced, removedIDs, nil
+}
+
+// tombstoneOwnedVaults marks every vault ownerID owns deleted, as their
+// account is being deleted. The vault and other members' rows stay so those
+// members' next sync drops the vault, but the name is cleared and owner_id
+// set to 0 on both, so nothing points back at the deleted account.
+func tombstoneOwnedVaults(db utils.DBTX, ownerID int64, now time.Time) error {
+	_, err := db.Exec(
+		"UPDATE shared_vaults SET name = '', owner_id = 0, deleted_at = COALESCE(deleted_at, ?), updated_at = ? WHERE owner_id = ?",
+		now, now, ownerID,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(
+		"UPDATE shared_vault_members SET owner_id = 0 WHERE owner_id = ? AND user_id != ?",
+		ownerID, ownerID,
+	)
+	return err
+}
+
+// formerVaultMember reports whether userID was once a member of a vault
+// that they have left or that has since been deleted.
+func formerVaultMember(db utils.DBTX, vaultID string, userID int64) (bool, error) {
+	var count int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM shared_vault_members WHERE vault_id = ? AND user_id = ?",
+		vaultID, userID,
+	).Scan(&count)
+	return count > 0, err
+}
+
+// syncSharedVaultItem applies a client's copy of an item in a shared vault,
+// existing being the stored item if there is one. If userID's role does not
+// allow the change it returns the status and error to reject the sync with.
+func syncSharedVaultItem(db utils.DBTX, ciphers *ownerCiphers, userID int64, item models.FileMetadata, existing *models.FileMetadata) (int, string, error) {
+	// A stored item belongs to the vault it is stored in, whatever the
+	// client says, and membership is checked before anything about the item
+	// is, so non-members learn nothing of it.
+	vaultID := item.VaultID
+	if existing != nil {
+		vaultID = existing.VaultID
+	}
+	if vaultID == "" {
+		if existing.UserID != userID {
+			return http.StatusConflict, "Item ID conflict", nil
+		}
+		return http.StatusBadRequest, "Items cannot move between vaults", nil
+	}
+
+	role, ownerID, err := vaultMembership(db, vaultID, userID)
+	if err == sql.ErrNoRows {
+		former, err := formerVaultMember(db, vaultID, userID)
+		if err != nil {
+			return 0, "", err
+		}
+		// Items of a vault the caller left, or that was deleted, are
+		// skipped: the response lists the vault in removed_vault_ids, which
+		// tells the client to drop them.
+		if former {
+			return 0, "", nil
+		}
+		if existing != nil {
+			return http.StatusConflict, "Item ID conflict", nil
+		}
+		return http.StatusForbidden, "Not a member of this vault", nil
+	} else if err != nil {
+		return 0, "", err
+	}
+
+	if existing != nil {
+		if item.VaultID != existing.VaultID {
+			return http.StatusBadRequest, "Items cannot move between vaults", nil
+		}
+		// Viewers send back the items they were given, which is fine as
+		// long as nothing changed.
+		if item.Version <= existing.Version {
+			return 0, "", nil
+		}
+	}
+	if role == models.VaultRoleViewer {
+		return http.StatusForbidden, "Vault is read-only for you", nil
+	}
+
+	cipher, err := ciphers.forUser(ownerID)
+	if err != nil {
+		return 0, "", err
+	}
+	sealed, err := cipher.Seal(utils.FileMetadataData, item.ID, item.EncryptedData)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if existing == nil {
+		_, err = db.Exec(
+			"INSERT INTO file_metadata (id, encrypted_data, user_id, version, last_modified_at, is_deleted, vault_id) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			item.ID, sealed, ownerID, item.Version, item.LastModifiedAt, item.IsDeleted, item.VaultID,
+		)
+	} else {
+		_, err = db.Exec(
+			"UPDATE file_metadata SET encrypted_data = ?, version = ?, last_modified_at = ?, is_deleted = ? WHERE id = ? AND vault_id = ?",
+			sealed, item.Version, item.LastModifiedAt, item.IsDeleted, item.ID, item.VaultID,
+		)
+	}
+	return 0, "", err
+}
+
+// CreateVault creates a shared vault owned by the caller.
+func (vc *SharedVaultController) CreateVault(c *gin.Context) {
+	var req models.SharedVaultRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.WrappedKeys) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if err := utils.ValidateClientPayload(req.Name); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid name: " + err.Error()})
+		return
+	}
+
+	userID := c.GetInt64("userID")
+
+	tx, err := vc.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	problem, deviceID, err := checkWrappedKeys(tx, userID, req.WrappedKeys)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem, "device_id": deviceID})
+		return
+	}
+
+	now := time.Now().UTC()
+	vault := models.SharedVault{
+		ID:          uuid.New().String(),
+		Name:        req.Name,
+		Owner:       c.GetString("username"),
+		Role:        models.VaultRoleOwner,
+		CreatedAt:   now,
+		WrappedKeys: req.WrappedKeys,
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO shared_vaults (id, owner_id, name, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+		vault.ID, userID, vault.Name, now, now,
+	)
+	if err == nil {
+		_, err = tx.Exec(
+			"INSERT INTO shared_vault_members (vault_id, user_id, owner_id, role, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+			vault.ID, userID, userID, models.VaultRoleOwner, now, now,
+		)
+	}
+	if err == nil {
+		err = storeVaultKeys(tx, vault.ID, userID, userID, req.WrappedKeys)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create vault"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, vault)
+}
+
+// ListVaults returns the shared vaults the caller is a member of.
+func (vc *SharedVaultController) ListVaults(c *gin.Context) {
+	vaults, removedIDs, err := loadVaultMemberships(vc.db, c.GetInt64("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load vaults"})
+		return
+	}
+	if vaults == nil {
+		vaults = []models.SharedVault{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"vaults":            vaults,
+		"removed_vault_ids": removedIDs,
+	})
+}
+
+// DeleteVault deletes a shared vault and every item in it.
+func (vc *SharedVaultController) DeleteVault(c *gin.Context) {
+	vaultID := c.Param("id")
+	userID := c.GetInt64("userID")
+
+	tx, err := vc.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	role, _, err := vaultMembership(tx, vaultID, userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Vault not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if role != models.VaultRoleOwner {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can delete the vault"})
+		return
+	}
+
+	// The vault and member rows stay so members' next sync drops the vault.
+	now := time.Now().UTC()
+	_, err = tx.Exec("UPDATE shared_vaults SET deleted_at = ?, updated_at = ? WHERE id = ?", now, now, vaultID)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM file_metadata WHERE vault_id = ?", vaultID)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM shared_vault_keys WHERE vault_id = ?", vaultID)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete vault"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Vault deleted"})
+}
+
+// ListMembers returns the members of a vault the caller belongs to.
+func (vc *SharedVaultController) ListMembers(c *gin.Context) {
+	vaultID := c.Param("id")
+
+	if _, _, err := vaultMembership(vc.db, vaultID, c.GetInt64("userID")); err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Vault not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	rows, err := vc.db.Query(
+		`SELECT m.user_id, u.username, m.role, m.created_at, m.updated_at
+		FROM shared_vault_members m JOIN users u ON u.id = m.user_id
+		WHERE m.vault_id = ? AND m.removed_at IS NULL
+		ORDER BY m.created_at`,
+		vaultID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	var memberIDs []int64
+	members := []models.VaultMember{}
+	for rows.Next() {
+		var memberID int64
+		var member models.VaultMember
+		if err := rows.Scan(&memberID, &member.Username, &member.Role, &member.CreatedAt, &member.UpdatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning rows"})
+			return
+		}
+		memberIDs = append(memberIDs, memberID)
+		members = append(members, member)
+	}
+	rows.Close()
+
+	for i := range members {
+		keys, err := loadVaultKeys(vc.db, vaultID, memberIDs[i])
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load wrapped keys"})
+			return
+		}
+		members[i].Devices = []string{}
+		for _, key := range keys {
+			members[i].Devices = append(members[i].Devices, key.DeviceID)
+		}
+	}
+
+	c.JSON(http.StatusOK, members)
+}
+
+// SetMember adds a member to a vault or changes their role, which only the
+// owner may do. Members may also replace the wrapped keys for their own
+// devices, such as to give a new device the vault key.
+func (vc *SharedVaultController) SetMember(c *gin.Context) {
+	vaultID := c.Param("id")
+	userID := c.GetInt64("userID")
+
+	var req models.VaultMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	tx, err := vc.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	role, ownerID, err := vaultMembership(tx, vaultID, userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Vault not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	member := models.VaultMember{Username: c.Param("username"), Role: req.Role}
+	var memberID int64
+	err = tx.QueryRow("SELECT id FROM users WHERE username = ?", member.Username).Scan(&memberID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var currentRole string
+	var removedAt sql.NullTime
+	err = tx.QueryRow(
+		"SELECT role, created_at, removed_at FROM shared_vault_members WHERE vault_id = ? AND user_id = ?",
+		vaultID, memberID,
+	).Scan(&currentRole, &member.CreatedAt, &removedAt)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	exists := err == nil
+	isMember := exists && !removedAt.Valid
+
+	switch {
+	case memberID == userID && req.Role != role:
+		if role == models.VaultRoleOwner {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The owner's role cannot change"})
+		} else {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can change roles"})
+		}
+		return
+	case memberID == userID && len(req.WrappedKeys) == 0:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	case memberID != userID && role != models.VaultRoleOwner:
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can manage members"})
+		return
+	case memberID != userID && req.Role != models.VaultRoleEditor && req.Role != models.VaultRoleViewer:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+		return
+	case !isMember && len(req.WrappedKeys) == 0:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "New members need wrapped keys"})
+		return
+	}
+
+	if len(req.WrappedKeys) > 0 {
+		problem, deviceID, err := checkWrappedKeys(tx, memberID, req.WrappedKeys)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if problem != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": problem, "device_id": deviceID})
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	member.UpdatedAt = now
+	status := http.StatusOK
+	if !exists {
+		member.CreatedAt = now
+		_, err = tx.Exec(
+			"INSERT INTO shared_vault_members (vault_id, user_id, owner_id, role, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+			vaultID, memberID, ownerID, req.Role, now, now,
+		)
+		status = http.StatusCreated
+	} else {
+		_, err = tx.Exec(
+			"UPDATE shared_vault_members SET role = ?, updated_at = ?, removed_at = NULL WHERE vault_id = ? AND user_id = ?",
+			req.Role, now, vaultID, memberID,
+		)
+	}
+	if err == nil && len(req.WrappedKeys) > 0 {
+		err = storeVaultKeys(tx, vaultID, memberID, ownerID, req.WrappedKeys)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update member"})
+		return
+	}
+
+	keys, err := loadVaultKeys(tx, vaultID, memberID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load wrapped keys"})
+		return
+	}
+	member.Devices = []string{}
+	for _, key := range keys {
+		member.Devices = append(member.Devices, key.DeviceID)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(status, member)
+}
+
+// RemoveMember removes a member from a vault, which the owner may do for
+// anyone else and any other member for themselves. A removed member keeps
+// whatever they already decrypted, so the owner's client should move the
+// vault to a new key.
+func (vc *SharedVaultController) RemoveMember(c *gin.Context) {
+	vaultID := c.Param("id")
+	userID := c.GetInt64("userID")
+
+	tx, err := vc.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	role, _, err := vaultMembership(tx, vaultID, userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Vault not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var memberID int64
+	err = tx.QueryRow("SELECT id FROM users WHERE username = ?", c.Param("username")).Scan(&memberID)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if memberID == userID && role == models.VaultRoleOwner {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The owner cannot leave the vault, delete it instead"})
+		return
+	}
+	if memberID != userID && role != models.VaultRoleOwner {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can manage members"})
+		return
+	}
+
+	now := time.Now().UTC()
+	result, err := tx.Exec(
+		"UPDATE shared_vault_members SET removed_at = ?, updated_at = ? WHERE vault_id = ? AND user_id = ? AND removed_at IS NULL",
+		now, now, vaultID, memberID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member"})
+		return
+	}
+	if removed, _ := result.RowsAffected(); removed == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM shared_vault_keys WHERE vault_id = ? AND user_id = ?", vaultID, memberID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed"})
+}
@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"AIPrivacyVaultServer/models"
+)
+
+// vaultTestServer has alice owning a vault with bob as an editor and carol
+// as a viewer, and returns their tokens and the vault's ID.
+func vaultTestServer(t *testing.T) (s *testServer, alice, bob, carol, vaultID string) {
+	t.Helper()
+	s = newTestServer(t, nil)
+	alice, bob, carol = s.register("alice"), s.register("bob"), s.register("carol")
+	aliceKey := s.publishKeys(alice, "alice")
+	bobKey := s.publishKeys(bob, "bob")
+	carolKey := s.publishKeys(carol, "carol")
+
+	vaultID = s.createVault(alice, "alice", aliceKey)
+	s.setVaultMember(alice, vaultID, "bob", models.VaultRoleEditor, bobKey)
+	s.setVaultMember(alice, vaultID, "carol", models.VaultRoleViewer, carolKey)
+	return s, alice, bob, carol, vaultID
+}
+
+func (s *testServer) itemVersion(id string) int {
+	s.t.Helper()
+	var version int
+	if err := s.db.QueryRow("SELECT version FROM file_metadata WHERE id = ?", id).Scan(&version); err != nil {
+		s.t.Fatal(err)
+	}
+	return version
+}
+
+func TestVaultEditorCanWrite(t *testing.T) {
+	s, _, bob, _, vaultID := vaultTestServer(t)
+
+	expectStatus(t, s.request(http.MethodPost, "/api/sync", bob, syncItem("item", 1, vaultID)), http.StatusOK)
+	expectStatus(t, s.request(http.MethodPost, "/api/sync", bob, syncItem("item", 2, vaultID)), http.StatusOK)
+	if version := s.itemVersion("item"); version != 2 {
+		t.Fatalf("item is at version %d, want 2", version)
+	}
+}
+
+func TestVaultViewerCannotWrite(t *testing.T) {
+	s, _, bob, carol, vaultID := vaultTestServer(t)
+	expectStatus(t, s.request(http.MethodPost, "/api/sync", bob, syncItem("item", 1, vaultID)), http.StatusOK)
+
+	expectStatus(t, s.request(http.MethodPost, "/api/sync", carol, syncItem("new-item", 1, vaultID)), http.StatusForbidden)
+	expectStatus(t, s.request(http.MethodPost, "/api/sync", carol, syncItem("item", 2, vaultID)), http.StatusForbidden)
+	if version := s.itemVersion("item"); version != 1 {
+		t.Fatalf("viewer moved the item to version %d", version)
+	}
+
+	// Sending back the version they were given is not a write.
+	expectStatus(t, s.request(http.MethodPost, "/api/sync", carol, syncItem("item", 1, vaultID)), http.StatusOK)
+}
+
+func TestStrangerCannotWriteToVault(t *testing.T) {
+	s, _, bob, _, vaultID := vaultTestServer(t)
+	dave := s.register("dave")
+	expectStatus(t, s.request(http.MethodPost, "/api/sync", bob, syncItem("item", 1, vaultID)), http.StatusOK)
+
+	expectStatus(t, s.request(http.MethodPost, "/api/sync", dave, syncItem("new-item", 1, vaultID)), http.StatusForbidden)
+	expectStatus(t, s.request(http.MethodPost, "/api/sync", dave, syncItem("item", 2, vaultID)), http.StatusConflict)
+}
+
+func TestItemsOfLeftVaultAreSkipped(t *testing.T) {
+	s, alice, bob, _, vaultID := vaultTestServer(t)
+	expectStatus(t, s.request(http.MethodPost, "/api/sync", bob, syncItem("item", 1, vaultID)), http.StatusOK)
+	expectStatus(t, s.request(http.MethodDelete, "/api/vaults/"+vaultID+"/members/bob", alice, nil), http.StatusOK)
+
+	// A device that has not heard it was removed yet still sends the
+	// vault's items along with its own; those are skipped, not refused.
+	request := syncItem("item", 2, vaultID)
+	request["items"] = append(request["items"].([]gin.H), syncItem("own-item", 1, "")["items"].([]gin.H)...)
+	w := s.request(http.MethodPost, "/api/sync", bob, request)
+	expectStatus(t, w, http.StatusOK)
+
+	var resp models.SyncResponse
+	decodeBody(t, w, &resp)
+	if len(resp.RemovedVaultIDs) != 1 || resp.RemovedVaultIDs[0] != vaultID {
+		t.Fatalf("removed_vault_ids is %v, want [%s]", resp.RemovedVaultIDs, vaultID)
+	}
+	if version := s.itemVersion("item"); version != 1 {
+		t.Fatalf("former member moved the item to version %d", version)
+	}
+	if version := s.itemVersion("own-item"); version != 1 {
+		t.Fatalf("own item is at version %d", version)
+	}
+}
@@ -0,0 +1,482 @@
+package controllers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"AIPrivacyVaultServer/config"
+	"AIPrivacyVaultServer/models"
+	"AIPrivacyVaultServer/utils"
+)
+
+// Outcomes recorded for each use of a share link.
+const (
+	linkAccessServed           = "served"
+	linkAccessRevoked          = "revoked"
+	linkAccessExpired          = "expired"
+	linkAccessExhausted        = "exhausted"
+	linkAccessPasswordRequired = "password_required"
+	linkAccessBadPassword      = "bad_password"
+	linkAccessLocked           = "locked"
+	linkAccessItemGone         = "item_unavailable"
+)
+
+// maxLinkPasswordFailures is how many wrong passwords a link accepts before
+// it stops checking them. Link passwords are picked by hand and the link
+// is public, so without a cap they could be guessed. Each attempt claims
+// one of them in share_links.failed_attempts before the password is
+// hashed, in the same transaction that checks it and, for a right
+// password, gives the claim back, so concurrent guesses cannot all get in
+// under the cap.
+const maxLinkPasswordFailures = 5
+
+// ShareLinkController lets a user hand a single item to someone without an
+// account. A link is an unguessable token that serves the item's ciphertext
+// until it expires, runs out of downloads or is revoked. The owner's client
+// puts the item key in the URL fragment, which is never sent to the server.
+type ShareLinkController struct {
+	db                *sql.DB
+	atRest            *utils.FieldCipher
+	passwordHasher    *utils.PasswordHasher
+	passwordMaxLength int
+	defaultTTL        time.Duration
+	maxTTL            time.Duration
+}
+
+// NewShareLinkController creates a new share link controller
+func NewShareLinkController(db *sql.DB, atRest *utils.FieldCipher, cfg *config.Config) *ShareLinkController {
+	return &ShareLinkController{
+		db:     db,
+		atRest: atRest,
+		passwordHasher: utils.NewPasswordHasher(utils.Argon2Params{
+			Memory:      uint32(cfg.Argon2MemoryKiB),
+			Iterations:  uint32(cfg.Argon2Iterations),
+			Parallelism: uint8(cfg.Argon2Parallelism),
+		}),
+		passwordMaxLength: cfg.PasswordMaxLength,
+		defaultTTL:        cfg.ShareLinkTTL,
+		maxTTL:            cfg.ShareLinkMaxTTL,
+	}
+}
+
+// recordLinkAccess logs one use of a link for its owner. The IP address
+// identifies whoever opened the link, so it is sealed like other at-rest
+// data. The record is written in two steps, so it takes a transaction to
+// keep a row without its address from being seen or left behind.
+func recordLinkAccess(tx *sql.Tx, atRest *utils.FieldCipher, linkID, ownerID int64, outcome, ipAddress string) error {
+	cipher, err := atRest.ForUser(tx, ownerID)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(
+		"INSERT INTO share_link_accesses (link_id, owner_id, outcome, accessed_at) VALUES (?, ?, ?, ?)",
+		linkID, ownerID, outcome, time.Now().UTC(),
+	)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	if ipAddress, err = cipher.Seal(utils.ShareLinkIP, utils.FormatItemID(id), ipAddress); err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE share_link_accesses SET ip_address = ? WHERE id = ?", ipAddress, id)
+	return err
+}
+
+// CreateLink creates a share link for one of the caller's own items. The
+// token is only returned here; the database keeps a hash.
+func (lc *ShareLinkController) CreateLink(c *gin.Context) {
+	id := c.Param("id")
+	userID := c.GetInt64("userID")
+
+	var req models.ShareLinkRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+
+	ttl := lc.defaultTTL
+	if req.TTLHours > 0 {
+		ttl = time.Duration(req.TTLHours) * time.Hour
+	}
+	if req.TTLHours < 0 || ttl > lc.maxTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ttl_hours", "max_ttl_hours": int(lc.maxTTL / time.Hour)})
+		return
+	}
+	if req.MaxDownloads < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid max_downloads"})
+		return
+	}
+	if len(req.Password) > lc.passwordMaxLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password is too long"})
+		return
+	}
+
+	var isDeleted bool
+	err := lc.db.QueryRow("SELECT is_deleted FROM file_metadata WHERE id = ? AND user_id = ? AND vault_id IS NULL", id, userID).Scan(&isDeleted)
+	if err == sql.ErrNoRows || isDeleted {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Metadata not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var passwordHash string
+	if req.Password != "" {
+		if passwordHash, err = lc.passwordHasher.Hash(req.Password); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+			return
+		}
+	}
+
+	token, err := utils.GenerateCode(20)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate link token"})
+		return
+	}
+
+	now := time.Now().UTC()
+	link := models.ShareLink{
+		Token:       token,
+		ItemID:      id,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ttl),
+		HasPassword: passwordHash != "",
+	}
+	var maxDownloads sql.NullInt64
+	if req.MaxDownloads > 0 {
+		link.MaxDownloads = &req.MaxDownloads
+		maxDownloads = sql.NullInt64{Int64: int64(req.MaxDownloads), Valid: true}
+	}
+
+	result, err := lc.db.Exec(
+		`INSERT INTO share_links (token_hash, item_id, owner_id, created_at, expires_at, max_downloads, password_hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		utils.HashCode(token), id, userID, link.CreatedAt, link.ExpiresAt, maxDownloads, passwordHash,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create link"})
+		return
+	}
+	link.ID, _ = result.LastInsertId()
+
+	c.JSON(http.StatusCreated, link)
+}
+
+// ListLinks returns the share links of one of the caller's items.
+func (lc *ShareLinkController) ListLinks(c *gin.Context) {
+	id := c.Param("id")
+	userID := c.GetInt64("userID")
+
+	rows, err := lc.db.Query(
+		`SELECT id, created_at, expires_at, max_downloads, download_count, password_hash != '', revoked_at
+		FROM share_links WHERE item_id = ? AND owner_id = ?
+		ORDER BY id`,
+		id, userID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	links := []models.ShareLink{}
+	for rows.Next() {
+		link := models.ShareLink{ItemID: id}
+		var maxDownloads sql.NullInt64
+		if err := rows.Scan(&link.ID, &link.CreatedAt, &link.ExpiresAt, &maxDownloads, &link.DownloadCount, &link.HasPassword, &link.RevokedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning rows"})
+			return
+		}
+		if maxDownloads.Valid {
+			n := int(maxDownloads.Int64)
+			link.MaxDownloads = &n
+		}
+		links = append(links, link)
+	}
+
+	c.JSON(http.StatusOK, links)
+}
+
+// RevokeLink stops a share link from serving its item. Anyone who already
+// downloaded the item keeps it and the key from the link.
+func (lc *ShareLinkController) RevokeLink(c *gin.Context) {
+	linkID, err := strconv.ParseInt(c.Param("link_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid link ID"})
+		return
+	}
+
+	result, err := lc.db.Exec(
+		"UPDATE share_links SET revoked_at = ? WHERE id = ? AND item_id = ? AND owner_id = ? AND revoked_at IS NULL",
+		time.Now().UTC(), linkID, c.Param("id"), c.GetInt64("userID"),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke link"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Link not found or already revoked"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Link revoked"})
+}
+
+// ListLinkAccesses returns every recorded use of one of the caller's links,
+// including the ones that were refused.
+func (lc *ShareLinkController) ListLinkAccesses(c *gin.Context) {
+	userID := c.GetInt64("userID")
+	linkID, err := strconv.ParseInt(c.Param("link_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid link ID"})
+		return
+	}
+
+	var owned int
+	if err := lc.db.QueryRow(
+		"SELECT COUNT(*) FROM share_links WHERE id = ? AND item_id = ? AND owner_id = ?",
+		linkID, c.Param("id"), userID,
+	).Scan(&owned); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if owned == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Link not found"})
+		return
+	}
+
+	cipher, err := lc.atRest.ForUser(lc.db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load encryption key"})
+		return
+	}
+
+	rows, err := lc.db.Query(
+		"SELECT id, outcome, ip_address, accessed_at FROM share_link_accesses WHERE link_id = ? AND owner_id = ? ORDER BY id",
+		linkID, userID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	accesses := []models.ShareLinkAccess{}
+	for rows.Next() {
+		var access models.ShareLinkAccess
+		if err := rows.Scan(&access.ID, &access.Outcome, &access.IPAddress, &access.AccessedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning rows"})
+			return
+		}
+		if access.IPAddress, err = cipher.Open(utils.ShareLinkIP, utils.FormatItemID(access.ID), access.IPAddress); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt access log"})
+			return
+		}
+		accesses = append(accesses, access)
+	}
+
+	c.JSON(http.StatusOK, accesses)
+}
+
+// OpenLink serves the ciphertext behind a share link to anyone holding its
+// token. It is POST rather than GET so link previews and prefetching don't
+// use up downloads, and the token is sent in the body rather than the path
+// so it stays out of access logs, ours and any proxy's. Every use of an
+// existing link is logged, whether or not it is served.
+func (lc *ShareLinkController) OpenLink(c *gin.Context) {
+	var req models.ShareLinkDownloadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	var linkID, ownerID int64
+	var itemID, passwordHash string
+	var expiresAt time.Time
+	var maxDownloads sql.NullInt64
+	var downloadCount int64
+	var failedAttempts int
+	var revokedAt sql.NullTime
+	err := lc.db.QueryRow(
+		`SELECT id, item_id, owner_id, expires_at, max_downloads, download_count, password_hash, failed_attempts, revoked_at
+		FROM share_links WHERE token_hash = ?`,
+		utils.HashCode(req.Token),
+	).Scan(&linkID, &itemID, &ownerID, &expiresAt, &maxDownloads, &downloadCount, &passwordHash, &failedAttempts, &revokedAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Link not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	logAccess := func(outcome string) {
+		err := utils.WithTx(lc.db, func(tx *sql.Tx) error {
+			return recordLinkAccess(tx, lc.atRest, linkID, ownerID, outcome, c.ClientIP())
+		})
+		if err != nil {
+			log.Printf("Failed to log access to share link %d: %v", linkID, err)
+		}
+	}
+	refuse := func(status int, outcome, message string) {
+		logAccess(outcome)
+		c.JSON(status, gin.H{"error": message})
+	}
+
+	switch {
+	case revokedAt.Valid:
+		refuse(http.StatusGone, linkAccessRevoked, "Link has been revoked")
+		return
+	case time.Now().After(expiresAt):
+		refuse(http.StatusGone, linkAccessExpired, "Link has expired")
+		return
+	case maxDownloads.Valid && downloadCount >= maxDownloads.Int64:
+		refuse(http.StatusGone, linkAccessExhausted, "Link has no downloads left")
+		return
+	}
+
+	if passwordHash != "" {
+		if failedAttempts >= maxLinkPasswordFailures {
+			refuse(http.StatusGone, linkAccessLocked, "Link is locked after too many wrong passwords")
+			return
+		}
+
+		if req.Password == "" {
+			logAccess(linkAccessPasswordRequired)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Password required", "password_required": true})
+			return
+		}
+	}
+
+	tx, err := lc.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	if passwordHash != "" {
+		result, err := tx.Exec(
+			"UPDATE share_links SET failed_attempts = failed_attempts + 1 WHERE id = ? AND failed_attempts < ?",
+			linkID, maxLinkPasswordFailures,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			tx.Rollback()
+			refuse(http.StatusGone, linkAccessLocked, "Link is locked after too many wrong passwords")
+			return
+		}
+
+		// If the password can't be checked, rolling back gives the claim
+		// back; a wrong one keeps it.
+		match, _, err := lc.passwordHasher.Verify(req.Password, passwordHash)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify password"})
+			return
+		}
+		if !match {
+			if err := recordLinkAccess(tx, lc.atRest, linkID, ownerID, linkAccessBadPassword, c.ClientIP()); err != nil {
+				log.Printf("Failed to log access to share link %d: %v", linkID, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record attempt"})
+				return
+			}
+			if err := tx.Commit(); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+				return
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Password is incorrect"})
+			return
+		}
+
+		if _, err := tx.Exec("UPDATE share_links SET failed_attempts = failed_attempts - 1 WHERE id = ?", linkID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+	}
+
+	// The limit is checked again here, so concurrent downloads can't take
+	// the count past it.
+	result, err := tx.Exec(
+		`UPDATE share_links SET download_count = download_count + 1
+		WHERE id = ? AND revoked_at IS NULL AND (max_downloads IS NULL OR download_count < max_downloads)`,
+		linkID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record download"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		tx.Rollback()
+		refuse(http.StatusGone, linkAccessExhausted, "Link has no downloads left")
+		return
+	}
+
+	var encryptedData string
+	var isDeleted bool
+	err = tx.QueryRow(
+		"SELECT encrypted_data, is_deleted FROM file_metadata WHERE id = ? AND user_id = ? AND vault_id IS NULL",
+		itemID, ownerID,
+	).Scan(&encryptedData, &isDeleted)
+	if err == sql.ErrNoRows || isDeleted {
+		tx.Rollback()
+		refuse(http.StatusGone, linkAccessItemGone, "Item is no longer available")
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	cipher, err := lc.atRest.ForUser(tx, ownerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load encryption key"})
+		return
+	}
+	if encryptedData, err = cipher.Open(utils.FileMetadataData, itemID, encryptedData); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt metadata"})
+		return
+	}
+
+	if err := tx.QueryRow("SELECT download_count FROM share_links WHERE id = ?", linkID).Scan(&downloadCount); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record download"})
+		return
+	}
+	if err := recordLinkAccess(tx, lc.atRest, linkID, ownerID, linkAccessServed, c.ClientIP()); err != nil {
+		log.Printf("Failed to log access to share link %d: %v", linkID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record download"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	download := models.ShareLinkDownload{
+		ItemID:        itemID,
+		EncryptedData: encryptedData,
+		ExpiresAt:     expiresAt,
+	}
+	if maxDownloads.Valid {
+		remaining := int(maxDownloads.Int64 - downloadCount)
+		download.DownloadsRemaining = &remaining
+	}
+
+	c.JSON(http.StatusOK, download)
+}
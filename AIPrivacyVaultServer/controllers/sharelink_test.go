@@ -0,0 +1,178 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"AIPrivacyVaultServer/models"
+)
+
+// createLink shares a new item of the caller's through a link made with
+// options and returns the link.
+func (s *testServer) createLink(token, itemID string, options gin.H) models.ShareLink {
+	s.t.Helper()
+	expectStatus(s.t, s.request(http.MethodPost, "/api/sync", token, syncItem(itemID, 1, "")), http.StatusOK)
+	w := s.request(http.MethodPost, "/api/metadata/"+itemID+"/links", token, options)
+	expectStatus(s.t, w, http.StatusCreated)
+	var link models.ShareLink
+	decodeBody(s.t, w, &link)
+	return link
+}
+
+// openLink opens link without an account, with password unless it is "".
+func (s *testServer) openLink(link models.ShareLink, password string) *httptest.ResponseRecorder {
+	body := gin.H{"token": link.Token}
+	if password != "" {
+		body["password"] = password
+	}
+	return s.request(http.MethodPost, "/api/links/open", "", body)
+}
+
+// openLinkConcurrently opens link n times at once and returns how many
+// times each status was answered.
+func (s *testServer) openLinkConcurrently(link models.ShareLink, password string, n int) map[int]int {
+	codes := make(chan int, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- s.openLink(link, password).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	counts := map[int]int{}
+	for code := range codes {
+		counts[code]++
+	}
+	return counts
+}
+
+// linkOutcomes returns the outcomes logged for link, oldest first.
+func (s *testServer) linkOutcomes(token string, link models.ShareLink) []string {
+	s.t.Helper()
+	w := s.request(http.MethodGet, "/api/metadata/"+link.ItemID+"/links/"+strconv.FormatInt(link.ID, 10)+"/accesses", token, nil)
+	expectStatus(s.t, w, http.StatusOK)
+	var accesses []models.ShareLinkAccess
+	decodeBody(s.t, w, &accesses)
+
+	outcomes := make([]string, len(accesses))
+	for i, access := range accesses {
+		outcomes[i] = access.Outcome
+	}
+	return outcomes
+}
+
+func TestShareLinkLocksAfterTooManyWrongPasswords(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice := s.register("alice")
+	link := s.createLink(alice, "item", gin.H{"password": "link-password"})
+
+	expectStatus(t, s.openLink(link, ""), http.StatusUnauthorized)
+	for i := 0; i < maxLinkPasswordFailures; i++ {
+		expectStatus(t, s.openLink(link, "wrong-password"), http.StatusUnauthorized)
+	}
+	expectStatus(t, s.openLink(link, "wrong-password"), http.StatusGone)
+	expectStatus(t, s.openLink(link, "link-password"), http.StatusGone)
+
+	outcomes := s.linkOutcomes(alice, link)
+	want := []string{linkAccessPasswordRequired}
+	for i := 0; i < maxLinkPasswordFailures; i++ {
+		want = append(want, linkAccessBadPassword)
+	}
+	want = append(want, linkAccessLocked, linkAccessLocked)
+	if len(outcomes) != len(want) {
+		t.Fatalf("logged %v, want %v", outcomes, want)
+	}
+	for i := range want {
+		if outcomes[i] != want[i] {
+			t.Fatalf("logged %v, want %v", outcomes, want)
+		}
+	}
+}
+
+func TestShareLinkRightPasswordDoesNotUseAnAttempt(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice := s.register("alice")
+	link := s.createLink(alice, "item", gin.H{"password": "link-password"})
+
+	for i := 0; i < maxLinkPasswordFailures-1; i++ {
+		expectStatus(t, s.openLink(link, "wrong-password"), http.StatusUnauthorized)
+	}
+	expectStatus(t, s.openLink(link, "link-password"), http.StatusOK)
+	expectStatus(t, s.openLink(link, "link-password"), http.StatusOK)
+
+	// One wrong password is still left before the link locks.
+	expectStatus(t, s.openLink(link, "wrong-password"), http.StatusUnauthorized)
+	expectStatus(t, s.openLink(link, "link-password"), http.StatusGone)
+}
+
+func TestShareLinkLockoutHoldsUnderConcurrentGuesses(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice := s.register("alice")
+	link := s.createLink(alice, "item", gin.H{"password": "link-password"})
+
+	counts := s.openLinkConcurrently(link, "wrong-password", 3*maxLinkPasswordFailures)
+	if counts[http.StatusUnauthorized] != maxLinkPasswordFailures || counts[http.StatusGone] != 2*maxLinkPasswordFailures {
+		t.Fatalf("answered %v, want %d checked and the rest refused", counts, maxLinkPasswordFailures)
+	}
+
+	var failedAttempts int
+	if err := s.db.QueryRow("SELECT failed_attempts FROM share_links WHERE id = ?", link.ID).Scan(&failedAttempts); err != nil {
+		t.Fatal(err)
+	}
+	if failedAttempts != maxLinkPasswordFailures {
+		t.Fatalf("failed_attempts is %d, want %d", failedAttempts, maxLinkPasswordFailures)
+	}
+}
+
+func TestShareLinkMaxDownloads(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice := s.register("alice")
+	link := s.createLink(alice, "item", gin.H{"max_downloads": 2})
+
+	for _, remaining := range []int{1, 0} {
+		w := s.openLink(link, "")
+		expectStatus(t, w, http.StatusOK)
+		var download models.ShareLinkDownload
+		decodeBody(t, w, &download)
+		if download.ItemID != "item" || download.EncryptedData != testEnvelope() {
+			t.Fatalf("served %+v", download)
+		}
+		if download.DownloadsRemaining == nil || *download.DownloadsRemaining != remaining {
+			t.Fatalf("downloads_remaining is %v, want %d", download.DownloadsRemaining, remaining)
+		}
+	}
+	expectStatus(t, s.openLink(link, ""), http.StatusGone)
+
+	outcomes := s.linkOutcomes(alice, link)
+	if len(outcomes) != 3 || outcomes[0] != linkAccessServed || outcomes[1] != linkAccessServed || outcomes[2] != linkAccessExhausted {
+		t.Fatalf("logged %v", outcomes)
+	}
+}
+
+func TestShareLinkMaxDownloadsHoldsUnderConcurrentDownloads(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice := s.register("alice")
+	link := s.createLink(alice, "item", gin.H{"max_downloads": 3})
+
+	counts := s.openLinkConcurrently(link, "", 10)
+	if counts[http.StatusOK] != 3 || counts[http.StatusGone] != 7 {
+		t.Fatalf("answered %v, want 3 served and the rest refused", counts)
+	}
+
+	var downloadCount int
+	if err := s.db.QueryRow("SELECT download_count FROM share_links WHERE id = ?", link.ID).Scan(&downloadCount); err != nil {
+		t.Fatal(err)
+	}
+	if downloadCount != 3 {
+		t.Fatalf("download_count is %d, want 3", downloadCount)
+	}
+}
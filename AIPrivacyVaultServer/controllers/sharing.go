@@ -0,0 +1,452 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"AIPrivacyVaultServer/models"
+	"AIPrivacyVaultServer/utils"
+)
+
+// maxWrappedKeySize bounds a wrapped item key, which only ever holds a
+// symmetric key and the sealing overhead.
+const maxWrappedKeySize = 1024
+
+// SharingController lets a user share single items with other users. Items
+// stay encrypted under their own item key; the owner wraps that key for
+// each of the recipient's devices under the device's key from the key
+// directory, so the server only ever handles wrapped keys.
+type SharingController struct {
+	db     *sql.DB
+	atRest *utils.FieldCipher
+}
+
+// NewSharingController creates a new sharing controller
+func NewSharingController(db *sql.DB, atRest *utils.FieldCipher) *SharingController {
+	return &SharingController{
+		db:     db,
+		atRest: atRest,
+	}
+}
+
+// ownerCiphers caches the at-rest cipher of each user whose items one
+// request reads or writes. Shared items stay sealed under their owner's
+// data key.
+type ownerCiphers struct {
+	db      utils.DBTX
+	atRest  *utils.FieldCipher
+	ciphers map[int64]*utils.UserCipher
+}
+
+func newOwnerCiphers(db utils.DBTX, atRest *utils.FieldCipher) *ownerCiphers {
+	return &ownerCiphers{
+		db:      db,
+		atRest:  atRest,
+		ciphers: make(map[int64]*utils.UserCipher),
+	}
+}
+
+func (oc *ownerCiphers) forUser(userID int64) (*utils.UserCipher, error) {
+	if cipher, ok := oc.ciphers[userID]; ok {
+		return cipher, nil
+	}
+	cipher, err := oc.atRest.ForUser(oc.db, userID)
+	if err != nil {
+		return nil, err
+	}
+	oc.ciphers[userID] = cipher
+	return cipher, nil
+}
+
+// checkWrappedKeys reports what is wrong with keys wrapped for
+// recipientID's devices, and for which device, or "" if nothing is. Keys
+// may only be wrapped for device keys the recipient published, so the
+// sender's client can check each against the transparency log.
+func checkWrappedKeys(db utils.DBTX, recipientID int64, keys []models.WrappedItemKey) (string, string, error) {
+	devices := make(map[string]bool)
+	for _, key := range keys {
+		raw, err := base64.StdEncoding.DecodeString(key.WrappedKey)
+		if err != nil || len(raw) == 0 || len(raw) > maxWrappedKeySize {
+			return "Invalid wrapped_key", key.DeviceID, nil
+		}
+		if devices[key.DeviceID] {
+			return "Duplicate device_id", key.DeviceID, nil
+		}
+		devices[key.DeviceID] = true
+
+		var published int
+		err = db.QueryRow(
+			"SELECT COUNT(*) FROM public_keys WHERE user_id = ? AND device_id = ? AND encryption_key = ? AND revoked_at IS NULL",
+			recipientID, key.DeviceID, key.EncryptionKey,
+		).Scan(&published)
+		if err != nil {
+			return "", "", err
+		}
+		if published == 0 {
+			return "Key is not in the recipient's key directory", key.DeviceID, nil
+		}
+	}
+	return "", "", nil
+}
+
+// loadWrappedKeys returns the keys stored for a share, leaving out those
+// for device keys revoked from the directory since.
+func loadWrappedKeys(db utils.DBTX, shareID int64) ([]models.WrappedItemKey, error) {
+	rows, err := db.Query(
+		`SELECT k.device_id, k.encryption_key, k.wrapped_key
+		FROM item_share_keys k
+		JOIN public_keys p ON p.user_id = k.recipient_id AND p.device_id = k.device_id
+			AND p.encryption_key = k.encryption_key AND p.revoked_at IS NULL
+		WHERE k.share_id = ?
+		ORDER BY k.device_id`,
+		shareID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []models.WrappedItemKey{}
+	for rows.Next() {
+		var key models.WrappedItemKey
+		if err := rows.Scan(&key.DeviceID, &key.EncryptionKey, &key.WrappedKey); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// loadSharedItems returns the items shared with userID, and the IDs of
+// those whose share has been revoked.
+func loadSharedItems(db utils.DBTX, ciphers *ownerCiphers, userID int64) ([]models.SharedItem, []string, error) {
+	rows, err := db.Query(
+		`SELECT s.id, s.permission, s.revoked_at, u.username,
+			m.id, m.encrypted_data, m.user_id, m.version, m.last_modified_at, m.is_deleted
+		FROM item_shares s
+		JOIN file_metadata m ON m.id = s.item_id
+		JOIN users u ON u.id = s.owner_id
+		WHERE s.recipient_id = ?
+		ORDER BY s.id`,
+		userID,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var shareIDs []int64
+	var items []models.SharedItem
+	var unsharedIDs []string
+	for rows.Next() {
+		var shareID int64
+		var revokedAt sql.NullTime
+		var item models.SharedItem
+		err := rows.Scan(&shareID, &item.Permission, &revokedAt, &item.Owner,
+			&item.ID, &item.EncryptedData, &item.UserID, &item.Version, &item.LastModifiedAt, &item.IsDeleted)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		if revokedAt.Valid {
+			unsharedIDs = append(unsharedIDs, item.ID)
+			continue
+		}
+		shareIDs = append(shareIDs, shareID)
+		items = append(items, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	for i := range items {
+		cipher, err := ciphers.forUser(items[i].UserID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := openItem(cipher, &items[i].FileMetadata); err != nil {
+			return nil, nil, err
+		}
+		if items[i].WrappedKeys, err = loadWrappedKeys(db, shareIDs[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return items, unsharedIDs, nil
+}
+
+// itemShareStatus reports whether item id has been shared with userID, and
+// if so whether the share has since been revoked.
+func itemShareStatus(db utils.DBTX, userID int64, id string) (shared, revoked bool, err error) {
+	var revokedAt sql.NullTime
+	err = db.QueryRow(
+		"SELECT revoked_at FROM item_shares WHERE item_id = ? AND recipient_id = ?",
+		id, userID,
+	).Scan(&revokedAt)
+	if err == sql.ErrNoRows {
+		return false, false, nil
+	} else if err != nil {
+		return false, false, err
+	}
+	return true, revokedAt.Valid, nil
+}
+
+// sharedWritePermission reports why userID may not change the shared item
+// id, or "" if they may.
+func sharedWritePermission(db utils.DBTX, userID int64, id string, deleting bool) (string, error) {
+	var permission string
+	err := db.QueryRow(
+		"SELECT permission FROM item_shares WHERE item_id = ? AND recipient_id = ? AND revoked_at IS NULL",
+		id, userID,
+	).Scan(&permission)
+	switch {
+	case err == sql.ErrNoRows:
+		return "Item is not shared with you", nil
+	case err != nil:
+		return "", err
+	case permission != models.SharePermissionWrite:
+		return "Item is shared read-only", nil
+	case deleting:
+		return "Only the owner can delete a shared item", nil
+	}
+	return "", nil
+}
+
+// ShareItem shares one of the caller's items with another user, or updates
+// the permission and wrapped keys of an existing share.
+func (sc *SharingController) ShareItem(c *gin.Context) {
+	id := c.Param("id")
+	userID := c.GetInt64("userID")
+
+	var req models.ShareRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.WrappedKeys) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if req.Permission != models.SharePermissionRead && req.Permission != models.SharePermissionWrite {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid permission"})
+		return
+	}
+	tx, err := sc.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	var isDeleted bool
+	err = tx.QueryRow("SELECT is_deleted FROM file_metadata WHERE id = ? AND user_id = ? AND vault_id IS NULL", id, userID).Scan(&isDeleted)
+	if err == sql.ErrNoRows || isDeleted {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Metadata not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var recipientID int64
+	err = tx.QueryRow("SELECT id FROM users WHERE username = ?", req.Recipient).Scan(&recipientID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipient not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if recipientID == userID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot share an item with yourself"})
+		return
+	}
+
+	problem, deviceID, err := checkWrappedKeys(tx, recipientID, req.WrappedKeys)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem, "device_id": deviceID})
+		return
+	}
+
+	now := time.Now().UTC()
+	share := models.ItemShare{
+		ItemID:      id,
+		Recipient:   req.Recipient,
+		Permission:  req.Permission,
+		UpdatedAt:   now,
+		WrappedKeys: req.WrappedKeys,
+	}
+
+	status := http.StatusOK
+	err = tx.QueryRow(
+		"SELECT id, created_at FROM item_shares WHERE item_id = ? AND recipient_id = ?",
+		id, recipientID,
+	).Scan(&share.ID, &share.CreatedAt)
+	if err == sql.ErrNoRows {
+		share.CreatedAt = now
+		result, err := tx.Exec(
+			"INSERT INTO item_shares (item_id, owner_id, recipient_id, permission, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+			id, userID, recipientID, req.Permission, now, now,
+		)
+		if err == nil {
+			share.ID, err = result.LastInsertId()
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to share item"})
+			return
+		}
+		status = http.StatusCreated
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	} else {
+		_, err = tx.Exec(
+			"UPDATE item_shares SET permission = ?, updated_at = ?, revoked_at = NULL WHERE id = ?",
+			req.Permission, now, share.ID,
+		)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM item_share_keys WHERE share_id = ?", share.ID)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to share item"})
+			return
+		}
+	}
+
+	for _, key := range req.WrappedKeys {
+		_, err := tx.Exec(
+			"INSERT INTO item_share_keys (share_id, owner_id, recipient_id, device_id, encryption_key, wrapped_key) VALUES (?, ?, ?, ?, ?, ?)",
+			share.ID, userID, recipientID, key.DeviceID, key.EncryptionKey, key.WrappedKey,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store wrapped keys"})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(status, share)
+}
+
+// ListShares returns every share of one of the caller's items, including
+// revoked ones.
+func (sc *SharingController) ListShares(c *gin.Context) {
+	id := c.Param("id")
+	userID := c.GetInt64("userID")
+
+	var owned int
+	if err := sc.db.QueryRow("SELECT COUNT(*) FROM file_metadata WHERE id = ? AND user_id = ? AND vault_id IS NULL", id, userID).Scan(&owned); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if owned == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Metadata not found"})
+		return
+	}
+
+	rows, err := sc.db.Query(
+		`SELECT s.id, u.username, s.permission, s.created_at, s.updated_at, s.revoked_at
+		FROM item_shares s JOIN users u ON u.id = s.recipient_id
+		WHERE s.item_id = ? AND s.owner_id = ?
+		ORDER BY s.id`,
+		id, userID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	shares := []models.ItemShare{}
+	for rows.Next() {
+		share := models.ItemShare{ItemID: id}
+		if err := rows.Scan(&share.ID, &share.Recipient, &share.Permission, &share.CreatedAt, &share.UpdatedAt, &share.RevokedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning rows"})
+			return
+		}
+		shares = append(shares, share)
+	}
+	rows.Close()
+
+	for i := range shares {
+		if shares[i].WrappedKeys, err = loadWrappedKeys(sc.db, shares[i].ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load wrapped keys"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, shares)
+}
+
+// RevokeShare withdraws a recipient's access to an item. Their wrapped keys
+// are deleted, but a recipient who already unwrapped the item key keeps
+// it, so the owner's client should re-encrypt the item under a new key.
+func (sc *SharingController) RevokeShare(c *gin.Context) {
+	id := c.Param("id")
+	userID := c.GetInt64("userID")
+
+	tx, err := sc.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	var shareID int64
+	err = tx.QueryRow(
+		`SELECT s.id FROM item_shares s JOIN users u ON u.id = s.recipient_id
+		WHERE s.item_id = ? AND s.owner_id = ? AND u.username = ? AND s.revoked_at IS NULL`,
+		id, userID, c.Param("username"),
+	).Scan(&shareID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	now := time.Now().UTC()
+	_, err = tx.Exec("UPDATE item_shares SET revoked_at = ?, updated_at = ? WHERE id = ?", now, now, shareID)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM item_share_keys WHERE share_id = ?", shareID)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke share"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Share revoked"})
+}
+
+// SharedWithMe returns the items other users shared with the caller, as
+// sync does.
+func (sc *SharingController) SharedWithMe(c *gin.Context) {
+	userID := c.GetInt64("userID")
+
+	items, unsharedIDs, err := loadSharedItems(sc.db, newOwnerCiphers(sc.db, sc.atRest), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load shared items"})
+		return
+	}
+	if items == nil {
+		items = []models.SharedItem{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"items":        items,
+		"unshared_ids": unsharedIDs,
+	})
+}
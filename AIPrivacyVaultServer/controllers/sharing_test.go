@@ -0,0 +1,27 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+
+	"AIPrivacyVaultServer/models"
+)
+
+func TestListSharesLeavesOutVaultItems(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice := s.register("alice")
+	bob := s.register("bob")
+	aliceKey := s.publishKeys(alice, "alice")
+	bobKey := s.publishKeys(bob, "bob")
+
+	vaultID := s.createVault(alice, "alice", aliceKey)
+	s.setVaultMember(alice, vaultID, "bob", models.VaultRoleEditor, bobKey)
+
+	// Vault items are stored under the vault owner, but they are shared
+	// through the vault, not one by one.
+	expectStatus(t, s.request(http.MethodPost, "/api/sync", bob, syncItem("vault-item", 1, vaultID)), http.StatusOK)
+	expectStatus(t, s.request(http.MethodGet, "/api/metadata/vault-item/shares", alice, nil), http.StatusNotFound)
+
+	expectStatus(t, s.request(http.MethodPost, "/api/sync", alice, syncItem("own-item", 1, "")), http.StatusOK)
+	expectStatus(t, s.request(http.MethodGet, "/api/metadata/own-item/shares", alice, nil), http.StatusOK)
+}
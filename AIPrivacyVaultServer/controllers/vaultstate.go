@@ -0,0 +1,233 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"AIPrivacyVaultServer/models"
+	"AIPrivacyVaultServer/utils"
+)
+
+// loadVaultItems reads every item userID's vault state commits to, as the
+// client sent it: their own items and those sharedStateItems adds.
+func loadVaultItems(db utils.DBTX, ciphers *ownerCiphers, userID int64) ([]utils.VaultItem, error) {
+	cipher, err := ciphers.forUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(
+		"SELECT id, encrypted_data, version, is_deleted FROM file_metadata WHERE user_id = ? AND vault_id IS NULL",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []utils.VaultItem
+	for rows.Next() {
+		var item utils.VaultItem
+		if err := rows.Scan(&item.ID, &item.Data, &item.Version, &item.Deleted); err != nil {
+			return nil, err
+		}
+		if item.Data, err = cipher.Open(utils.FileMetadataData, item.ID, item.Data); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	sharedItems, _, err := loadSharedItems(db, ciphers, userID)
+	if err != nil {
+		return nil, err
+	}
+	vaults, _, err := loadSharedVaults(db, ciphers, userID)
+	if err != nil {
+		return nil, err
+	}
+	return append(items, sharedStateItems(vaults, sharedItems)...), nil
+}
+
+// sharedStateItems returns what a vault state commits to besides the
+// user's own items: the items of every shared vault they are a member of
+// and every item shared with them, as a sync returns them.
+func sharedStateItems(vaults []models.VaultSync, sharedItems []models.SharedItem) []utils.VaultItem {
+	var items []utils.VaultItem
+	for _, vault := range vaults {
+		for _, item := range vault.UpdatedItems {
+			items = append(items, utils.VaultItem{ID: item.ID, Version: item.Version, Data: item.EncryptedData})
+		}
+		for _, id := range vault.DeletedIDs {
+			items = append(items, utils.VaultItem{ID: id, Deleted: true})
+		}
+	}
+	for _, item := range sharedItems {
+		items = append(items, utils.VaultItem{ID: item.ID, Version: item.Version, Deleted: item.IsDeleted, Data: item.EncryptedData})
+	}
+	return items
+}
+
+// latestVaultState returns the newest entry of userID's state chain, or nil
+// if there is none yet.
+func latestVaultState(db utils.DBTX, userID int64) (*models.VaultState, error) {
+	latest := &models.VaultState{UserID: userID}
+	err := db.QueryRow(
+		"SELECT sequence, root, previous_head, head, item_count, created_at FROM vault_states WHERE user_id = ? ORDER BY sequence DESC LIMIT 1",
+		userID,
+	).Scan(&latest.Sequence, &latest.Root, &latest.PreviousHead, &latest.Head, &latest.ItemCount, &latest.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return latest, err
+}
+
+// advanceVaultState appends the root over items to userID's state chain,
+// unless it is already the latest state, and returns the latest state. The
+// chain only advances when a sync computes the root anyway, so single item
+// changes cost nothing extra and the chain grows with syncs, not edits.
+func advanceVaultState(db utils.DBTX, userID int64, items []utils.VaultItem) (*models.VaultState, error) {
+	rootBytes := utils.VaultStateRoot(items)
+	root := hex.EncodeToString(rootBytes)
+
+	latest, err := latestVaultState(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	if latest == nil {
+		latest = &models.VaultState{UserID: userID, Head: hex.EncodeToString(utils.VaultGenesisHead)}
+	} else if latest.Root == root {
+		return latest, nil
+	}
+
+	previousHead, err := hex.DecodeString(latest.Head)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &models.VaultState{
+		UserID:       userID,
+		Sequence:     latest.Sequence + 1,
+		Root:         root,
+		PreviousHead: latest.Head,
+		ItemCount:    len(items),
+		CreatedAt:    time.Now().UTC(),
+	}
+	state.Head = hex.EncodeToString(utils.NextVaultHead(previousHead, state.Sequence, rootBytes))
+
+	_, err = db.Exec(
+		"INSERT INTO vault_states (user_id, sequence, root, previous_head, head, item_count, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		state.UserID, state.Sequence, state.Root, state.PreviousHead, state.Head, state.ItemCount, state.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// recordVaultState computes userID's state from their stored items.
+func recordVaultState(db utils.DBTX, ciphers *ownerCiphers, userID int64) (*models.VaultState, error) {
+	items, err := loadVaultItems(db, ciphers, userID)
+	if err != nil {
+		return nil, err
+	}
+	return advanceVaultState(db, userID, items)
+}
+
+func signVaultState(signer *utils.SigningService, state *models.VaultState) (*models.SignedVaultState, error) {
+	payload, signature, err := signer.SignStatement(utils.StatementVaultState, state)
+	if err != nil {
+		return nil, err
+	}
+	return &models.SignedVaultState{
+		State:     *state,
+		Payload:   base64.StdEncoding.EncodeToString(payload),
+		Signature: signature,
+		KeyID:     signer.KeyID(),
+		Algorithm: "Ed25519",
+	}, nil
+}
+
+// GetVaultState returns the signed state of the caller's vault as of their
+// last sync and the chain entries after the sequence given as since. A
+// device that stored the head it last saw at that sequence can replay the
+// entries from it with utils.NextVaultHead; ending anywhere but the signed
+// head, or a current sequence below since, means the vault was rolled back
+// or forked.
+func (mc *MetadataController) GetVaultState(c *gin.Context) {
+	userID := c.GetInt64("userID")
+
+	since, err := strconv.ParseInt(c.DefaultQuery("since", "0"), 10, 64)
+	if err != nil || since < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid since"})
+		return
+	}
+
+	tx, err := mc.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	state, err := latestVaultState(tx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// Vaults not synced since state tracking was added get their first
+	// state here.
+	if state == nil {
+		if state, err = recordVaultState(tx, newOwnerCiphers(tx, mc.atRest), userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update vault state"})
+			return
+		}
+	}
+
+	rows, err := tx.Query(
+		"SELECT sequence, root, head FROM vault_states WHERE user_id = ? AND sequence > ? ORDER BY sequence",
+		userID, since,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	entries := []models.VaultStateEntry{}
+	for rows.Next() {
+		var entry models.VaultStateEntry
+		if err := rows.Scan(&entry.Sequence, &entry.Root, &entry.Head); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning rows"})
+			return
+		}
+		entries = append(entries, entry)
+	}
+	rows.Close()
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	signed, err := signVaultState(mc.signer, state)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign vault state"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"state":   signed,
+		"entries": entries,
+	})
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"crypto/tls"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -9,6 +11,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 
+	"AIPrivacyVaultServer/commands"
 	"AIPrivacyVaultServer/config"
 	"AIPrivacyVaultServer/controllers"
 	"AIPrivacyVaultServer/utils"
@@ -17,42 +20,197 @@ import (
 func main() {
 	cfg := config.LoadConfig()
 
+	if len(os.Args) > 1 {
+		if err := commands.Run(cfg, os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalf("%s: %v", os.Args[1], err)
+		}
+		return
+	}
+
 	db, err := utils.InitDatabase(cfg.DatabasePath)
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 	defer db.Close()
 
+	signer, err := utils.LoadOrCreateSigningKey(cfg.SigningKeyPath)
+	if err != nil {
+		log.Fatalf("Failed to load signing key: %v", err)
+	}
+
+	var ca *utils.CertificateAuthority
+	if cfg.MTLSMode != config.MTLSOff {
+		ca, err = utils.LoadOrCreateCA(cfg.CADir)
+		if err != nil {
+			log.Fatalf("Failed to load device certificate authority: %v", err)
+		}
+	}
+
+	// Every configured key is fetched now, whether or not anything is sealed
+	// with it yet, so a bad key file, passphrase or KMS setting stops the
+	// server here rather than surfacing the day encryption is turned on.
+	var master *utils.CryptoService
+	if len(cfg.KeyProviders) > 0 {
+		master, err = utils.LoadKeyring(cfg.KeyProviders, cfg.EncryptKeyID)
+		if err != nil {
+			log.Fatalf("Failed to load encryption keys: %v", err)
+		}
+	}
+
+	var atRest *utils.FieldCipher
+	if cfg.AtRestEncryption {
+		atRest = utils.NewFieldCipher(master)
+		log.Printf("At-rest encryption enabled (key %s)", cfg.EncryptKeyID)
+
+		resealed, err := utils.AtRestResealed(db)
+		if err != nil {
+			log.Fatalf("Failed to read at-rest format: %v", err)
+		}
+		if resealed {
+			atRest.RequireBound()
+			log.Printf("Only values sealed in the current at-rest format are accepted")
+		}
+	}
+
 	router := gin.Default()
 	router.Use(gin.Logger())
 	router.Use(gin.Recovery())
 
-	authController := controllers.NewAuthController(db, cfg.JWTSecret)
-	metadataController := controllers.NewMetadataController(db)
+	authController := controllers.NewAuthController(db, cfg, atRest)
+	metadataController := controllers.NewMetadataController(db, atRest, signer)
+	inviteController := controllers.NewInviteController(db, cfg.InviteTTL)
+	oidcController := controllers.NewOIDCController(db, authController, cfg)
+	accountController := controllers.NewAccountController(db, authController, signer)
+	keyDirectoryController := controllers.NewKeyDirectoryController(db, signer)
+	sharingController := controllers.NewSharingController(db, atRest)
+	sharedVaultController := controllers.NewSharedVaultController(db, atRest)
+	shareLinkController := controllers.NewShareLinkController(db, atRest, cfg)
 
 	router.POST("/api/auth/register", authController.Register)
 	router.POST("/api/auth/login", authController.Login)
+	router.POST("/api/auth/recover", authController.Recover)
+	if oidcController != nil {
+		router.GET("/api/auth/oidc/login", oidcController.Login)
+		router.GET("/api/auth/oidc/callback", oidcController.Callback)
+	}
+	router.GET("/api/server/signing-key", accountController.SigningKey)
+	router.POST("/api/links/open", shareLinkController.OpenLink)
 	router.GET("/api/status", func(c *gin.Context) {
-		c.JSON(200, gin.H{"status": "online"})
+		c.JSON(200, gin.H{"status": "online", "registration": authController.RegistrationMode(), "oidc": oidcController != nil, "tls": cfg.TLSEnabled})
 	})
 
 	authorized := router.Group("/api")
 	authorized.Use(authController.AuthMiddleware())
 	{
+		authorized.POST("/auth/password", authController.ChangePassword)
+		authorized.POST("/auth/recovery-codes", authController.RegenerateRecoveryCodes)
+		authorized.DELETE("/account", accountController.DeleteAccount)
+
 		authorized.GET("/metadata", metadataController.GetAllMetadata)
 		authorized.GET("/metadata/:id", metadataController.GetMetadata)
 		authorized.POST("/metadata", metadataController.AddMetadata)
 		authorized.PUT("/metadata/:id", metadataController.UpdateMetadata)
 		authorized.DELETE("/metadata/:id", metadataController.DeleteMetadata)
 
+		authorized.POST("/metadata/:id/shares", sharingController.ShareItem)
+		authorized.GET("/metadata/:id/shares", sharingController.ListShares)
+		authorized.DELETE("/metadata/:id/shares/:username", sharingController.RevokeShare)
+		authorized.GET("/shared", sharingController.SharedWithMe)
+
+		authorized.POST("/metadata/:id/links", shareLinkController.CreateLink)
+		authorized.GET("/metadata/:id/links", shareLinkController.ListLinks)
+		authorized.DELETE("/metadata/:id/links/:link_id", shareLinkController.RevokeLink)
+		authorized.GET("/metadata/:id/links/:link_id/accesses", shareLinkController.ListLinkAccesses)
+
+		authorized.POST("/vaults", sharedVaultController.CreateVault)
+		authorized.GET("/vaults", sharedVaultController.ListVaults)
+		authorized.DELETE("/vaults/:id", sharedVaultController.DeleteVault)
+		authorized.GET("/vaults/:id/members", sharedVaultController.ListMembers)
+		authorized.PUT("/vaults/:id/members/:username", sharedVaultController.SetMember)
+		authorized.DELETE("/vaults/:id/members/:username", sharedVaultController.RemoveMember)
+
 		authorized.POST("/sync", metadataController.SyncMetadata)
 		authorized.GET("/sync/status", metadataController.SyncStatus)
+		authorized.GET("/sync/state", metadataController.GetVaultState)
+
+		authorized.POST("/keys", keyDirectoryController.RegisterKeys)
+		authorized.GET("/keys/:username", keyDirectoryController.GetKeys)
+		authorized.DELETE("/keys/:device_id", keyDirectoryController.RevokeKeys)
+
+		authorized.GET("/keylog/head", keyDirectoryController.GetTreeHead)
+		authorized.GET("/keylog/entries", keyDirectoryController.GetLogEntries)
+		authorized.GET("/keylog/proof", keyDirectoryController.GetInclusionProof)
+		authorized.GET("/keylog/consistency", keyDirectoryController.GetConsistencyProof)
+	}
+
+	admin := router.Group("/api/admin")
+	admin.Use(authController.AuthMiddleware(), authController.AdminMiddleware())
+	{
+		admin.POST("/invites", inviteController.CreateInvite)
+		admin.GET("/invites", inviteController.ListInvites)
+		admin.DELETE("/invites/:id", inviteController.RevokeInvite)
+	}
+
+	if ca != nil {
+		deviceCertController := controllers.NewDeviceCertificateController(db, atRest, ca, cfg.ClientCertValidity)
+
+		router.GET("/api/devices/ca", deviceCertController.CACertificate)
+		authorized.POST("/devices/certificates", deviceCertController.RequestCertificate)
+		authorized.GET("/devices/certificates/:id", deviceCertController.GetCertificate)
+
+		admin.GET("/device-certificates", deviceCertController.ListCertificates)
+		admin.POST("/device-certificates/:id/approve", deviceCertController.ApproveCertificate)
+		admin.POST("/device-certificates/:id/reject", deviceCertController.RejectCertificate)
+		admin.POST("/device-certificates/:id/revoke", deviceCertController.RevokeCertificate)
+	}
+
+	server := &http.Server{
+		Addr:    ":" + cfg.ServicePort,
+		Handler: router,
+	}
+
+	var tlsFingerprint string
+	if cfg.TLSEnabled {
+		var serverCert tls.Certificate
+		if cfg.TLSCertPath != "" {
+			serverCert, err = utils.LoadServerCertificate(cfg.TLSCertPath, cfg.TLSKeyPath)
+		} else {
+			serverCert, err = utils.LoadOrCreateSelfSignedCertificate(cfg.TLSDir)
+		}
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+
+		tlsFingerprint = utils.CertificateFingerprint(serverCert)
+		server.TLSConfig = &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{serverCert},
+		}
+		log.Printf("HTTPS enabled, certificate fingerprint sha256:%s", tlsFingerprint)
+	} else {
+		log.Printf("Warning: TLS_ENABLED=false, serving plain HTTP")
+	}
+
+	if ca != nil {
+		// In "require" mode even registration and login need a client
+		// certificate, so devices should be enrolled in "optional" mode first.
+		server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if cfg.MTLSMode == config.MTLSRequire {
+			server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		server.TLSConfig.ClientCAs = ca.ClientCAPool()
+		log.Printf("Mutual TLS enabled (mode=%s)", cfg.MTLSMode)
 	}
 
 	serverCh := make(chan error, 1)
 	go func() {
 		serverStartTime := time.Now()
-		serverErr := router.Run(":" + cfg.ServicePort)
+		var serverErr error
+		if server.TLSConfig != nil {
+			serverErr = server.ListenAndServeTLS("", "")
+		} else {
+			serverErr = server.ListenAndServe()
+		}
 		log.Printf("Server stopped after running for %v", time.Since(serverStartTime))
 		serverCh <- serverErr
 	}()
@@ -64,6 +222,7 @@ func main() {
 		discoveryStartTime := time.Now()
 		log.Printf("Starting discovery service at %v...", discoveryStartTime.Format(time.RFC3339))
 		discovery = utils.NewDiscoveryService(cfg.ServiceName, cfg.ServicePort)
+		discovery.SetTLSFingerprint(tlsFingerprint)
 
 		if err := discovery.Advertise(); err != nil {
 			log.Printf("Warning: Failed to start discovery service: %v", err)
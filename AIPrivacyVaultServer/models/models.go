@@ -9,6 +9,7 @@ type User struct {
 	DeviceID     string    `json:"device_id" db:"device_id"`
 	CreatedAt    time.Time `json:"created_at" db:"created_at"`
 	LastSyncAt   time.Time `json:"last_sync_at" db:"last_sync_at"`
+	IsAdmin      bool      `json:"is_admin" db:"is_admin"`
 }
 
 type FileMetadata struct {
@@ -18,6 +19,7 @@ type FileMetadata struct {
 	Version        int       `json:"version" db:"version"`
 	LastModifiedAt time.Time `json:"last_modified_at" db:"last_modified_at"`
 	IsDeleted      bool      `json:"is_deleted" db:"is_deleted"`
+	VaultID        string    `json:"vault_id,omitempty" db:"vault_id"`
 }
 
 type PlainMetadata struct {
@@ -37,19 +39,348 @@ type SyncRequest struct {
 }
 
 type SyncResponse struct {
+	UpdatedItems    []FileMetadata    `json:"updated_items"`
+	DeletedIDs      []string          `json:"deleted_ids"`
+	SyncToken       string            `json:"sync_token"`
+	Timestamp       time.Time         `json:"timestamp"`
+	State           *SignedVaultState `json:"state,omitempty"`
+	SharedItems     []SharedItem      `json:"shared_items,omitempty"`
+	UnsharedIDs     []string          `json:"unshared_ids,omitempty"`
+	Vaults          []VaultSync       `json:"vaults,omitempty"`
+	RemovedVaultIDs []string          `json:"removed_vault_ids,omitempty"`
+}
+
+// VaultState commits to the whole of a user's vault at one point in its
+// history; see utils/vaultstate.go for how Root and Head are computed.
+type VaultState struct {
+	UserID       int64     `json:"user_id"`
+	Sequence     int64     `json:"sequence"`
+	Root         string    `json:"root"`
+	PreviousHead string    `json:"previous_head"`
+	Head         string    `json:"head"`
+	ItemCount    int       `json:"item_count"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// SignedVaultState carries the exact signed bytes, like
+// SignedDeletionReceipt, with the type utils.StatementVaultState.
+type SignedVaultState struct {
+	State     VaultState `json:"state"`
+	Payload   string     `json:"payload"`
+	Signature string     `json:"signature"`
+	KeyID     string     `json:"key_id"`
+	Algorithm string     `json:"algorithm"`
+}
+
+// VaultStateEntry is one link of a user's state chain.
+type VaultStateEntry struct {
+	Sequence int64  `json:"sequence"`
+	Root     string `json:"root"`
+	Head     string `json:"head"`
+}
+
+// Key log actions.
+const (
+	KeyLogRegister = "register"
+	KeyLogRevoke   = "revoke"
+)
+
+// KeyLogEntry is one leaf of the key transparency log. The log stores and
+// serves its exact JSON encoding, which is what the leaf hash covers. User
+// and Device are the commitments from utils.KeyLogUserCommitment and
+// utils.KeyLogDeviceCommitment; leaves logged before commitments were
+// introduced carry UserID, Username, DeviceID and BindingSignature instead.
+type KeyLogEntry struct {
+	Action           string    `json:"action"`
+	User             string    `json:"user,omitempty"`
+	Device           string    `json:"device,omitempty"`
+	UserID           int64     `json:"user_id,omitempty"`
+	Username         string    `json:"username,omitempty"`
+	DeviceID         string    `json:"device_id,omitempty"`
+	EncryptionKey    string    `json:"encryption_key"`
+	SigningKey       string    `json:"signing_key"`
+	BindingSignature string    `json:"binding_signature,omitempty"`
+	Timestamp        time.Time `json:"timestamp"`
+}
+
+// PublicKeyRequest publishes the calling device's keys. Signature is the
+// device's Ed25519 signature over utils.KeyBindingMessage.
+type PublicKeyRequest struct {
+	EncryptionKey string `json:"encryption_key" binding:"required"`
+	SigningKey    string `json:"signing_key" binding:"required"`
+	Signature     string `json:"signature" binding:"required"`
+}
+
+// PublicKey is a device's current keys together with the proof that the
+// log leaf registering them is in the tree the response's tree head signs.
+type PublicKey struct {
+	UserID           int64     `json:"user_id"`
+	Username         string    `json:"username"`
+	DeviceID         string    `json:"device_id"`
+	EncryptionKey    string    `json:"encryption_key"`
+	SigningKey       string    `json:"signing_key"`
+	BindingSignature string    `json:"binding_signature"`
+	CreatedAt        time.Time `json:"created_at"`
+	LogIndex         int64     `json:"log_index"`
+	Leaf             string    `json:"leaf"`
+	InclusionProof   []string  `json:"inclusion_proof"`
+}
+
+// TreeHead commits to the first TreeSize leaves of the key log.
+type TreeHead struct {
+	TreeSize  int64     `json:"tree_size"`
+	RootHash  string    `json:"root_hash"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// SignedTreeHead carries the exact signed bytes, like
+// SignedDeletionReceipt, with the type utils.StatementTreeHead.
+type SignedTreeHead struct {
+	TreeHead  TreeHead `json:"tree_head"`
+	Payload   string   `json:"payload"`
+	Signature string   `json:"signature"`
+	KeyID     string   `json:"key_id"`
+	Algorithm string   `json:"algorithm"`
+}
+
+// KeyLogLeaf is a leaf as served to auditors.
+type KeyLogLeaf struct {
+	Index int64  `json:"index"`
+	Leaf  string `json:"leaf"`
+}
+
+// Share permissions.
+const (
+	SharePermissionRead  = "read"
+	SharePermissionWrite = "write"
+)
+
+// WrappedItemKey is the key of an item or shared vault wrapped for one of
+// the recipient's devices, under that device's key from the key directory. The
+// server stores it as sent and cannot unwrap it.
+type WrappedItemKey struct {
+	DeviceID      string `json:"device_id" binding:"required"`
+	EncryptionKey string `json:"encryption_key" binding:"required"`
+	WrappedKey    string `json:"wrapped_key" binding:"required"`
+}
+
+// ShareRequest shares an item with Recipient, or changes an existing share.
+type ShareRequest struct {
+	Recipient   string           `json:"recipient" binding:"required"`
+	Permission  string           `json:"permission" binding:"required"`
+	WrappedKeys []WrappedItemKey `json:"wrapped_keys" binding:"required,dive"`
+}
+
+// ItemShare is a share as its owner sees it.
+type ItemShare struct {
+	ID          int64            `json:"id"`
+	ItemID      string           `json:"item_id"`
+	Recipient   string           `json:"recipient"`
+	Permission  string           `json:"permission"`
+	CreatedAt   time.Time        `json:"created_at"`
+	UpdatedAt   time.Time        `json:"updated_at"`
+	RevokedAt   *time.Time       `json:"revoked_at,omitempty"`
+	WrappedKeys []WrappedItemKey `json:"wrapped_keys"`
+}
+
+// SharedItem is an item another user shared with the caller.
+type SharedItem struct {
+	FileMetadata
+	Owner       string           `json:"owner"`
+	Permission  string           `json:"permission"`
+	WrappedKeys []WrappedItemKey `json:"wrapped_keys"`
+}
+
+// Shared vault roles. Viewers can read a vault's items, editors can also
+// change them, and the owner can also manage members and delete the vault.
+const (
+	VaultRoleOwner  = "owner"
+	VaultRoleEditor = "editor"
+	VaultRoleViewer = "viewer"
+)
+
+// SharedVaultRequest creates a shared vault. Name is an envelope sealed
+// with the vault key, and WrappedKeys hold that key for the creator's
+// devices.
+type SharedVaultRequest struct {
+	Name        string           `json:"name" binding:"required"`
+	WrappedKeys []WrappedItemKey `json:"wrapped_keys" binding:"required,dive"`
+}
+
+// VaultMemberRequest adds a member or changes their role. WrappedKeys hold
+// the vault key for the member's devices and replace any stored before.
+type VaultMemberRequest struct {
+	Role        string           `json:"role" binding:"required"`
+	WrappedKeys []WrappedItemKey `json:"wrapped_keys" binding:"dive"`
+}
+
+// SharedVault is a shared vault as one of its members sees it.
+type SharedVault struct {
+	ID          string           `json:"id"`
+	Name        string           `json:"name"`
+	Owner       string           `json:"owner"`
+	Role        string           `json:"role"`
+	CreatedAt   time.Time        `json:"created_at"`
+	WrappedKeys []WrappedItemKey `json:"wrapped_keys"`
+}
+
+// VaultMember is one member of a shared vault.
+type VaultMember struct {
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Devices are the member's devices that have the vault key.
+	Devices []string `json:"devices"`
+}
+
+// VaultSync is the part of a sync response for one shared vault.
+type VaultSync struct {
+	Vault        SharedVault    `json:"vault"`
 	UpdatedItems []FileMetadata `json:"updated_items"`
 	DeletedIDs   []string       `json:"deleted_ids"`
-	SyncToken    string         `json:"sync_token"`
-	Timestamp    time.Time      `json:"timestamp"`
+}
+
+// ShareLinkRequest creates a share link. MaxDownloads and Password are
+// optional; zero and "" mean no limit and no password.
+type ShareLinkRequest struct {
+	TTLHours     int    `json:"ttl_hours"`
+	MaxDownloads int    `json:"max_downloads"`
+	Password     string `json:"password"`
+}
+
+// ShareLink is a share link as its owner sees it. Token is only set when
+// the link is created.
+type ShareLink struct {
+	ID            int64      `json:"id"`
+	Token         string     `json:"token,omitempty"`
+	ItemID        string     `json:"item_id"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	MaxDownloads  *int       `json:"max_downloads,omitempty"`
+	DownloadCount int        `json:"download_count"`
+	HasPassword   bool       `json:"has_password"`
+	RevokedAt     *time.Time `json:"revoked_at,omitempty"`
+}
+
+// ShareLinkAccess is one recorded use of a share link.
+type ShareLinkAccess struct {
+	ID         int64     `json:"id"`
+	Outcome    string    `json:"outcome"`
+	IPAddress  string    `json:"ip_address"`
+	AccessedAt time.Time `json:"accessed_at"`
+}
+
+// ShareLinkDownloadRequest opens a share link.
+type ShareLinkDownloadRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password"`
+}
+
+// ShareLinkDownload is the ciphertext a share link serves. The key that
+// decrypts it travels in the link's URL fragment and never reaches the
+// server.
+type ShareLinkDownload struct {
+	ItemID             string    `json:"item_id"`
+	EncryptedData      string    `json:"encrypted_data"`
+	ExpiresAt          time.Time `json:"expires_at"`
+	DownloadsRemaining *int      `json:"downloads_remaining,omitempty"`
 }
 
 type AuthRequest struct {
-	Username string `json:"username" binding:"required"`
-	Password string `json:"password" binding:"required"`
-	DeviceID string `json:"device_id" binding:"required"`
+	Username        string `json:"username" binding:"required"`
+	Password        string `json:"password" binding:"required"`
+	DeviceID        string `json:"device_id" binding:"required"`
+	InviteCode      string `json:"invite_code"`
+	DevicePublicKey string `json:"device_public_key"`
 }
 type AuthResponse struct {
-	Token     string `json:"token"`
-	ExpiresAt int64  `json:"expires_at"`
-	UserID    int64  `json:"user_id"`
+	Token         string   `json:"token"`
+	ExpiresAt     int64    `json:"expires_at"`
+	UserID        int64    `json:"user_id"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+type RecoveryRequest struct {
+	Username        string `json:"username" binding:"required"`
+	RecoveryCode    string `json:"recovery_code" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+	DeviceID        string `json:"device_id" binding:"required"`
+	DevicePublicKey string `json:"device_public_key"`
+}
+
+type RecoveryCodesRequest struct {
+	Password string `json:"password" binding:"required"`
+}
+
+type PasswordChangeRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+// AccountDeleteRequest confirms an account deletion. Accounts created
+// through an identity provider have no password and instead sign in with it
+// again shortly before deleting.
+type AccountDeleteRequest struct {
+	Password string `json:"password"`
+}
+
+// DeletionReceipt records what was purged when an account was deleted.
+type DeletionReceipt struct {
+	ReceiptID    string           `json:"receipt_id"`
+	UserID       int64            `json:"user_id"`
+	Username     string           `json:"username"`
+	DeletedAt    time.Time        `json:"deleted_at"`
+	RowsDeleted  map[string]int64 `json:"rows_deleted"`
+	RowsRemain   map[string]int64 `json:"rows_remaining"`
+	SecureDelete bool             `json:"secure_delete"`
+	Vacuumed     bool             `json:"vacuumed"`
+}
+
+// SignedDeletionReceipt carries the exact signed bytes so clients can verify
+// the signature against the server's public signing key. Payload is the
+// statement type utils.StatementDeletionReceipt, a newline and the receipt's
+// JSON; clients must check the type before reading the JSON, as the same key
+// signs other statements.
+type SignedDeletionReceipt struct {
+	Receipt   DeletionReceipt `json:"receipt"`
+	Payload   string          `json:"payload"`
+	Signature string          `json:"signature"`
+	KeyID     string          `json:"key_id"`
+	Algorithm string          `json:"algorithm"`
+}
+
+type DeviceCertificateRequest struct {
+	CSR string `json:"csr" binding:"required"`
+}
+
+type DeviceCertificate struct {
+	ID             int64      `json:"id" db:"id"`
+	UserID         int64      `json:"user_id" db:"user_id"`
+	DeviceID       string     `json:"device_id" db:"device_id"`
+	Status         string     `json:"status" db:"status"`
+	Serial         string     `json:"serial,omitempty" db:"serial"`
+	CertificatePEM string     `json:"certificate_pem,omitempty" db:"cert_pem"`
+	CAPEM          string     `json:"ca_pem,omitempty" db:"-"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+	IssuedAt       *time.Time `json:"issued_at,omitempty" db:"issued_at"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty" db:"expires_at"`
+	RevokedAt      *time.Time `json:"revoked_at,omitempty" db:"revoked_at"`
+}
+
+type Invite struct {
+	ID        int64      `json:"id" db:"id"`
+	Code      string     `json:"code,omitempty" db:"-"`
+	CreatedBy int64      `json:"created_by" db:"created_by"`
+	Note      string     `json:"note" db:"note"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at" db:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty" db:"used_at"`
+	UsedBy    *int64     `json:"used_by,omitempty" db:"used_by"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty" db:"revoked_at"`
+}
+
+type InviteRequest struct {
+	Note     string `json:"note"`
+	TTLHours int    `json:"ttl_hours"`
 }
@@ -0,0 +1,292 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prefixes marking column values sealed on the server. Values without one
+// were written before at-rest encryption was enabled and are returned as
+// stored.
+const (
+	// AtRestPrefixV1 values are sealed directly with the master key.
+	AtRestPrefixV1 = "enc:v1:"
+	// AtRestPrefixV2 values are sealed with the owning user's data key.
+	AtRestPrefixV2 = "enc:v2:"
+	// AtRestPrefixV3 values are sealed with the owning user's data key and
+	// bound to their user, row and column.
+	AtRestPrefixV3 = "enc:v3:"
+)
+
+// AtRestIndexPrefix marks a blind index: a keyed hash stored in place of a
+// value that is only ever looked up, never read back.
+const AtRestIndexPrefix = "idx:v1:"
+
+const userKeySize = 32
+
+// AtRestColumn is a column FieldCipher seals, along with the columns naming
+// the user whose data key it is sealed under and the row it is bound to.
+type AtRestColumn struct {
+	Table      string
+	Column     string
+	UserColumn string
+	ItemColumn string
+}
+
+func (col AtRestColumn) Name() string {
+	return col.Table + "." + col.Column
+}
+
+// Sealed columns.
+var (
+	FileMetadataData = AtRestColumn{"file_metadata", "encrypted_data", "user_id", "id"}
+	UserDeviceID     = AtRestColumn{"users", "device_id", "id", "id"}
+	SessionDeviceID  = AtRestColumn{"sessions", "device_id", "user_id", "id"}
+	CertDeviceID     = AtRestColumn{"device_certificates", "device_id", "user_id", "id"}
+	CertCSR          = AtRestColumn{"device_certificates", "csr_pem", "user_id", "id"}
+	CertPEM          = AtRestColumn{"device_certificates", "cert_pem", "user_id", "id"}
+	AuditDetail      = AtRestColumn{"audit_log", "detail", "user_id", "id"}
+	AuditIPAddress   = AtRestColumn{"audit_log", "ip_address", "user_id", "id"}
+	ShareLinkIP      = AtRestColumn{"share_link_accesses", "ip_address", "owner_id", "id"}
+)
+
+// AtRestColumns lists every sealed column.
+var AtRestColumns = []AtRestColumn{FileMetadataData, UserDeviceID, SessionDeviceID, CertDeviceID, CertCSR, CertPEM, AuditDetail, AuditIPAddress, ShareLinkIP}
+
+// DeviceIndex is the blind index devices rows are looked up by in place of
+// the device ID. Device IDs in public_keys are not covered: the key
+// directory publishes them to other users, who address wrapped keys by them.
+var DeviceIndex = AtRestColumn{"devices", "device_id", "user_id", "id"}
+
+var ErrAtRestKeyMissing = errors.New("value is encrypted at rest but AT_REST_ENCRYPTION is disabled")
+
+// ErrAtRestUnbound is returned for a value in an older format, or not sealed
+// at all, once reseal has moved every column to enc:v3. Such a value can
+// only have been written into the database directly.
+var ErrAtRestUnbound = errors.New("value is not sealed in the current at-rest format")
+
+// atRestFormatSetting is the server_settings entry reseal writes once every
+// sealed column holds enc:v3 values only.
+const atRestFormatSetting = "at_rest_format"
+
+// MarkAtRestResealed records that every sealed column has been resealed, so
+// later starts only accept enc:v3 values.
+func MarkAtRestResealed(db DBTX) error {
+	_, err := db.Exec(
+		"INSERT INTO server_settings (name, value) VALUES (?, 'v3') ON CONFLICT (name) DO UPDATE SET value = excluded.value",
+		atRestFormatSetting,
+	)
+	return err
+}
+
+// AtRestResealed reports whether MarkAtRestResealed has been called.
+func AtRestResealed(db DBTX) (bool, error) {
+	var value string
+	err := db.QueryRow("SELECT value FROM server_settings WHERE name = ?", atRestFormatSetting).Scan(&value)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return value == "v3", err
+}
+
+// DBTX is satisfied by both *sql.DB and *sql.Tx.
+type DBTX interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// FieldCipher adds a server-side layer of encryption to individual database
+// columns, so a copied metadata.db reveals neither the client envelopes nor
+// identifying fields. Each user's values are sealed with their own data key,
+// stored in user_keys wrapped by the master key; deleting that row makes the
+// user's sealed values unrecoverable. A nil FieldCipher stores values
+// unchanged.
+type FieldCipher struct {
+	master       *CryptoService
+	requireBound bool
+}
+
+func NewFieldCipher(master *CryptoService) *FieldCipher {
+	return &FieldCipher{master: master}
+}
+
+// RequireBound makes Open refuse anything but enc:v3 values. Call it once
+// reseal has converted the database.
+func (fc *FieldCipher) RequireBound() {
+	fc.requireBound = true
+}
+
+// ForUser returns a cipher bound to userID's data key, generating the key on
+// first use. Pass the surrounding transaction, if any, as db.
+func (fc *FieldCipher) ForUser(db DBTX, userID int64) (*UserCipher, error) {
+	if fc == nil {
+		return nil, nil
+	}
+
+	var wrapped string
+	var bound bool
+	err := db.QueryRow("SELECT wrapped_key, context_bound FROM user_keys WHERE user_id = ?", userID).Scan(&wrapped, &bound)
+	if err == sql.ErrNoRows {
+		wrapped, err = fc.createUserKey(db, userID)
+		bound = true
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := fc.unwrapUserKey(userID, wrapped, bound)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UserCipher{
+		userID:       userID,
+		master:       fc.master,
+		key:          NewCryptoService(string(key)),
+		indexKey:     deriveIndexKey(key),
+		requireBound: fc.requireBound,
+	}, nil
+}
+
+// deriveIndexKey derives the key blind indexes are computed with from a
+// user's data key, so it is unrecoverable along with their sealed values.
+func deriveIndexKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("aiprivacyvault/index/v1"))
+	return mac.Sum(nil)
+}
+
+// RewrapUserKey re-encrypts a wrapped data key under the active master key,
+// bound to its user.
+func (fc *FieldCipher) RewrapUserKey(userID int64, wrapped string, bound bool) (string, error) {
+	key, err := fc.unwrapUserKey(userID, wrapped, bound)
+	if err != nil {
+		return "", err
+	}
+	return fc.master.EncryptWithContext(key, userKeyContext(userID))
+}
+
+func (fc *FieldCipher) unwrapUserKey(userID int64, wrapped string, bound bool) ([]byte, error) {
+	// Keys wrapped before context binding stay readable until the next
+	// rotate-keys run rewraps them.
+	if !bound {
+		return fc.master.Decrypt(wrapped)
+	}
+	return fc.master.DecryptWithContext(wrapped, userKeyContext(userID))
+}
+
+func (fc *FieldCipher) createUserKey(db DBTX, userID int64) (string, error) {
+	key := make([]byte, userKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+
+	wrapped, err := fc.master.EncryptWithContext(key, userKeyContext(userID))
+	if err != nil {
+		return "", err
+	}
+
+	// Another request may have created the key first; whichever row won is
+	// the one to use.
+	if _, err := db.Exec(
+		"INSERT OR IGNORE INTO user_keys (user_id, wrapped_key, key_id, context_bound, created_at) VALUES (?, ?, ?, 1, ?)",
+		userID, wrapped, fc.master.ActiveKeyID(), time.Now(),
+	); err != nil {
+		return "", err
+	}
+
+	err = db.QueryRow("SELECT wrapped_key FROM user_keys WHERE user_id = ?", userID).Scan(&wrapped)
+	return wrapped, err
+}
+
+func userKeyContext(userID int64) EncryptionContext {
+	return EncryptionContext{UserID: userID, Column: "user_keys.wrapped_key"}
+}
+
+// UserCipher seals and opens one user's column values. A nil UserCipher
+// stores values unchanged.
+type UserCipher struct {
+	userID       int64
+	master       *CryptoService
+	key          *CryptoService
+	indexKey     []byte
+	requireBound bool
+}
+
+// Seal encrypts value for storage in column of the row identified by itemID.
+func (uc *UserCipher) Seal(column AtRestColumn, itemID, value string) (string, error) {
+	if uc == nil {
+		return value, nil
+	}
+	sealed, err := uc.key.EncryptWithContext([]byte(value), uc.context(column, itemID))
+	if err != nil {
+		return "", err
+	}
+	return AtRestPrefixV3 + sealed, nil
+}
+
+// Open reverses Seal. A v3 value only opens in the column and row it was
+// sealed for; older values are still accepted so they can be migrated,
+// until RequireBound is set. Empty values, which columns hold before
+// anything is stored in them, are always accepted.
+func (uc *UserCipher) Open(column AtRestColumn, itemID, stored string) (string, error) {
+	var plaintext []byte
+	var err error
+	switch {
+	case strings.HasPrefix(stored, AtRestPrefixV3):
+		if uc == nil {
+			return "", ErrAtRestKeyMissing
+		}
+		plaintext, err = uc.key.DecryptWithContext(strings.TrimPrefix(stored, AtRestPrefixV3), uc.context(column, itemID))
+	case stored == "":
+		return "", nil
+	case uc != nil && uc.requireBound:
+		return "", ErrAtRestUnbound
+	case strings.HasPrefix(stored, AtRestPrefixV2):
+		if uc == nil {
+			return "", ErrAtRestKeyMissing
+		}
+		plaintext, err = uc.key.Decrypt(strings.TrimPrefix(stored, AtRestPrefixV2))
+	case strings.HasPrefix(stored, AtRestPrefixV1):
+		if uc == nil {
+			return "", ErrAtRestKeyMissing
+		}
+		plaintext, err = uc.master.Decrypt(strings.TrimPrefix(stored, AtRestPrefixV1))
+	default:
+		return stored, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Index returns a blind index of value for column: equal values give equal
+// indexes, so it can be used in lookups and unique constraints, but it
+// cannot be reversed without the user's data key.
+func (uc *UserCipher) Index(column AtRestColumn, value string) string {
+	if uc == nil {
+		return value
+	}
+	mac := hmac.New(sha256.New, uc.indexKey)
+	mac.Write([]byte(column.Name() + "\x00" + value))
+	return AtRestIndexPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (uc *UserCipher) context(column AtRestColumn, itemID string) EncryptionContext {
+	return EncryptionContext{UserID: uc.userID, ItemID: itemID, Column: column.Name()}
+}
+
+// FormatItemID renders an integer row ID for use as an item ID.
+func FormatItemID(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
@@ -0,0 +1,288 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// BreachedPasswordList looks passwords up in a local copy of the Have I Been
+// Pwned SHA-1 corpus. Two layouts are supported:
+//
+//   - a single file ordered by hash, where every line is
+//     "<40 hex SHA-1>:<count>";
+//   - a directory in the range format, with one file per 5 hex digit prefix
+//     (e.g. "21BD1.txt", as written by the PwnedPasswordsDownloader or
+//     fetched from the range API) whose lines are "<35 hex suffix>:<count>".
+//
+// Lines must be sorted by hash. Files are binary searched in place, so only
+// a few small reads are made per lookup and memory use does not depend on
+// the corpus size.
+type BreachedPasswordList struct {
+	// Exactly one of file and rangeDir is set.
+	file     *hashFile
+	rangeDir string
+}
+
+// breachPrefixLength is the length of the prefixes range files are named
+// after and stripped of.
+const breachPrefixLength = 5
+
+const breachLineReadSize = 128
+
+// OpenBreachedPasswordList returns nil without an error when path is empty or
+// does not exist, in which case the breach check is skipped. A list that
+// exists but is not in either format is an error.
+func OpenBreachedPasswordList(path string) (*BreachedPasswordList, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("Breached password list not found at %s, skipping breach checks", path)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		sample, count, err := findRangeFiles(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		file, err := openHashFile(sample, sha1.Size*2-breachPrefixLength)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", sample, err)
+		}
+		file.Close()
+
+		log.Printf("Loaded breached password range files from %s (%d prefixes)", path, count)
+		return &BreachedPasswordList{rangeDir: path}, nil
+	}
+
+	file, err := openHashFile(path, sha1.Size*2)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	log.Printf("Loaded breached password list from %s (%d bytes)", path, file.size)
+	return &BreachedPasswordList{file: file}, nil
+}
+
+// findRangeFiles returns one of the range files in dir, to check its format,
+// and how many there are.
+func findRangeFiles(dir string) (string, int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var sample string
+	count := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !isRangePrefix(strings.TrimSuffix(entry.Name(), ".txt")) {
+			continue
+		}
+		if sample == "" {
+			sample = filepath.Join(dir, entry.Name())
+		}
+		count++
+	}
+	if count == 0 {
+		return "", 0, errors.New("no range files named after a 5 hex digit prefix found")
+	}
+	return sample, count, nil
+}
+
+func isRangePrefix(name string) bool {
+	if len(name) != breachPrefixLength {
+		return false
+	}
+	_, err := hex.DecodeString(name + "0")
+	return err == nil
+}
+
+// Contains reports whether the password's SHA-1 appears in the list.
+func (b *BreachedPasswordList) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	target := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	if b.file != nil {
+		return b.file.contains(target)
+	}
+
+	prefix, suffix := target[:breachPrefixLength], target[breachPrefixLength:]
+	path := filepath.Join(b.rangeDir, prefix+".txt")
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		path = filepath.Join(b.rangeDir, prefix)
+	}
+	file, err := openHashFile(path, len(suffix))
+	if errors.Is(err, os.ErrNotExist) {
+		// Not every prefix has to be present in a partial download.
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("%s: %w", path, err)
+	}
+	defer file.Close()
+
+	return file.contains(suffix)
+}
+
+func (b *BreachedPasswordList) Close() error {
+	if b.file != nil {
+		return b.file.Close()
+	}
+	return nil
+}
+
+// hashFile is one sorted file of "<hash>:<count>" lines whose hashes all
+// have hashLength hex digits.
+type hashFile struct {
+	file       *os.File
+	size       int64
+	hashLength int
+}
+
+// openHashFile opens a hash file and checks that its first line is in the
+// expected format.
+func openHashFile(path string, hashLength int) (*hashFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	h := &hashFile{file: file, size: info.Size(), hashLength: hashLength}
+
+	if h.size > 0 {
+		line, _, err := h.readLine(0)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if _, _, err := h.parseLine(line); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
+
+func (h *hashFile) contains(target string) (bool, error) {
+	lo, hi := int64(0), h.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		start, err := h.nextLineStart(mid)
+		if err != nil {
+			return false, err
+		}
+		if start >= hi {
+			hi = mid
+			continue
+		}
+
+		line, next, err := h.readLine(start)
+		if err != nil {
+			return false, err
+		}
+		hash, count, err := h.parseLine(line)
+		if err != nil {
+			return false, err
+		}
+
+		switch strings.Compare(hash, target) {
+		case 0:
+			// Padded range responses include made-up hashes with a count
+			// of zero.
+			return count > 0, nil
+		case -1:
+			lo = next
+		default:
+			hi = mid
+		}
+	}
+
+	return false, nil
+}
+
+func (h *hashFile) Close() error {
+	return h.file.Close()
+}
+
+// nextLineStart returns the offset of the first line starting at or after offset.
+func (h *hashFile) nextLineStart(offset int64) (int64, error) {
+	if offset == 0 {
+		return 0, nil
+	}
+
+	pos := offset - 1
+	buf := make([]byte, breachLineReadSize)
+	for pos < h.size {
+		n, err := h.file.ReadAt(buf, pos)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			return pos + int64(i) + 1, nil
+		}
+		if err == io.EOF || n == 0 {
+			break
+		}
+		pos += int64(n)
+	}
+	return h.size, nil
+}
+
+// readLine returns the line starting at offset and the offset of the next one.
+func (h *hashFile) readLine(offset int64) (string, int64, error) {
+	buf := make([]byte, breachLineReadSize)
+	n, err := h.file.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return "", 0, err
+	}
+	buf = buf[:n]
+
+	if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+		return string(buf[:i]), offset + int64(i) + 1, nil
+	}
+	if offset+int64(n) >= h.size {
+		return string(buf), h.size, nil
+	}
+	return "", 0, fmt.Errorf("breached password list line at offset %d is too long", offset)
+}
+
+func (h *hashFile) parseLine(line string) (string, int64, error) {
+	line = strings.TrimRight(line, "\r")
+	hash, countText, ok := strings.Cut(line, ":")
+	if len(hash) != h.hashLength {
+		return "", 0, fmt.Errorf("breached password list is not in %d hex digit hash:count format", h.hashLength)
+	}
+	if _, err := hex.DecodeString(hash + strings.Repeat("0", h.hashLength%2)); err != nil {
+		return "", 0, fmt.Errorf("breached password list is not in %d hex digit hash:count format", h.hashLength)
+	}
+	// Lists without counts are taken to be all breached.
+	count := int64(1)
+	if ok {
+		var err error
+		if count, err = strconv.ParseInt(strings.TrimSpace(countText), 10, 64); err != nil {
+			return "", 0, fmt.Errorf("breached password list has an invalid count %q", countText)
+		}
+	}
+	return strings.ToUpper(hash), count, nil
+}
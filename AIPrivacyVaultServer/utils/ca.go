@@ -0,0 +1,283 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clientIdentityScheme is used for the URI SAN that ties a client certificate
+// to a vault user and device: aiprivacyvault://user/<id>/device/<device_id>.
+const clientIdentityScheme = "aiprivacyvault"
+
+// CertificateAuthority is a small local CA that issues client certificates to
+// approved devices for mutual TLS.
+type CertificateAuthority struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+}
+
+// LoadOrCreateCA loads ca.crt and ca.key from dir, creating them on first use.
+func LoadOrCreateCA(dir string) (*CertificateAuthority, error) {
+	certPath := filepath.Join(dir, "ca.crt")
+	keyPath := filepath.Join(dir, "ca.key")
+
+	certPEM, certErr := os.ReadFile(certPath)
+	keyPEM, keyErr := os.ReadFile(keyPath)
+	if errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist) {
+		return createCA(certPath, keyPath)
+	}
+	if certErr != nil {
+		return nil, certErr
+	}
+	if keyErr != nil {
+		return nil, keyErr
+	}
+
+	cert, err := parseCertificatePEM(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseECPrivateKeyPEM(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CertificateAuthority{cert: cert, key: key, certPEM: certPEM}, nil
+}
+
+func createCA(certPath, keyPath string) (*CertificateAuthority, error) {
+	log.Printf("Generating device certificate authority in %s...", filepath.Dir(certPath))
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "AI Privacy Vault Device CA (" + hostname + ")"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM, err := encodeECPrivateKeyPEM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certPath), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return nil, err
+	}
+
+	return &CertificateAuthority{cert: cert, key: key, certPEM: certPEM}, nil
+}
+
+// CertificatePEM returns the CA certificate clients need to trust.
+func (ca *CertificateAuthority) CertificatePEM() []byte {
+	return ca.certPEM
+}
+
+// ClientCAPool is used as tls.Config.ClientCAs.
+func (ca *CertificateAuthority) ClientCAPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// ParseCSR decodes and checks a PEM certificate signing request from a device.
+func ParseCSR(csrPEM string) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("csr must be a PEM encoded CERTIFICATE REQUEST")
+	}
+
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, errors.New("csr signature is invalid")
+	}
+
+	switch pub := csr.PublicKey.(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return nil, errors.New("rsa keys must be at least 2048 bits")
+		}
+	default:
+		return nil, errors.New("unsupported csr key type")
+	}
+
+	return csr, nil
+}
+
+// IssueClientCertificate signs the device's CSR. The subject and SANs are set
+// by the CA, not taken from the CSR, so a device cannot claim another identity.
+func (ca *CertificateAuthority) IssueClientCertificate(csr *x509.CertificateRequest, userID int64, username, deviceID string, validity time.Duration) ([]byte, string, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: username, OrganizationalUnit: []string{deviceID}},
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		URIs:         []*url.URL{ClientIdentityURI(userID, deviceID)},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), serial.Text(16), nil
+}
+
+// ClientIdentityURI builds the URI SAN embedded in client certificates.
+func ClientIdentityURI(userID int64, deviceID string) *url.URL {
+	return &url.URL{
+		Scheme: clientIdentityScheme,
+		Host:   "user",
+		Path:   "/" + strconv.FormatInt(userID, 10) + "/device/" + url.PathEscape(deviceID),
+	}
+}
+
+// ParseClientIdentity extracts the user and device a client certificate was
+// issued to.
+func ParseClientIdentity(cert *x509.Certificate) (int64, string, error) {
+	for _, uri := range cert.URIs {
+		if uri.Scheme != clientIdentityScheme || uri.Host != "user" {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(uri.EscapedPath(), "/"), "/", 3)
+		if len(parts) != 3 || parts[1] != "device" {
+			continue
+		}
+		userID, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		deviceID, err := url.PathUnescape(parts[2])
+		if err != nil {
+			continue
+		}
+		return userID, deviceID, nil
+	}
+	return 0, "", errors.New("certificate does not carry a vault identity")
+}
+
+// LocalHostnames lists the names and addresses this server is reachable at on
+// the LAN, for use in server certificates.
+func LocalHostnames() ([]string, []net.IP) {
+	dnsNames := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		hostname = strings.TrimSuffix(hostname, ".local")
+		dnsNames = append([]string{hostname}, dnsNames...)
+		dnsNames = append(dnsNames, hostname+".local")
+	}
+
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+	}
+
+	return dnsNames, ips
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+}
+
+func parseCertificatePEM(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func encodeECPrivateKeyPEM(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func parseECPrivateKeyPEM(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM private key found")
+	}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := parsed.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("expected an ECDSA key, got %T", parsed)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+	}
+}
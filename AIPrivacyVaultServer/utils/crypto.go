@@ -6,71 +6,268 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
+	"sort"
+	"strconv"
 )
 
+// CryptoService writes Envelopes. It still reads the formats that came
+// before them: format | len(key ID) | key ID | nonce | sealed data, where
+// the first byte says whether the data is bound to an EncryptionContext,
+// and before that, nonce | sealed data without a key ID.
+const (
+	keyedFormat   = 0x01
+	contextFormat = 0x02
+)
+
+const nonceSize = 12
+
+// EncryptionContext says where a ciphertext is stored. It is bound into the
+// ciphertext as associated data, so a value copied to another row, column or
+// user no longer decrypts.
+type EncryptionContext struct {
+	UserID int64
+	ItemID string
+	Column string
+}
+
+func (ec EncryptionContext) associatedData() []byte {
+	return []byte("aiprivacyvault/v1\x00" + ec.Column + "\x00" + strconv.FormatInt(ec.UserID, 10) + "\x00" + ec.ItemID)
+}
+
+// CryptoService seals data with AES-GCM. It can hold several keys at once so
+// data sealed under a retired key stays readable until it is rotated.
 type CryptoService struct {
-	key []byte
+	keys     map[string][]byte
+	activeID string
 }
 
+// NewCryptoService creates a service with a single, unnamed key.
 func NewCryptoService(key string) *CryptoService {
 	return &CryptoService{
-		key: []byte(key),
+		keys:     map[string][]byte{"": []byte(key)},
+		activeID: "",
 	}
 }
 
+// NewKeyring creates a service holding every key in keys. Encrypt uses the
+// key named activeID; Decrypt accepts any of them.
+func NewKeyring(keys map[string]string, activeID string) (*CryptoService, error) {
+	cs := &CryptoService{
+		keys:     make(map[string][]byte, len(keys)),
+		activeID: activeID,
+	}
+	for id, key := range keys {
+		if len(id) > 255 {
+			return nil, fmt.Errorf("key ID %q is too long", id)
+		}
+		if _, err := aes.NewCipher([]byte(key)); err != nil {
+			return nil, fmt.Errorf("key %q: %v", id, err)
+		}
+		cs.keys[id] = []byte(key)
+	}
+	if _, ok := cs.keys[activeID]; !ok {
+		return nil, fmt.Errorf("active key %q is not loaded", activeID)
+	}
+	return cs, nil
+}
+
+// ActiveKeyID names the key Encrypt uses.
+func (cs *CryptoService) ActiveKeyID() string {
+	return cs.activeID
+}
+
 func (cs *CryptoService) Encrypt(plaintext []byte) (string, error) {
-	block, err := aes.NewCipher(cs.key)
+	return cs.seal(plaintext, nil)
+}
+
+// EncryptWithContext seals plaintext so that it only decrypts with
+// DecryptWithContext and the same context.
+func (cs *CryptoService) EncryptWithContext(plaintext []byte, ctx EncryptionContext) (string, error) {
+	return cs.seal(plaintext, ctx.associatedData())
+}
+
+func (cs *CryptoService) seal(plaintext []byte, contextData []byte) (string, error) {
+	aesgcm, err := newGCM(cs.keys[cs.activeID])
 	if err != nil {
 		return "", err
 	}
 
-	nonce := make([]byte, 12)
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+	envelope := &Envelope{
+		Version:   EnvelopeVersion,
+		Algorithm: AlgorithmAESGCM,
+		KeyID:     cs.activeID,
+		Nonce:     make([]byte, nonceSize),
+	}
+	if _, err := io.ReadFull(rand.Reader, envelope.Nonce); err != nil {
 		return "", err
 	}
 
-	aesgcm, err := cipher.NewGCM(block)
+	envelope.Ciphertext = aesgcm.Seal(nil, envelope.Nonce, plaintext, append(envelope.Header(), contextData...))
+	return envelope.Encode(), nil
+}
+
+// openEnvelope opens data in the Envelope format. envelope is nil if the
+// data is not an envelope, so older formats can be tried.
+func (cs *CryptoService) openEnvelope(encrypted []byte, contextData []byte) (envelope *Envelope, plaintext []byte, err error) {
+	envelope, err = parseEnvelope(encrypted)
 	if err != nil {
-		return "", err
+		return nil, nil, nil
+	}
+	key, ok := cs.keys[envelope.KeyID]
+	if !ok {
+		return envelope, nil, keyNotLoaded(envelope.KeyID)
+	}
+	aesgcm, err := newGCM(key)
+	if err != nil {
+		return envelope, nil, err
+	}
+	plaintext, err = aesgcm.Open(nil, envelope.Nonce, envelope.Ciphertext, append(envelope.Header(), contextData...))
+	return envelope, plaintext, err
+}
+
+// Decrypt opens data sealed by Encrypt, including data written before
+// envelopes and key IDs existed.
+func (cs *CryptoService) Decrypt(encryptedStr string) ([]byte, error) {
+	encrypted, err := base64.StdEncoding.DecodeString(encryptedStr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Legacy ciphertexts can start with bytes that look like an envelope or
+	// a header, so a reading that fails falls through to the next one.
+	envelope, plaintext, err := cs.openEnvelope(encrypted, nil)
+	if envelope != nil && err == nil {
+		return plaintext, nil
 	}
 
-	ciphertext := aesgcm.Seal(nil, nonce, plaintext, nil)
+	format, keyID, body, keyed := splitHeader(encrypted)
+	keyed = keyed && format == keyedFormat
+	if keyed {
+		if key, ok := cs.keys[keyID]; ok {
+			if plaintext, err := open(key, body, nil); err == nil {
+				return plaintext, nil
+			}
+		}
+	}
 
-	encrypted := make([]byte, len(nonce)+len(ciphertext))
-	copy(encrypted, nonce)
-	copy(encrypted[len(nonce):], ciphertext)
+	for _, id := range cs.legacyOrder() {
+		if plaintext, err := open(cs.keys[id], encrypted, nil); err == nil {
+			return plaintext, nil
+		}
+	}
 
-	return base64.StdEncoding.EncodeToString(encrypted), nil
+	if envelope != nil {
+		if _, ok := cs.keys[envelope.KeyID]; !ok {
+			return nil, keyNotLoaded(envelope.KeyID)
+		}
+	} else if keyed {
+		if _, ok := cs.keys[keyID]; !ok {
+			return nil, keyNotLoaded(keyID)
+		}
+	}
+	return nil, errors.New("data could not be decrypted with any loaded key")
 }
 
-func (cs *CryptoService) Decrypt(encryptedStr string) ([]byte, error) {
+// DecryptWithContext opens data sealed by EncryptWithContext. It fails if
+// ctx differs from the context the data was sealed with.
+func (cs *CryptoService) DecryptWithContext(encryptedStr string, ctx EncryptionContext) ([]byte, error) {
 	encrypted, err := base64.StdEncoding.DecodeString(encryptedStr)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(encrypted) < 12 {
-		return nil, errors.New("ciphertext too short")
+	envelope, plaintext, err := cs.openEnvelope(encrypted, ctx.associatedData())
+	if envelope != nil {
+		if _, ok := cs.keys[envelope.KeyID]; ok && err != nil {
+			return nil, errors.New("data does not decrypt in this context")
+		}
+		return plaintext, err
 	}
 
-	nonce := encrypted[:12]
-	ciphertext := encrypted[12:]
+	format, keyID, body, ok := splitHeader(encrypted)
+	if !ok || format != contextFormat {
+		return nil, errors.New("data is not bound to a context")
+	}
+	key, ok := cs.keys[keyID]
+	if !ok {
+		return nil, keyNotLoaded(keyID)
+	}
 
-	block, err := aes.NewCipher(cs.key)
+	plaintext, err = open(key, body, ctx.associatedData())
 	if err != nil {
-		return nil, err
+		return nil, errors.New("data does not decrypt in this context")
+	}
+	return plaintext, nil
+}
+
+// KeyID reports the key that sealed encryptedStr. ok is false for data
+// written before ciphertexts carried key IDs.
+func (cs *CryptoService) KeyID(encryptedStr string) (keyID string, ok bool) {
+	encrypted, err := base64.StdEncoding.DecodeString(encryptedStr)
+	if err != nil {
+		return "", false
+	}
+	if envelope, err := parseEnvelope(encrypted); err == nil {
+		return envelope.KeyID, true
+	}
+	_, keyID, _, ok = splitHeader(encrypted)
+	return keyID, ok
+}
+
+func keyNotLoaded(keyID string) error {
+	return fmt.Errorf("data was sealed with key %q, which is not loaded", keyID)
+}
+
+// legacyOrder tries the active key first, then the others in a stable order.
+func (cs *CryptoService) legacyOrder() []string {
+	ids := make([]string, 0, len(cs.keys))
+	for id := range cs.keys {
+		if id != cs.activeID {
+			ids = append(ids, id)
+		}
 	}
+	sort.Strings(ids)
+	return append([]string{cs.activeID}, ids...)
+}
 
-	aesgcm, err := cipher.NewGCM(block)
+func splitHeader(encrypted []byte) (byte, string, []byte, bool) {
+	if len(encrypted) < 2 || (encrypted[0] != keyedFormat && encrypted[0] != contextFormat) {
+		return 0, "", nil, false
+	}
+	end := 2 + int(encrypted[1])
+	if len(encrypted) < end+nonceSize {
+		return 0, "", nil, false
+	}
+	return encrypted[0], string(encrypted[2:end]), encrypted[end:], true
+}
+
+func open(key, encrypted, additionalData []byte) ([]byte, error) {
+	if len(encrypted) < nonceSize {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce := encrypted[:nonceSize]
+	ciphertext := encrypted[nonceSize:]
+
+	aesgcm, err := newGCM(key)
 	if err != nil {
 		return nil, err
 	}
 
-	plaintext, err := aesgcm.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := aesgcm.Open(nil, nonce, ciphertext, additionalData)
 	if err != nil {
 		return nil, err
 	}
 
 	return plaintext, nil
 }
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
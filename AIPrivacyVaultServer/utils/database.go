@@ -16,7 +16,9 @@ func InitDatabase(dbPath string) (*sql.DB, error) {
 		return nil, err
 	}
 
-	db, err := sql.Open("sqlite3", dbPath)
+	// secure_delete makes SQLite overwrite freed pages with zeros, so deleted
+	// rows do not linger in the file.
+	db, err := sql.Open("sqlite3", dbPath+"?_secure_delete=on")
 	if err != nil {
 		return nil, err
 	}
@@ -66,6 +68,428 @@ func createSchema(db *sql.DB) error {
 		return err
 	}
 
+	if err := addColumnIfMissing(db, "users", "is_admin", "BOOLEAN NOT NULL DEFAULT 0"); err != nil {
+		log.Printf("Failed to add is_admin column in %v:", err)
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS invites (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			code_hash TEXT UNIQUE NOT NULL,
+			created_by INTEGER NOT NULL,
+			note TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			used_at TIMESTAMP,
+			used_by INTEGER,
+			revoked_at TIMESTAMP,
+			FOREIGN KEY (created_by) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create invites table in %v:", err)
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS sessions (
+			id TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			device_id TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			revoked_at TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create sessions table in %v:", err)
+		return err
+	}
+
+	if err := addColumnIfMissing(db, "sessions", "device_public_key", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		log.Printf("Failed to add device_public_key column in %v:", err)
+		return err
+	}
+	if err := addColumnIfMissing(db, "sessions", "auth_method", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		log.Printf("Failed to add auth_method column in %v:", err)
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS oidc_identities (
+			issuer TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			user_id INTEGER NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (issuer, subject),
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create oidc_identities table in %v:", err)
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS recovery_codes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			code_hash TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			used_at TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create recovery_codes table in %v:", err)
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			event TEXT NOT NULL,
+			detail TEXT NOT NULL DEFAULT '',
+			ip_address TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create audit_log table in %v:", err)
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS user_keys (
+			user_id INTEGER PRIMARY KEY,
+			wrapped_key TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create user_keys table in %v:", err)
+		return err
+	}
+
+	// key_id names the master key the data key is wrapped with, so a
+	// rotation can find the keys it has not rewrapped yet.
+	if err := addColumnIfMissing(db, "user_keys", "key_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		log.Printf("Failed to add key_id column in %v:", err)
+		return err
+	}
+
+	if err := addColumnIfMissing(db, "user_keys", "context_bound", "BOOLEAN NOT NULL DEFAULT 0"); err != nil {
+		log.Printf("Failed to add context_bound column in %v:", err)
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS devices (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			device_id TEXT NOT NULL,
+			public_key TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			last_seen_at TIMESTAMP NOT NULL,
+			UNIQUE (user_id, device_id),
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create devices table in %v:", err)
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS device_certificates (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			device_id TEXT NOT NULL,
+			csr_pem TEXT NOT NULL,
+			status TEXT NOT NULL,
+			serial TEXT UNIQUE,
+			cert_pem TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL,
+			issued_at TIMESTAMP,
+			expires_at TIMESTAMP,
+			revoked_at TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create device_certificates table in %v:", err)
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS vault_states (
+			user_id INTEGER NOT NULL,
+			sequence INTEGER NOT NULL,
+			root TEXT NOT NULL,
+			previous_head TEXT NOT NULL,
+			head TEXT NOT NULL,
+			item_count INTEGER NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (user_id, sequence),
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create vault_states table in %v:", err)
+		return err
+	}
+
+	// The key log is shared by all users and only ever appended to. Its
+	// leaves outlive the keys they record: deleting an account revokes its
+	// keys in the log rather than removing them, and deletes the salt in
+	// users.key_log_salt that ties those leaves to it.
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS key_log (
+			leaf_index INTEGER PRIMARY KEY,
+			leaf TEXT NOT NULL,
+			leaf_hash TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create key_log table in %v:", err)
+		return err
+	}
+
+	// key_log_nodes holds the hash of every complete subtree of the key
+	// log above the leaves, so roots and proofs take O(log n) lookups.
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS key_log_nodes (
+			level INTEGER NOT NULL,
+			node_index INTEGER NOT NULL,
+			hash TEXT NOT NULL,
+			PRIMARY KEY (level, node_index)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create key_log_nodes table in %v:", err)
+		return err
+	}
+
+	if err := fillKeyLogNodes(db); err != nil {
+		log.Printf("Failed to build key log subtree hashes in %v:", err)
+		return err
+	}
+
+	if err := addColumnIfMissing(db, "users", "key_log_salt", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		log.Printf("Failed to add key_log_salt column in %v:", err)
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS public_keys (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			device_id TEXT NOT NULL,
+			encryption_key TEXT NOT NULL,
+			signing_key TEXT NOT NULL,
+			log_index INTEGER NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			revoked_at TIMESTAMP,
+			revoked_log_index INTEGER,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create public_keys table in %v:", err)
+		return err
+	}
+
+	if err := addColumnIfMissing(db, "public_keys", "binding_signature", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		log.Printf("Failed to add binding_signature column in %v:", err)
+		return err
+	}
+
+	// A share gives one recipient access to one item. Revoking it keeps the
+	// row, so the recipient's next sync can tell them to drop the item.
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS item_shares (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			item_id TEXT NOT NULL,
+			owner_id INTEGER NOT NULL,
+			recipient_id INTEGER NOT NULL,
+			permission TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			revoked_at TIMESTAMP,
+			UNIQUE (item_id, recipient_id),
+			FOREIGN KEY (item_id) REFERENCES file_metadata(id),
+			FOREIGN KEY (owner_id) REFERENCES users(id),
+			FOREIGN KEY (recipient_id) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create item_shares table in %v:", err)
+		return err
+	}
+
+	// owner_id and recipient_id repeat the share's so deleting either
+	// account finds these rows directly.
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS item_share_keys (
+			share_id INTEGER NOT NULL,
+			owner_id INTEGER NOT NULL,
+			recipient_id INTEGER NOT NULL,
+			device_id TEXT NOT NULL,
+			encryption_key TEXT NOT NULL,
+			wrapped_key TEXT NOT NULL,
+			PRIMARY KEY (share_id, device_id),
+			FOREIGN KEY (share_id) REFERENCES item_shares(id)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create item_share_keys table in %v:", err)
+		return err
+	}
+
+	// Items in a shared vault are stored under the vault owner's user_id,
+	// so they are sealed with the owner's data key and go when the owner's
+	// account does. Items with no vault_id are in their user's own vault.
+	if err := addColumnIfMissing(db, "file_metadata", "vault_id", "TEXT"); err != nil {
+		log.Printf("Failed to add vault_id column in %v:", err)
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS shared_vaults (
+			id TEXT PRIMARY KEY,
+			owner_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			deleted_at TIMESTAMP,
+			FOREIGN KEY (owner_id) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create shared_vaults table in %v:", err)
+		return err
+	}
+
+	// Removing a member keeps the row, so the member's next sync can tell
+	// them to drop the vault. owner_id repeats the vault's so deleting the
+	// owner's account finds these rows directly. When the owner deletes
+	// their account, the vault and the other members' rows are kept as
+	// tombstones with owner_id 0.
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS shared_vault_members (
+			vault_id TEXT NOT NULL,
+			user_id INTEGER NOT NULL,
+			owner_id INTEGER NOT NULL,
+			role TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			removed_at TIMESTAMP,
+			PRIMARY KEY (vault_id, user_id),
+			FOREIGN KEY (vault_id) REFERENCES shared_vaults(id),
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create shared_vault_members table in %v:", err)
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS shared_vault_keys (
+			vault_id TEXT NOT NULL,
+			user_id INTEGER NOT NULL,
+			owner_id INTEGER NOT NULL,
+			device_id TEXT NOT NULL,
+			encryption_key TEXT NOT NULL,
+			wrapped_key TEXT NOT NULL,
+			PRIMARY KEY (vault_id, user_id, device_id),
+			FOREIGN KEY (vault_id) REFERENCES shared_vaults(id)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create shared_vault_keys table in %v:", err)
+		return err
+	}
+
+	// Share links serve one item to anyone holding the token, which is only
+	// stored hashed.
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS share_links (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			token_hash TEXT UNIQUE NOT NULL,
+			item_id TEXT NOT NULL,
+			owner_id INTEGER NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			max_downloads INTEGER,
+			download_count INTEGER NOT NULL DEFAULT 0,
+			password_hash TEXT NOT NULL DEFAULT '',
+			revoked_at TIMESTAMP,
+			FOREIGN KEY (owner_id) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create share_links table in %v:", err)
+		return err
+	}
+
+	// failed_attempts counts wrong link passwords, plus any being checked
+	// right now.
+	if err := addColumnIfMissing(db, "share_links", "failed_attempts", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		log.Printf("Failed to add failed_attempts column in %v:", err)
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS share_link_accesses (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			link_id INTEGER NOT NULL,
+			owner_id INTEGER NOT NULL,
+			outcome TEXT NOT NULL,
+			ip_address TEXT NOT NULL DEFAULT '',
+			accessed_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (link_id) REFERENCES share_links(id)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create share_link_accesses table in %v:", err)
+		return err
+	}
+
+	// Links created before failed_attempts existed take the count from
+	// their access log. Every wrong password since is in both, so this
+	// changes nothing once they agree.
+	_, err = db.Exec(`
+		UPDATE share_links SET failed_attempts = (
+			SELECT COUNT(*) FROM share_link_accesses a
+			WHERE a.link_id = share_links.id AND a.outcome = 'bad_password'
+		)
+		WHERE password_hash != '' AND failed_attempts < (
+			SELECT COUNT(*) FROM share_link_accesses a
+			WHERE a.link_id = share_links.id AND a.outcome = 'bad_password'
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to count failed share link passwords in %v:", err)
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS server_settings (
+			name TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create server_settings table in %v:", err)
+		return err
+	}
+
 	log.Printf("Creating index if not exists...")
 	_, err = db.Exec(`
 		CREATE INDEX IF NOT EXISTS idx_file_metadata_user_id ON file_metadata (user_id)
@@ -75,9 +499,157 @@ func createSchema(db *sql.DB) error {
 		return err
 	}
 
+	_, err = db.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id)
+	`)
+	if err != nil {
+		log.Printf("Failed to create index in %v:", err)
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes (user_id)
+	`)
+	if err != nil {
+		log.Printf("Failed to create index in %v:", err)
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_public_keys_user_id ON public_keys (user_id)
+	`)
+	if err != nil {
+		log.Printf("Failed to create index in %v:", err)
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_item_shares_recipient_id ON item_shares (recipient_id)
+	`)
+	if err != nil {
+		log.Printf("Failed to create index in %v:", err)
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_file_metadata_vault_id ON file_metadata (vault_id)
+	`)
+	if err != nil {
+		log.Printf("Failed to create index in %v:", err)
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_shared_vault_members_user_id ON shared_vault_members (user_id)
+	`)
+	if err != nil {
+		log.Printf("Failed to create index in %v:", err)
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_share_links_item_id ON share_links (item_id)
+	`)
+	if err != nil {
+		log.Printf("Failed to create index in %v:", err)
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_share_link_accesses_link_id ON share_link_accesses (link_id)
+	`)
+	if err != nil {
+		log.Printf("Failed to create index in %v:", err)
+		return err
+	}
+
 	return nil
 }
 
+// fillKeyLogNodes computes the subtree hashes of a key log written before
+// they were stored alongside its leaves. A log that has any is complete,
+// since each leaf's nodes are stored in the transaction that appends it.
+func fillKeyLogNodes(db *sql.DB) error {
+	var nodes int
+	if err := db.QueryRow("SELECT COUNT(*) FROM (SELECT 1 FROM key_log_nodes LIMIT 1)").Scan(&nodes); err != nil {
+		return err
+	}
+	if nodes > 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	tree, err := KeyLogTree(tx)
+	if err != nil {
+		return err
+	}
+	size := tree.Size
+	for tree.Size = 0; tree.Size < size; tree.Size++ {
+		leafHash, err := tree.Node(0, tree.Size)
+		if err != nil {
+			return err
+		}
+		if err := StoreKeyLogNodes(tx, tree, leafHash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// WithTx runs fn in a transaction, which is committed if fn succeeds and
+// rolled back otherwise.
+func WithTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// addColumnIfMissing lets older databases pick up columns added after the
+// table was first created, since CREATE TABLE IF NOT EXISTS leaves them as-is.
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    bool
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
 func GenerateSyncToken(userID int64, timestamp interface{}) string {
 	return "sync_token_" + fmt.Sprint(userID)
 }
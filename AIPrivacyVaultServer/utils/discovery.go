@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/grandcat/zeroconf"
@@ -14,6 +15,7 @@ type DiscoveryService struct {
 	server      *zeroconf.Server
 	serviceName string
 	port        string
+	fingerprint string
 	ctx         context.Context
 	cancel      context.CancelFunc
 }
@@ -35,6 +37,13 @@ func NewDiscoveryService(serviceName, port string) *DiscoveryService {
 	return ds
 }
 
+// SetTLSFingerprint publishes the server certificate's SHA-256 fingerprint in
+// the TXT record so clients can pin it on first contact. An empty fingerprint
+// advertises plain HTTP.
+func (ds *DiscoveryService) SetTLSFingerprint(fingerprint string) {
+	ds.fingerprint = fingerprint
+}
+
 func (ds *DiscoveryService) Advertise() error {
 	startTime := time.Now()
 	log.Printf("Starting service advertisement...")
@@ -53,6 +62,11 @@ func (ds *DiscoveryService) Advertise() error {
 	fmt.Sscanf(ds.port, "%d", &port)
 	log.Printf("Using port: %d", port)
 
+	txt := []string{"version=1.0", "tls=0"}
+	if ds.fingerprint != "" {
+		txt = []string{"version=1.0", "tls=1", "fp=sha256:" + ds.fingerprint}
+	}
+
 	regTime := time.Now()
 	log.Printf("Registering mDNS service...")
 	server, err := zeroconf.Register(
@@ -60,7 +74,7 @@ func (ds *DiscoveryService) Advertise() error {
 		"_aiprivacyvault._tcp",
 		"local.",
 		port,
-		[]string{"version=1.0"},
+		txt,
 		nil,
 	)
 
@@ -104,10 +118,11 @@ func (ds *DiscoveryService) Browse() []ServiceInstance {
 
 			if len(entry.AddrIPv4) > 0 {
 				instances = append(instances, ServiceInstance{
-					Name:     entry.Instance,
-					Address:  entry.AddrIPv4[0].String(),
-					Port:     entry.Port,
-					Hostname: entry.HostName,
+					Name:        entry.Instance,
+					Address:     entry.AddrIPv4[0].String(),
+					Port:        entry.Port,
+					Hostname:    entry.HostName,
+					Fingerprint: txtValue(entry.Text, "fp"),
 				})
 			} else {
 				log.Printf("Service has no IPv4 address: %s", entry.Instance)
@@ -153,8 +168,18 @@ func (ds *DiscoveryService) IsRunning() bool {
 }
 
 type ServiceInstance struct {
-	Name     string
-	Address  string
-	Port     int
-	Hostname string
+	Name        string
+	Address     string
+	Port        int
+	Hostname    string
+	Fingerprint string
+}
+
+func txtValue(records []string, key string) string {
+	for _, record := range records {
+		if strings.HasPrefix(record, key+"=") {
+			return strings.TrimPrefix(record, key+"=")
+		}
+	}
+	return ""
 }
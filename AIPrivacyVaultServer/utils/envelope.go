@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Envelope is the format of everything encrypted with AES-GCM in this
+// project: the payloads clients upload as FileMetadata.EncryptedData and
+// the values CryptoService seals. It travels base64-encoded (standard
+// alphabet, padded) and is laid out as
+//
+//	magic      4 bytes   "AIPV"
+//	version    1 byte    EnvelopeVersion
+//	algorithm  1 byte    AlgorithmAESGCM
+//	key ID     1 byte length, then up to 255 bytes naming the key
+//	nonce      12 bytes
+//	ciphertext followed by the 16-byte GCM tag
+//
+// The header (everything before the nonce) is passed to GCM as associated
+// data, so the version, algorithm and key ID cannot be altered without
+// failing authentication. CryptoService appends its EncryptionContext to the
+// associated data; clients use the header alone. Key IDs are opaque labels
+// chosen by whoever sealed the envelope and need not be unique across users.
+const (
+	EnvelopeMagic   = "AIPV"
+	EnvelopeVersion = 1
+	AlgorithmAESGCM = 1
+)
+
+const gcmTagSize = 16
+
+var (
+	ErrNotEnvelope   = errors.New("payload is not an encrypted envelope")
+	ErrPlaintextJSON = errors.New("payload looks like unencrypted JSON")
+)
+
+// Envelope is a parsed envelope.
+type Envelope struct {
+	Version    byte
+	Algorithm  byte
+	KeyID      string
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// Header returns the authenticated header bytes.
+func (e *Envelope) Header() []byte {
+	header := make([]byte, 0, len(EnvelopeMagic)+3+len(e.KeyID))
+	header = append(header, EnvelopeMagic...)
+	header = append(header, e.Version, e.Algorithm, byte(len(e.KeyID)))
+	return append(header, e.KeyID...)
+}
+
+// Encode returns the envelope in its transport form.
+func (e *Envelope) Encode() string {
+	encoded := e.Header()
+	encoded = append(encoded, e.Nonce...)
+	encoded = append(encoded, e.Ciphertext...)
+	return base64.StdEncoding.EncodeToString(encoded)
+}
+
+// ParseEnvelope decodes and checks the structure of an envelope. It cannot
+// check that the ciphertext authenticates, which needs the key.
+func ParseEnvelope(encoded string) (*Envelope, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrNotEnvelope
+	}
+	return parseEnvelope(raw)
+}
+
+func parseEnvelope(raw []byte) (*Envelope, error) {
+	if len(raw) < len(EnvelopeMagic)+3 || !bytes.HasPrefix(raw, []byte(EnvelopeMagic)) {
+		return nil, ErrNotEnvelope
+	}
+
+	e := &Envelope{
+		Version:   raw[len(EnvelopeMagic)],
+		Algorithm: raw[len(EnvelopeMagic)+1],
+	}
+	if e.Version != EnvelopeVersion {
+		return nil, fmt.Errorf("unsupported envelope version %d", e.Version)
+	}
+	if e.Algorithm != AlgorithmAESGCM {
+		return nil, fmt.Errorf("unsupported envelope algorithm %d", e.Algorithm)
+	}
+
+	body := raw[len(EnvelopeMagic)+3:]
+	keyIDLength := int(raw[len(EnvelopeMagic)+2])
+	if len(body) < keyIDLength+nonceSize+gcmTagSize {
+		return nil, errors.New("envelope is truncated")
+	}
+	e.KeyID = string(body[:keyIDLength])
+	e.Nonce = body[keyIDLength : keyIDLength+nonceSize]
+	e.Ciphertext = body[keyIDLength+nonceSize:]
+	return e, nil
+}
+
+// ValidateClientPayload checks that a payload a client wants stored is an
+// envelope, so a client bug cannot sync unencrypted data to every device.
+func ValidateClientPayload(encoded string) error {
+	trimmed := bytes.TrimSpace([]byte(encoded))
+	if json.Valid(trimmed) && len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		return ErrPlaintextJSON
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return ErrNotEnvelope
+	}
+	if json.Valid(raw) {
+		return ErrPlaintextJSON
+	}
+
+	_, err = parseEnvelope(raw)
+	return err
+}
@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testEnvelope(keyID string) *Envelope {
+	return &Envelope{
+		Version:    EnvelopeVersion,
+		Algorithm:  AlgorithmAESGCM,
+		KeyID:      keyID,
+		Nonce:      bytes.Repeat([]byte{0x01}, nonceSize),
+		Ciphertext: bytes.Repeat([]byte{0x02}, gcmTagSize+5),
+	}
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	for _, keyID := range []string{"", "device-key-1", strings.Repeat("k", 255)} {
+		want := testEnvelope(keyID)
+
+		got, err := ParseEnvelope(want.Encode())
+		if err != nil {
+			t.Fatalf("key ID of length %d: %v", len(keyID), err)
+		}
+		if got.Version != want.Version || got.Algorithm != want.Algorithm || got.KeyID != want.KeyID ||
+			!bytes.Equal(got.Nonce, want.Nonce) || !bytes.Equal(got.Ciphertext, want.Ciphertext) {
+			t.Fatalf("key ID of length %d: parsed %+v, want %+v", len(keyID), got, want)
+		}
+	}
+}
+
+func TestEnvelopeLayout(t *testing.T) {
+	raw, err := base64.StdEncoding.DecodeString(testEnvelope("ab").Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{'A', 'I', 'P', 'V', EnvelopeVersion, AlgorithmAESGCM, 2, 'a', 'b'}
+	if !bytes.HasPrefix(raw, want) {
+		t.Fatalf("header is %x, want %x", raw[:len(want)], want)
+	}
+	if !bytes.Equal(testEnvelope("ab").Header(), want) {
+		t.Fatalf("Header() = %x, want %x", testEnvelope("ab").Header(), want)
+	}
+	if len(raw) != len(want)+nonceSize+gcmTagSize+5 {
+		t.Fatalf("envelope is %d bytes long", len(raw))
+	}
+}
+
+func TestParseEnvelopeRejectsMalformedInput(t *testing.T) {
+	valid, err := base64.StdEncoding.DecodeString(testEnvelope("key").Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := func(change func(raw []byte) []byte) string {
+		raw := append([]byte{}, valid...)
+		return base64.StdEncoding.EncodeToString(change(raw))
+	}
+
+	tests := []struct {
+		name    string
+		encoded string
+		want    error
+	}{
+		{"not base64", "not base64!", ErrNotEnvelope},
+		{"empty", "", ErrNotEnvelope},
+		{"wrong magic", modified(func(raw []byte) []byte { raw[0] = 'X'; return raw }), ErrNotEnvelope},
+		{"header only", modified(func(raw []byte) []byte { return raw[:len(EnvelopeMagic)+2] }), ErrNotEnvelope},
+		{"unknown version", modified(func(raw []byte) []byte { raw[4] = 9; return raw }), nil},
+		{"unknown algorithm", modified(func(raw []byte) []byte { raw[5] = 9; return raw }), nil},
+		{"key ID longer than the data", modified(func(raw []byte) []byte { raw[6] = 255; return raw }), nil},
+		{"no room for the tag", modified(func(raw []byte) []byte { return raw[:len(raw)-5-1] }), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseEnvelope(tt.encoded)
+			if err == nil {
+				t.Fatal("malformed envelope was accepted")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCryptoServiceWritesEnvelopes(t *testing.T) {
+	cs, err := NewKeyring(map[string]string{"2026-01": "0123456789abcdef0123456789abcdef"}, "2026-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := cs.Encrypt([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	envelope, err := ParseEnvelope(sealed)
+	if err != nil {
+		t.Fatalf("CryptoService output is not an envelope: %v", err)
+	}
+	if envelope.KeyID != "2026-01" {
+		t.Fatalf("envelope names key %q, want 2026-01", envelope.KeyID)
+	}
+	if err := ValidateClientPayload(sealed); err != nil {
+		t.Fatalf("ValidateClientPayload: %v", err)
+	}
+}
+
+func TestValidateClientPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    error
+	}{
+		{"envelope", testEnvelope("device").Encode(), nil},
+		{"JSON object", `{"name":"tax return.pdf"}`, ErrPlaintextJSON},
+		{"JSON array with whitespace", "  [1, 2]\n", ErrPlaintextJSON},
+		{"base64 JSON", base64.StdEncoding.EncodeToString([]byte(`{"name":"tax return.pdf"}`)), ErrPlaintextJSON},
+		{"base64 JSON string", base64.StdEncoding.EncodeToString([]byte(`"tax return.pdf"`)), ErrPlaintextJSON},
+		{"plain text", "tax return.pdf", ErrNotEnvelope},
+		{"random base64", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xff}, 40)), ErrNotEnvelope},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateClientPayload(tt.payload)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("valid payload rejected: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// The key log names users and devices only through commitments keyed with
+// a random salt each user is given when first publishing keys:
+//
+//	user   = hex(HMAC-SHA256(salt, "aiprivacyvault key log user v1\n" + USERNAME))
+//	device = hex(HMAC-SHA256(salt, "aiprivacyvault key log device v1\n" + DEVICE_ID))
+//
+// with salt in the hex form the directory serves it in. Looking a user up
+// returns their salt, so anyone who knows a username can find that user's
+// leaves, but the log on its own reveals no one, and deleting the account
+// deletes the salt and with it the only link back to the leaves.
+const keyLogSaltSize = 32
+
+// NewKeyLogSalt returns a fresh key log salt, hex encoded.
+func NewKeyLogSalt() (string, error) {
+	salt := make([]byte, keyLogSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(salt), nil
+}
+
+// KeyLogUserCommitment returns what the key log records for username.
+func KeyLogUserCommitment(salt, username string) string {
+	return keyLogCommitment(salt, "aiprivacyvault key log user v1\n"+username)
+}
+
+// KeyLogDeviceCommitment returns what the key log records for deviceID.
+func KeyLogDeviceCommitment(salt, deviceID string) string {
+	return keyLogCommitment(salt, "aiprivacyvault key log device v1\n"+deviceID)
+}
+
+func keyLogCommitment(salt, message string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// KeyLogTree returns the key log as it stands in db. Besides the leaves,
+// the log keeps the hash of every complete subtree in key_log_nodes, so
+// the tree is never rebuilt from all of its leaves.
+func KeyLogTree(db DBTX) (*MerkleTree, error) {
+	var size int64
+	if err := db.QueryRow("SELECT COALESCE(MAX(leaf_index) + 1, 0) FROM key_log").Scan(&size); err != nil {
+		return nil, err
+	}
+	return &MerkleTree{
+		Size: size,
+		Node: func(level int, index int64) ([]byte, error) {
+			var encoded string
+			var err error
+			if level == 0 {
+				err = db.QueryRow("SELECT leaf_hash FROM key_log WHERE leaf_index = ?", index).Scan(&encoded)
+			} else {
+				err = db.QueryRow("SELECT hash FROM key_log_nodes WHERE level = ? AND node_index = ?", level, index).Scan(&encoded)
+			}
+			if err != nil {
+				return nil, err
+			}
+			return hex.DecodeString(encoded)
+		},
+	}, nil
+}
+
+// StoreKeyLogNodes records the subtrees that the leaf with leafHash closes
+// when appended to tree. Call it in the transaction that inserts the leaf.
+func StoreKeyLogNodes(db DBTX, tree *MerkleTree, leafHash []byte) error {
+	closed, err := tree.Append(leafHash)
+	if err != nil {
+		return err
+	}
+	for _, node := range closed {
+		_, err := db.Exec(
+			"INSERT INTO key_log_nodes (level, node_index, hash) VALUES (?, ?, ?)",
+			node.Level, node.Index, hex.EncodeToString(node.Hash),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// KeyBindingMessage is what a device signs with its Ed25519 key when it
+// publishes its keys, as
+//
+//	aiprivacyvault key binding v1
+//	USERNAME
+//	DEVICE_ID
+//	ENCRYPTION_KEY
+//	SIGNING_KEY
+//
+// with both keys in base64. The signature proves the device holds the
+// signing key and ties the encryption key to it, so the server cannot pair
+// someone's signing key with an encryption key of its own.
+func KeyBindingMessage(username, deviceID, encryptionKey, signingKey string) []byte {
+	return []byte(strings.Join([]string{
+		"aiprivacyvault key binding v1",
+		username,
+		deviceID,
+		encryptionKey,
+		signingKey,
+	}, "\n"))
+}
+
+// ParseEncryptionPublicKey decodes a base64 X25519 public key sent by a
+// device. Low-order points, which would give every sender the same shared
+// secret, are rejected.
+func ParseEncryptionPublicKey(encoded string) (*ecdh.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("encryption key is not valid base64")
+	}
+	publicKey, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, errors.New("encryption key must be a 32-byte X25519 key")
+	}
+
+	probe, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := probe.ECDH(publicKey); err != nil {
+		return nil, errors.New("encryption key is a low-order point")
+	}
+	return publicKey, nil
+}
@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+)
+
+// KeyProvider supplies a master key. Providers are asked for their key when
+// a CryptoService is built: at server start, for every configured key, and
+// by the commands that need one.
+type KeyProvider interface {
+	// Name describes where the key comes from, for logs and errors.
+	Name() string
+	MasterKey() ([]byte, error)
+}
+
+// StaticKeyProvider returns a key given directly in the configuration.
+type StaticKeyProvider struct {
+	Key []byte
+}
+
+func (p StaticKeyProvider) Name() string {
+	return "configured key"
+}
+
+func (p StaticKeyProvider) MasterKey() ([]byte, error) {
+	return p.Key, ValidateKeyLength(p.Key)
+}
+
+// FileKeyProvider reads the key from a file, see LoadKeyFile.
+type FileKeyProvider struct {
+	Path string
+}
+
+func (p FileKeyProvider) Name() string {
+	return "key file " + p.Path
+}
+
+func (p FileKeyProvider) MasterKey() ([]byte, error) {
+	return LoadKeyFile(p.Path)
+}
+
+// PassphraseKeyProvider derives the key from a passphrase, see
+// DeriveKeyFromPassphrase.
+type PassphraseKeyProvider struct {
+	Passphrase string
+	ParamsPath string
+	Params     Argon2Params
+}
+
+func (p PassphraseKeyProvider) Name() string {
+	return "passphrase"
+}
+
+func (p PassphraseKeyProvider) MasterKey() ([]byte, error) {
+	return DeriveKeyFromPassphrase(p.Passphrase, p.ParamsPath)
+}
+
+// Init creates the parameters file MasterKey reads, see InitPassphraseKey.
+func (p PassphraseKeyProvider) Init() error {
+	return InitPassphraseKey(p.Passphrase, p.ParamsPath, p.Params)
+}
+
+// LoadKeyring fetches every provider's key and builds a CryptoService that
+// encrypts with the key named activeID.
+func LoadKeyring(providers map[string]KeyProvider, activeID string) (*CryptoService, error) {
+	ids := make([]string, 0, len(providers))
+	for id := range providers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	keys := make(map[string]string, len(providers))
+	for _, id := range ids {
+		key, err := providers[id].MasterKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q from %s: %v", id, providers[id].Name(), err)
+		}
+		keys[id] = string(key)
+	}
+	return NewKeyring(keys, activeID)
+}
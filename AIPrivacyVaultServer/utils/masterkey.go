@@ -0,0 +1,174 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// MasterKeySize is the length of keys produced by GenerateKey and
+// DeriveKeyFromPassphrase.
+const MasterKeySize = 32
+
+// ValidateKeyLength checks that key can be used with AES.
+func ValidateKeyLength(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	default:
+		return fmt.Errorf("key must be 16, 24 or 32 bytes long, got %d", len(key))
+	}
+}
+
+// GenerateKey returns a new random master key.
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, MasterKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// EncodeKey formats a key the way ParseKey reads it.
+func EncodeKey(key []byte) string {
+	return "base64:" + base64.StdEncoding.EncodeToString(key)
+}
+
+// ParseKey decodes a key given as "base64:<key>" or "hex:<key>". A value
+// without a prefix is used as raw bytes, as keys were before encodings
+// were supported.
+func ParseKey(value string) ([]byte, error) {
+	var key []byte
+	var err error
+	switch {
+	case strings.HasPrefix(value, "base64:"):
+		key, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(value, "base64:"))
+	case strings.HasPrefix(value, "hex:"):
+		key, err = hex.DecodeString(strings.TrimPrefix(value, "hex:"))
+	default:
+		key = []byte(value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, ValidateKeyLength(key)
+}
+
+// LoadKeyFile reads a key file holding either the raw key bytes or a key in
+// a format ParseKey accepts.
+func LoadKeyFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		log.Printf("Warning: Key file %s is accessible to other users (mode %v)", path, info.Mode().Perm())
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// An encoded key can be 16, 24 or 32 bytes long too, so the prefixes
+	// are looked for before the contents are taken as a raw key.
+	text := strings.TrimSpace(string(data))
+	if strings.HasPrefix(text, "base64:") || strings.HasPrefix(text, "hex:") {
+		return ParseKey(text)
+	}
+	if ValidateKeyLength(data) == nil {
+		return data, nil
+	}
+	return ParseKey(text)
+}
+
+// DeriveKeyFromPassphrase derives a master key from an operator passphrase
+// with Argon2id, using the salt and cost parameters InitPassphraseKey wrote
+// to paramsPath. They are stored with a check value so a mistyped
+// passphrase is rejected at startup instead of producing a key that
+// decrypts nothing. A missing parameters file is an error rather than a
+// cue to pick a new salt, which would silently give a different key.
+func DeriveKeyFromPassphrase(passphrase, paramsPath string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, errors.New("passphrase is empty")
+	}
+
+	encoded, err := os.ReadFile(paramsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s not found, run the init-passphrase command to create the master key", paramsPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stored, salt, check, err := decodeArgon2Hash(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", paramsPath, err)
+	}
+
+	key := argon2.IDKey([]byte(passphrase), salt, stored.Iterations, stored.Memory, stored.Parallelism, MasterKeySize)
+	if subtle.ConstantTimeCompare(keyCheckValue(key), check) != 1 {
+		return nil, errors.New("passphrase does not match the one the master key was created with")
+	}
+	return key, nil
+}
+
+// InitPassphraseKey picks a new salt for passphrase and writes it, with
+// params and the check value, to paramsPath. It refuses to replace an
+// existing file, since data sealed under the old key would be lost.
+func InitPassphraseKey(passphrase, paramsPath string, params Argon2Params) error {
+	if passphrase == "" {
+		return errors.New("passphrase is empty")
+	}
+	if params.SaltLength == 0 {
+		params.SaltLength = 16
+	}
+	if params.Parallelism == 0 {
+		params.Parallelism = 1
+	}
+
+	salt := make([]byte, params.SaltLength)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+
+	key := argon2.IDKey([]byte(passphrase), salt, params.Iterations, params.Memory, params.Parallelism, MasterKeySize)
+
+	encoded := fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s\n",
+		argon2.Version, params.Memory, params.Iterations, params.Parallelism,
+		phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(keyCheckValue(key)),
+	)
+
+	if err := os.MkdirAll(filepath.Dir(paramsPath), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(paramsPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%s already exists", paramsPath)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(encoded); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// keyCheckValue identifies a key without revealing it.
+func keyCheckValue(key []byte) []byte {
+	sum := sha256.Sum256(append([]byte("aiprivacyvault master key check\x00"), key...))
+	return sum[:8]
+}
@@ -0,0 +1,296 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+// Merkle trees are built as in RFC 6962 section 2.1: leaves are hashed as
+// SHA-256(0x00 || data) and interior nodes as SHA-256(0x01 || left || right),
+// so a leaf can never be passed off as a node. A tree of n leaves splits at
+// the largest power of two below n, and the empty tree hashes to SHA-256("").
+
+// MerkleLeafHash hashes one leaf.
+func MerkleLeafHash(data []byte) []byte {
+	sum := sha256.Sum256(append([]byte{0x00}, data...))
+	return sum[:]
+}
+
+// MerkleNodeHash hashes an interior node from its children's hashes.
+func MerkleNodeHash(left, right []byte) []byte {
+	buffer := make([]byte, 0, 1+len(left)+len(right))
+	buffer = append(buffer, 0x01)
+	buffer = append(buffer, left...)
+	buffer = append(buffer, right...)
+	sum := sha256.Sum256(buffer)
+	return sum[:]
+}
+
+// MerkleRoot returns the root of the tree over the given leaf hashes.
+func MerkleRoot(leafHashes [][]byte) []byte {
+	switch len(leafHashes) {
+	case 0:
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	case 1:
+		return leafHashes[0]
+	}
+	k := merkleSplit(len(leafHashes))
+	return MerkleNodeHash(MerkleRoot(leafHashes[:k]), MerkleRoot(leafHashes[k:]))
+}
+
+// merkleSplit returns the largest power of two smaller than n, for n > 1.
+func merkleSplit(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// MerkleTree computes roots and proofs from the hashes of a log's complete
+// subtrees rather than from every leaf, so a log can store those hashes as
+// leaves are appended and answer each request with O(log n) lookups.
+//
+// Node returns the hash of the complete subtree of 2^level leaves starting
+// at leaf index<<level; level 0 is the leaf hashes themselves. Every
+// subtree on the left of a split in an RFC 6962 tree is complete, which is
+// what makes this enough.
+type MerkleTree struct {
+	Size int64
+	Node func(level int, index int64) ([]byte, error)
+}
+
+// MerkleNode is the hash of one complete subtree, as returned by
+// MerkleTree.Node.
+type MerkleNode struct {
+	Level int
+	Index int64
+	Hash  []byte
+}
+
+// NewMerkleTree returns the tree over leafHashes held in memory.
+func NewMerkleTree(leafHashes [][]byte) *MerkleTree {
+	return &MerkleTree{
+		Size: int64(len(leafHashes)),
+		Node: func(level int, index int64) ([]byte, error) {
+			return MerkleRoot(leafHashes[index<<level : (index+1)<<level]), nil
+		},
+	}
+}
+
+// Root returns the root of the whole tree.
+func (t *MerkleTree) Root() ([]byte, error) {
+	return t.RootAt(t.Size)
+}
+
+// RootAt returns the root of the tree over the first size leaves.
+func (t *MerkleTree) RootAt(size int64) ([]byte, error) {
+	if size == 0 {
+		sum := sha256.Sum256(nil)
+		return sum[:], nil
+	}
+	return t.rangeHash(0, size)
+}
+
+// rangeHash returns the root of the subtree over leaves start to end-1,
+// which must be one the RFC 6962 recursion reaches.
+func (t *MerkleTree) rangeHash(start, end int64) ([]byte, error) {
+	n := end - start
+	if n&(n-1) == 0 && start%n == 0 {
+		level := 0
+		for int64(1)<<level < n {
+			level++
+		}
+		return t.Node(level, start>>level)
+	}
+	k := int64(merkleSplit(int(n)))
+	left, err := t.rangeHash(start, start+k)
+	if err != nil {
+		return nil, err
+	}
+	right, err := t.rangeHash(start+k, end)
+	if err != nil {
+		return nil, err
+	}
+	return MerkleNodeHash(left, right), nil
+}
+
+// InclusionProof returns the audit path for the leaf at index in the tree
+// over the first size leaves, as PATH in RFC 6962 section 2.1.1.
+func (t *MerkleTree) InclusionProof(index, size int64) ([][]byte, error) {
+	if index < 0 || index >= size || size > t.Size {
+		return nil, errors.New("leaf index out of range")
+	}
+	return t.path(index, 0, size)
+}
+
+func (t *MerkleTree) path(index, start, end int64) ([][]byte, error) {
+	n := end - start
+	if n <= 1 {
+		return nil, nil
+	}
+	k := int64(merkleSplit(int(n)))
+	if index < start+k {
+		proof, err := t.path(index, start, start+k)
+		if err != nil {
+			return nil, err
+		}
+		sibling, err := t.rangeHash(start+k, end)
+		if err != nil {
+			return nil, err
+		}
+		return append(proof, sibling), nil
+	}
+	proof, err := t.path(index, start+k, end)
+	if err != nil {
+		return nil, err
+	}
+	sibling, err := t.rangeHash(start, start+k)
+	if err != nil {
+		return nil, err
+	}
+	return append(proof, sibling), nil
+}
+
+// ConsistencyProof returns the proof that the tree over the first first
+// leaves is a prefix of the tree over the first second leaves, as PROOF in
+// RFC 6962 section 2.1.2.
+func (t *MerkleTree) ConsistencyProof(first, second int64) ([][]byte, error) {
+	if first < 0 || first > second || second > t.Size {
+		return nil, errors.New("tree sizes out of range")
+	}
+	if first == 0 || first == second {
+		return nil, nil
+	}
+	return t.subproof(first, 0, second, true)
+}
+
+func (t *MerkleTree) subproof(size, start, end int64, complete bool) ([][]byte, error) {
+	n := end - start
+	if size == n {
+		if complete {
+			return nil, nil
+		}
+		root, err := t.rangeHash(start, end)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{root}, nil
+	}
+	k := int64(merkleSplit(int(n)))
+	if size <= k {
+		proof, err := t.subproof(size, start, start+k, complete)
+		if err != nil {
+			return nil, err
+		}
+		sibling, err := t.rangeHash(start+k, end)
+		if err != nil {
+			return nil, err
+		}
+		return append(proof, sibling), nil
+	}
+	proof, err := t.subproof(size-k, start+k, end, false)
+	if err != nil {
+		return nil, err
+	}
+	sibling, err := t.rangeHash(start, start+k)
+	if err != nil {
+		return nil, err
+	}
+	return append(proof, sibling), nil
+}
+
+// Append returns the complete subtrees, above the leaf itself, that adding
+// the leaf with leafHash at index Size closes. A log that stores them along
+// with the leaf keeps Node answerable without ever rehashing old leaves.
+func (t *MerkleTree) Append(leafHash []byte) ([]MerkleNode, error) {
+	var closed []MerkleNode
+	hash, level, index := leafHash, 0, t.Size
+	for index&1 == 1 {
+		left, err := t.Node(level, index-1)
+		if err != nil {
+			return nil, err
+		}
+		hash = MerkleNodeHash(left, hash)
+		level++
+		index >>= 1
+		closed = append(closed, MerkleNode{Level: level, Index: index, Hash: hash})
+	}
+	return closed, nil
+}
+
+// VerifyMerkleInclusion reports whether proof shows the leaf with leafHash
+// at index in the tree of size leaves with the given root, following RFC
+// 9162 section 2.1.3.2.
+func VerifyMerkleInclusion(leafHash []byte, index, size int64, proof [][]byte, root []byte) bool {
+	if index < 0 || index >= size {
+		return false
+	}
+	fn, sn := index, size-1
+	hash := leafHash
+	for _, sibling := range proof {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			hash = MerkleNodeHash(sibling, hash)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			hash = MerkleNodeHash(hash, sibling)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(hash, root)
+}
+
+// VerifyMerkleConsistency reports whether proof shows the tree of size1
+// leaves with root1 to be a prefix of the tree of size2 leaves with root2,
+// following RFC 9162 section 2.1.4.2.
+func VerifyMerkleConsistency(size1, size2 int64, root1, root2 []byte, proof [][]byte) bool {
+	switch {
+	case size1 < 0 || size1 > size2:
+		return false
+	case size1 == size2:
+		return len(proof) == 0 && bytes.Equal(root1, root2)
+	case size1 == 0:
+		// Every tree extends the empty one.
+		return len(proof) == 0
+	case len(proof) == 0:
+		return false
+	}
+
+	if size1&(size1-1) == 0 {
+		proof = append([][]byte{root1}, proof...)
+	}
+	fn, sn := size1-1, size2-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+
+	firstHash, secondHash := proof[0], proof[0]
+	for _, node := range proof[1:] {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			firstHash = MerkleNodeHash(node, firstHash)
+			secondHash = MerkleNodeHash(node, secondHash)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			secondHash = MerkleNodeHash(secondHash, node)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(firstHash, root1) && bytes.Equal(secondHash, root2)
+}
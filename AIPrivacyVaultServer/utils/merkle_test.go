@@ -0,0 +1,261 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+// The test vectors of RFC 6962 and RFC 9162, as used by the reference
+// Certificate Transparency implementations: eight leaves, the roots of every
+// prefix of the tree over them, and a set of audit paths and consistency
+// proofs.
+var merkleTestLeaves = []string{
+	"",
+	"00",
+	"10",
+	"2021",
+	"3031",
+	"40414243",
+	"5051525354555657",
+	"606162636465666768696a6b6c6d6e6f",
+}
+
+var merkleTestRoots = []string{
+	"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+	"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+	"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+	"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+	"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+	"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+}
+
+var merkleTestInclusionProofs = []struct {
+	index, size int64
+	proof       []string
+}{
+	{0, 1, nil},
+	{0, 8, []string{
+		"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+	}},
+	{5, 8, []string{
+		"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+		"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+		"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	}},
+	{2, 3, []string{
+		"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	}},
+	{1, 5, []string{
+		"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+	}},
+}
+
+var merkleTestConsistencyProofs = []struct {
+	first, second int64
+	proof         []string
+}{
+	{1, 1, nil},
+	{1, 8, []string{
+		"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+	}},
+	{6, 8, []string{
+		"0ebc5d3437fbe2db158b9f126a1d118e308181031d0a949f8dededebc558ef6a",
+		"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+		"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	}},
+	{2, 5, []string{
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+	}},
+}
+
+func merkleTestLeafHashes(t *testing.T) [][]byte {
+	t.Helper()
+	hashes := make([][]byte, len(merkleTestLeaves))
+	for i, leaf := range merkleTestLeaves {
+		data, err := hex.DecodeString(leaf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes[i] = MerkleLeafHash(data)
+	}
+	return hashes
+}
+
+func decodeTestHashes(t *testing.T, encoded []string) [][]byte {
+	t.Helper()
+	hashes := make([][]byte, len(encoded))
+	for i, value := range encoded {
+		hash, err := hex.DecodeString(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes[i] = hash
+	}
+	return hashes
+}
+
+func equalHashes(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMerkleRootVectors(t *testing.T) {
+	hashes := merkleTestLeafHashes(t)
+	tree := NewMerkleTree(hashes)
+
+	for size, want := range merkleTestRoots {
+		if got := hex.EncodeToString(MerkleRoot(hashes[:size])); got != want {
+			t.Fatalf("MerkleRoot of %d leaves = %s, want %s", size, got, want)
+		}
+		root, err := tree.RootAt(int64(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(root); got != want {
+			t.Fatalf("RootAt(%d) = %s, want %s", size, got, want)
+		}
+	}
+}
+
+func TestMerkleInclusionVectors(t *testing.T) {
+	hashes := merkleTestLeafHashes(t)
+	tree := NewMerkleTree(hashes)
+
+	for _, tt := range merkleTestInclusionProofs {
+		want := decodeTestHashes(t, tt.proof)
+		proof, err := tree.InclusionProof(tt.index, tt.size)
+		if err != nil {
+			t.Fatalf("leaf %d of %d: %v", tt.index, tt.size, err)
+		}
+		if !equalHashes(proof, want) {
+			t.Fatalf("leaf %d of %d: got path %x, want %x", tt.index, tt.size, proof, want)
+		}
+
+		root := MerkleRoot(hashes[:tt.size])
+		if !VerifyMerkleInclusion(hashes[tt.index], tt.index, tt.size, want, root) {
+			t.Fatalf("leaf %d of %d: valid path rejected", tt.index, tt.size)
+		}
+		if VerifyMerkleInclusion(hashes[(tt.index+1)%tt.size], tt.index, tt.size, want, root) && tt.size > 1 {
+			t.Fatalf("leaf %d of %d: path accepted for another leaf", tt.index, tt.size)
+		}
+		if len(want) > 0 && VerifyMerkleInclusion(hashes[tt.index], tt.index, tt.size, want[:len(want)-1], root) {
+			t.Fatalf("leaf %d of %d: truncated path accepted", tt.index, tt.size)
+		}
+	}
+}
+
+func TestMerkleConsistencyVectors(t *testing.T) {
+	hashes := merkleTestLeafHashes(t)
+	tree := NewMerkleTree(hashes)
+
+	for _, tt := range merkleTestConsistencyProofs {
+		want := decodeTestHashes(t, tt.proof)
+		proof, err := tree.ConsistencyProof(tt.first, tt.second)
+		if err != nil {
+			t.Fatalf("%d to %d: %v", tt.first, tt.second, err)
+		}
+		if !equalHashes(proof, want) {
+			t.Fatalf("%d to %d: got proof %x, want %x", tt.first, tt.second, proof, want)
+		}
+
+		root1, root2 := MerkleRoot(hashes[:tt.first]), MerkleRoot(hashes[:tt.second])
+		if !VerifyMerkleConsistency(tt.first, tt.second, root1, root2, want) {
+			t.Fatalf("%d to %d: valid proof rejected", tt.first, tt.second)
+		}
+		if tt.first != tt.second && VerifyMerkleConsistency(tt.first, tt.second, root2, root1, want) {
+			t.Fatalf("%d to %d: proof accepted with the roots swapped", tt.first, tt.second)
+		}
+	}
+}
+
+// storedMerkleTree is a tree whose subtree hashes are kept in a map as
+// Append reports them, the way the key log keeps them in the database.
+func storedMerkleTree(t *testing.T, leafHashes [][]byte) *MerkleTree {
+	t.Helper()
+	nodes := make(map[string][]byte)
+	key := func(level int, index int64) string { return fmt.Sprintf("%d/%d", level, index) }
+
+	tree := &MerkleTree{Node: func(level int, index int64) ([]byte, error) {
+		hash, ok := nodes[key(level, index)]
+		if !ok {
+			return nil, fmt.Errorf("node %d/%d is not stored", level, index)
+		}
+		return hash, nil
+	}}
+	for _, leafHash := range leafHashes {
+		closed, err := tree.Append(leafHash)
+		if err != nil {
+			t.Fatalf("appending leaf %d: %v", tree.Size, err)
+		}
+		nodes[key(0, tree.Size)] = leafHash
+		for _, node := range closed {
+			nodes[key(node.Level, node.Index)] = node.Hash
+		}
+		tree.Size++
+	}
+	return tree
+}
+
+func TestMerkleTreeFromStoredNodes(t *testing.T) {
+	leafHashes := make([][]byte, 70)
+	for i := range leafHashes {
+		leafHashes[i] = MerkleLeafHash([]byte{byte(i)})
+	}
+	tree := storedMerkleTree(t, leafHashes)
+
+	for size := int64(0); size <= tree.Size; size++ {
+		prefix := leafHashes[:size]
+		root, err := tree.RootAt(size)
+		if err != nil {
+			t.Fatalf("RootAt(%d): %v", size, err)
+		}
+		if !bytes.Equal(root, MerkleRoot(prefix)) {
+			t.Fatalf("RootAt(%d) differs from the root over every leaf", size)
+		}
+
+		for index := int64(0); index < size; index++ {
+			proof, err := tree.InclusionProof(index, size)
+			if err != nil {
+				t.Fatalf("InclusionProof(%d, %d): %v", index, size, err)
+			}
+			if !VerifyMerkleInclusion(prefix[index], index, size, proof, root) {
+				t.Fatalf("InclusionProof(%d, %d) does not verify", index, size)
+			}
+		}
+		for first := int64(0); first <= size; first++ {
+			proof, err := tree.ConsistencyProof(first, size)
+			if err != nil {
+				t.Fatalf("ConsistencyProof(%d, %d): %v", first, size, err)
+			}
+			if !VerifyMerkleConsistency(first, size, MerkleRoot(leafHashes[:first]), root, proof) {
+				t.Fatalf("ConsistencyProof(%d, %d) does not verify", first, size)
+			}
+		}
+	}
+
+	if _, err := tree.InclusionProof(tree.Size, tree.Size+1); err == nil {
+		t.Fatal("proof for a leaf beyond the tree was returned")
+	}
+	if _, err := tree.ConsistencyProof(2, 1); err == nil {
+		t.Fatal("consistency proof from a larger tree was returned")
+	}
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNonceCacheFull is returned instead of forgetting a nonce that is still
+// within its TTL, which would let a captured request be replayed.
+var ErrNonceCacheFull = errors.New("nonce cache is full")
+
+// NonceCache remembers recently seen request nonces so a signed request
+// cannot be replayed. Nonces are kept per partition, e.g. per user. It holds
+// at most capacity entries in total and perPartition for any one partition,
+// so a single client cannot use up room meant for others. When either limit
+// is reached, new nonces are refused until old ones expire.
+type NonceCache struct {
+	mu           sync.Mutex
+	capacity     int
+	perPartition int
+	ttl          time.Duration
+	order        *list.List
+	entries      map[string]*list.Element
+	counts       map[string]int
+}
+
+type nonceEntry struct {
+	partition string
+	key       string
+	expiry    time.Time
+}
+
+func NewNonceCache(capacity, perPartition int, ttl time.Duration) *NonceCache {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	if perPartition <= 0 || perPartition > capacity {
+		perPartition = capacity
+	}
+	return &NonceCache{
+		capacity:     capacity,
+		perPartition: perPartition,
+		ttl:          ttl,
+		order:        list.New(),
+		entries:      make(map[string]*list.Element),
+		counts:       make(map[string]int),
+	}
+}
+
+// Seen records nonce in partition and reports whether it was already
+// present. It returns ErrNonceCacheFull, without recording the nonce, when
+// there is no room left for it.
+func (nc *NonceCache) Seen(partition, nonce string) (bool, error) {
+	now := time.Now()
+	key := partition + "\x00" + nonce
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	// Entries are appended in time order, so expired ones sit at the front.
+	for front := nc.order.Front(); front != nil; front = nc.order.Front() {
+		entry := front.Value.(*nonceEntry)
+		if now.Before(entry.expiry) {
+			break
+		}
+		nc.remove(front)
+	}
+
+	if _, ok := nc.entries[key]; ok {
+		return true, nil
+	}
+
+	if nc.order.Len() >= nc.capacity || nc.counts[partition] >= nc.perPartition {
+		return false, ErrNonceCacheFull
+	}
+
+	nc.entries[key] = nc.order.PushBack(&nonceEntry{partition: partition, key: key, expiry: now.Add(nc.ttl)})
+	nc.counts[partition]++
+	return false, nil
+}
+
+func (nc *NonceCache) remove(element *list.Element) {
+	entry := element.Value.(*nonceEntry)
+	nc.order.Remove(element)
+	delete(nc.entries, entry.key)
+	if nc.counts[entry.partition] <= 1 {
+		delete(nc.counts, entry.partition)
+	} else {
+		nc.counts[entry.partition]--
+	}
+}
+
+func (nc *NonceCache) Len() int {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	return nc.order.Len()
+}
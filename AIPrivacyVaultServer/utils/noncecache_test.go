@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNonceCacheDetectsReplay(t *testing.T) {
+	nc := NewNonceCache(10, 10, time.Minute)
+
+	if seen, err := nc.Seen("alice", "nonce-1"); seen || err != nil {
+		t.Fatalf("first use: seen %v, err %v", seen, err)
+	}
+	if seen, err := nc.Seen("alice", "nonce-1"); !seen || err != nil {
+		t.Fatalf("replay: seen %v, err %v", seen, err)
+	}
+	if seen, err := nc.Seen("bob", "nonce-1"); seen || err != nil {
+		t.Fatalf("same nonce in another partition: seen %v, err %v", seen, err)
+	}
+}
+
+func TestNonceCachePartitionCannotExhaustOthers(t *testing.T) {
+	nc := NewNonceCache(20, 5, time.Minute)
+
+	for i := 0; i < 5; i++ {
+		if _, err := nc.Seen("alice", fmt.Sprintf("nonce-%d", i)); err != nil {
+			t.Fatalf("nonce %d: %v", i, err)
+		}
+	}
+	if _, err := nc.Seen("alice", "one-too-many"); err != ErrNonceCacheFull {
+		t.Fatalf("partition over its share: got %v, want ErrNonceCacheFull", err)
+	}
+	// A refused nonce is not remembered, so it is not reported as a replay.
+	if seen, _ := nc.Seen("alice", "one-too-many"); seen {
+		t.Fatal("a refused nonce was recorded")
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := nc.Seen("bob", fmt.Sprintf("nonce-%d", i)); err != nil {
+			t.Fatalf("bob's nonce %d refused after alice filled her share: %v", i, err)
+		}
+	}
+	if nc.Len() != 10 {
+		t.Fatalf("cache holds %d nonces, want 10", nc.Len())
+	}
+}
+
+func TestNonceCacheForgetsExpiredNonces(t *testing.T) {
+	nc := NewNonceCache(2, 2, 20*time.Millisecond)
+
+	for _, nonce := range []string{"a", "b"} {
+		if _, err := nc.Seen("alice", nonce); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := nc.Seen("bob", "c"); err != ErrNonceCacheFull {
+		t.Fatalf("full cache: got %v, want ErrNonceCacheFull", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if seen, err := nc.Seen("bob", "c"); seen || err != nil {
+		t.Fatalf("after expiry: seen %v, err %v", seen, err)
+	}
+	if nc.Len() != 1 {
+		t.Fatalf("cache holds %d nonces after expiry, want 1", nc.Len())
+	}
+}
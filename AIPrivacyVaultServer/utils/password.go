@@ -0,0 +1,221 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BcryptMaxPasswordBytes is the longest input bcrypt will hash; anything past
+// it is silently ignored, so the policy never allows longer passwords.
+const BcryptMaxPasswordBytes = 72
+
+// UnusablePasswordHash marks accounts that cannot log in with a password,
+// such as users provisioned through OpenID Connect.
+const UnusablePasswordHash = "!"
+
+//go:embed common_passwords.txt
+var commonPasswordList string
+
+type PasswordPolicy struct {
+	MinLength     int
+	MaxLength     int
+	RejectCommon  bool
+	commonEntries map[string]struct{}
+	breached      *BreachedPasswordList
+}
+
+// NewPasswordPolicy builds the policy; breached may be nil to skip the
+// breached-password lookup.
+func NewPasswordPolicy(minLength, maxLength int, rejectCommon bool, breached *BreachedPasswordList) *PasswordPolicy {
+	if maxLength <= 0 || maxLength > BcryptMaxPasswordBytes {
+		maxLength = BcryptMaxPasswordBytes
+	}
+	if minLength > maxLength {
+		minLength = maxLength
+	}
+
+	policy := &PasswordPolicy{
+		MinLength:     minLength,
+		MaxLength:     maxLength,
+		RejectCommon:  rejectCommon,
+		commonEntries: make(map[string]struct{}),
+		breached:      breached,
+	}
+
+	for _, line := range strings.Split(commonPasswordList, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		policy.commonEntries[strings.ToLower(line)] = struct{}{}
+	}
+
+	return policy
+}
+
+// Validate returns an error suitable for showing to the user when the
+// password does not satisfy the policy.
+func (p *PasswordPolicy) Validate(password, username string) error {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return fmt.Errorf("password must be at least %d characters", p.MinLength)
+	}
+	if len(password) > p.MaxLength {
+		return fmt.Errorf("password must be at most %d bytes", p.MaxLength)
+	}
+
+	if p.RejectCommon {
+		lowered := strings.ToLower(password)
+		if _, found := p.commonEntries[lowered]; found {
+			return fmt.Errorf("password is too common")
+		}
+		if username != "" && strings.EqualFold(password, username) {
+			return fmt.Errorf("password must not match the username")
+		}
+	}
+
+	if p.breached != nil {
+		found, err := p.breached.Contains(password)
+		if err != nil {
+			log.Printf("Warning: Breached password lookup failed: %v", err)
+		} else if found {
+			return fmt.Errorf("password appears in a known data breach")
+		}
+	}
+
+	return nil
+}
+
+// Argon2Params are the tunable Argon2id parameters; Memory is in KiB.
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// PasswordHasher produces Argon2id hashes in PHC string format and still
+// verifies the bcrypt hashes written by older versions of the server.
+type PasswordHasher struct {
+	params Argon2Params
+}
+
+func NewPasswordHasher(params Argon2Params) *PasswordHasher {
+	if params.SaltLength == 0 {
+		params.SaltLength = 16
+	}
+	if params.KeyLength == 0 {
+		params.KeyLength = 32
+	}
+	if params.Parallelism == 0 {
+		params.Parallelism = 1
+	}
+	return &PasswordHasher{params: params}
+}
+
+// Hash returns e.g. $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>.
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.params.Iterations, h.params.Memory, h.params.Parallelism, h.params.KeyLength)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.params.Memory, h.params.Iterations, h.params.Parallelism,
+		phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key),
+	), nil
+}
+
+// Verify checks password against an encoded hash. needsRehash is set when the
+// hash matched but was produced by bcrypt or with outdated Argon2 parameters.
+func (h *PasswordHasher) Verify(password, encoded string) (match bool, needsRehash bool, err error) {
+	if encoded == UnusablePasswordHash {
+		return false, false, nil
+	}
+
+	if isBcryptHash(encoded) {
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, false, nil
+		} else if err != nil {
+			return false, false, err
+		}
+		return true, true, nil
+	}
+
+	params, salt, key, err := decodeArgon2Hash(encoded)
+	if err != nil {
+		return false, false, err
+	}
+
+	candidate := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	if subtle.ConstantTimeCompare(candidate, key) != 1 {
+		return false, false, nil
+	}
+
+	needsRehash = params.Memory != h.params.Memory ||
+		params.Iterations != h.params.Iterations ||
+		params.Parallelism != h.params.Parallelism ||
+		uint32(len(salt)) != h.params.SaltLength ||
+		uint32(len(key)) != h.params.KeyLength
+
+	return true, needsRehash, nil
+}
+
+var phcEncoding = base64.RawStdEncoding
+
+var errInvalidPasswordHash = errors.New("invalid password hash format")
+
+func isBcryptHash(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func decodeArgon2Hash(encoded string) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+	if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+	if params.Memory < 1 || params.Iterations < 1 || params.Parallelism < 1 {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+
+	salt, err := phcEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+	key, err := phcEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// Headers carrying a device's request signature.
+const (
+	HeaderRequestTimestamp = "X-Vault-Timestamp"
+	HeaderRequestNonce     = "X-Vault-Nonce"
+	HeaderRequestSignature = "X-Vault-Signature"
+)
+
+// RequestSigningString is what a device signs for every request:
+//
+//	METHOD\nREQUEST_URI\nHEX(SHA-256(body))\nTIMESTAMP\nNONCE
+//
+// REQUEST_URI is the path including any query string, and TIMESTAMP is in
+// Unix seconds.
+func RequestSigningString(method, requestURI string, body []byte, timestamp, nonce string) []byte {
+	bodyHash := sha256.Sum256(body)
+	return []byte(strings.Join([]string{
+		strings.ToUpper(method),
+		requestURI,
+		hex.EncodeToString(bodyHash[:]),
+		timestamp,
+		nonce,
+	}, "\n"))
+}
+
+// ParseDevicePublicKey decodes a base64 Ed25519 public key sent by a device.
+func ParseDevicePublicKey(encoded string) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("device public key is not valid base64")
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("device public key must be a 32-byte Ed25519 key")
+	}
+	return ed25519.PublicKey(raw), nil
+}
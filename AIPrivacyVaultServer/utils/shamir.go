@@ -0,0 +1,205 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Shares are printed as "AVS1-" followed by the base32 encoding of
+//
+//	set ID (4) | threshold (1) | index (1) | share bytes | checksum (4)
+//
+// in dash-separated groups of five characters. The set ID is random per
+// split, so shares from different splits are never combined, and the
+// checksum catches a share that was mistyped while being copied back in.
+const (
+	sharePrefix       = "AVS1-"
+	shareSetIDSize    = 4
+	shareChecksumSize = 4
+	shareGroupSize    = 5
+)
+
+var shareEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Share is one part of a secret split by SplitSecret.
+type Share struct {
+	SetID     [shareSetIDSize]byte
+	Threshold int
+	Index     int
+	Data      []byte
+}
+
+// SplitSecret splits secret into n shares, any threshold of which recover
+// it with CombineShares. Fewer than threshold shares reveal nothing about
+// the secret.
+func SplitSecret(secret []byte, n, threshold int) ([]Share, error) {
+	if threshold < 2 {
+		return nil, errors.New("threshold must be at least 2")
+	}
+	if n < threshold {
+		return nil, errors.New("number of shares must be at least the threshold")
+	}
+	if n > 255 {
+		return nil, errors.New("at most 255 shares are supported")
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("secret is empty")
+	}
+
+	var setID [shareSetIDSize]byte
+	if _, err := io.ReadFull(rand.Reader, setID[:]); err != nil {
+		return nil, err
+	}
+
+	shares := make([]Share, n)
+	for i := range shares {
+		shares[i] = Share{SetID: setID, Threshold: threshold, Index: i + 1, Data: make([]byte, len(secret))}
+	}
+
+	// Each byte of the secret is the constant term of its own random
+	// polynomial of degree threshold-1 over GF(256); share i holds every
+	// polynomial evaluated at x = i.
+	coefficients := make([]byte, threshold)
+	for b, s := range secret {
+		if _, err := io.ReadFull(rand.Reader, coefficients[1:]); err != nil {
+			return nil, err
+		}
+		coefficients[0] = s
+		for i := range shares {
+			shares[i].Data[b] = evaluatePolynomial(coefficients, byte(shares[i].Index))
+		}
+	}
+	return shares, nil
+}
+
+// CombineShares recovers a secret from at least threshold shares of the
+// same split.
+func CombineShares(shares []Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares given")
+	}
+
+	first := shares[0]
+	seen := make(map[int]bool, len(shares))
+	for _, share := range shares {
+		if share.SetID != first.SetID || share.Threshold != first.Threshold || len(share.Data) != len(first.Data) {
+			return nil, errors.New("shares come from different splits")
+		}
+		if share.Index < 1 || share.Index > 255 {
+			return nil, fmt.Errorf("invalid share index %d", share.Index)
+		}
+		if seen[share.Index] {
+			return nil, fmt.Errorf("share %d was given more than once", share.Index)
+		}
+		seen[share.Index] = true
+	}
+	if len(shares) < first.Threshold {
+		return nil, fmt.Errorf("%d shares are needed, got %d", first.Threshold, len(shares))
+	}
+
+	// Lagrange interpolation at x = 0 over the first threshold shares.
+	shares = shares[:first.Threshold]
+	secret := make([]byte, len(first.Data))
+	for i, share := range shares {
+		basis := byte(1)
+		xi := byte(share.Index)
+		for j, other := range shares {
+			if i == j {
+				continue
+			}
+			xj := byte(other.Index)
+			basis = gfMul(basis, gfDiv(xj, xj^xi))
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(share.Data[b], basis)
+		}
+	}
+	return secret, nil
+}
+
+// String formats the share for printing.
+func (s Share) String() string {
+	payload := s.payload()
+	sum := sha256.Sum256(payload)
+	encoded := shareEncoding.EncodeToString(append(payload, sum[:shareChecksumSize]...))
+
+	groups := make([]string, 0, len(encoded)/shareGroupSize+1)
+	for len(encoded) > shareGroupSize {
+		groups = append(groups, encoded[:shareGroupSize])
+		encoded = encoded[shareGroupSize:]
+	}
+	groups = append(groups, encoded)
+	return sharePrefix + strings.Join(groups, "-")
+}
+
+func (s Share) payload() []byte {
+	payload := make([]byte, 0, shareSetIDSize+2+len(s.Data))
+	payload = append(payload, s.SetID[:]...)
+	payload = append(payload, byte(s.Threshold), byte(s.Index))
+	return append(payload, s.Data...)
+}
+
+// ParseShare reads a share printed by Share.String. Case, spaces and dashes
+// between groups are ignored.
+func ParseShare(value string) (Share, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if !strings.HasPrefix(value, sharePrefix) {
+		return Share{}, errors.New("not a key share")
+	}
+	value = strings.NewReplacer("-", "", " ", "").Replace(strings.TrimPrefix(value, sharePrefix))
+
+	decoded, err := shareEncoding.DecodeString(value)
+	if err != nil || len(decoded) < shareSetIDSize+2+1+shareChecksumSize {
+		return Share{}, errors.New("share is malformed or incomplete")
+	}
+
+	payload := decoded[:len(decoded)-shareChecksumSize]
+	sum := sha256.Sum256(payload)
+	if subtle.ConstantTimeCompare(sum[:shareChecksumSize], decoded[len(payload):]) != 1 {
+		return Share{}, errors.New("share checksum does not match, check it for typos")
+	}
+
+	var share Share
+	copy(share.SetID[:], payload)
+	share.Threshold = int(payload[shareSetIDSize])
+	share.Index = int(payload[shareSetIDSize+1])
+	share.Data = payload[shareSetIDSize+2:]
+	return share, nil
+}
+
+func evaluatePolynomial(coefficients []byte, x byte) byte {
+	// Horner's method, highest degree first.
+	result := byte(0)
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		result = gfMul(result, x) ^ coefficients[i]
+	}
+	return result
+}
+
+// GF(256) arithmetic with the AES polynomial x^8 + x^4 + x^3 + x + 1. Every
+// operation is a fixed loop with no data-dependent branches or table
+// lookups, since the operands are key material.
+func gfMul(a, b byte) byte {
+	var product byte
+	for i := 0; i < 8; i++ {
+		product ^= -(b & 1) & a
+		a = (a << 1) ^ (-(a >> 7) & 0x1b)
+		b >>= 1
+	}
+	return product
+}
+
+// gfDiv returns a / b for b != 0, using b^254 as the inverse of b.
+func gfDiv(a, b byte) byte {
+	inverse := byte(1)
+	for i := 0; i < 254; i++ {
+		inverse = gfMul(inverse, b)
+	}
+	return gfMul(a, inverse)
+}
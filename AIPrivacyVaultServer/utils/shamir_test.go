@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestGFArithmetic(t *testing.T) {
+	// The worked example from FIPS-197 section 4.2.
+	if got := gfMul(0x57, 0x83); got != 0xc1 {
+		t.Fatalf("gfMul(0x57, 0x83) = %#x, want 0xc1", got)
+	}
+	for a := 1; a < 256; a++ {
+		if got := gfMul(gfDiv(1, byte(a)), byte(a)); got != 1 {
+			t.Fatalf("inverse of %#x is wrong: a * 1/a = %#x", a, got)
+		}
+	}
+}
+
+func TestShamirRoundTrip(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+
+	shares, err := SplitSecret(secret, 5, 3)
+	if err != nil {
+		t.Fatalf("SplitSecret: %v", err)
+	}
+	if len(shares) != 5 {
+		t.Fatalf("expected 5 shares, got %d", len(shares))
+	}
+
+	// Every subset of three shares, in any order, recovers the secret.
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 5; j++ {
+			for k := 0; k < 5; k++ {
+				if i == j || j == k || i == k {
+					continue
+				}
+				got, err := CombineShares([]Share{shares[i], shares[j], shares[k]})
+				if err != nil {
+					t.Fatalf("shares %d,%d,%d: %v", i+1, j+1, k+1, err)
+				}
+				if !bytes.Equal(got, secret) {
+					t.Fatalf("shares %d,%d,%d recovered the wrong secret", i+1, j+1, k+1)
+				}
+			}
+		}
+	}
+
+	got, err := CombineShares(shares)
+	if err != nil || !bytes.Equal(got, secret) {
+		t.Fatalf("all shares: got %x, %v", got, err)
+	}
+}
+
+func TestShamirRejectsBadShareSets(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	shares, err := SplitSecret(secret, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := SplitSecret(secret, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		shares []Share
+	}{
+		{"too few", shares[:1]},
+		{"none", nil},
+		{"duplicate", []Share{shares[0], shares[0]}},
+		{"different splits", []Share{shares[0], other[1]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := CombineShares(tt.shares); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+
+	for _, args := range [][2]int{{3, 1}, {2, 3}, {256, 2}} {
+		if _, err := SplitSecret(secret, args[0], args[1]); err == nil {
+			t.Fatalf("SplitSecret(n=%d, threshold=%d) should fail", args[0], args[1])
+		}
+	}
+}
+
+func TestShareEncoding(t *testing.T) {
+	shares, err := SplitSecret([]byte("0123456789abcdef0123456789abcdef"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, share := range shares {
+		printed := share.String()
+		if !strings.HasPrefix(printed, sharePrefix) {
+			t.Fatalf("share %q lacks the %s prefix", printed, sharePrefix)
+		}
+
+		// Shares are typed back in by hand, so case and spacing vary.
+		spaced := sharePrefix + strings.ReplaceAll(strings.TrimPrefix(printed, sharePrefix), "-", " ")
+		for _, typed := range []string{printed, strings.ToLower(printed), "  " + spaced + "\n"} {
+			parsed, err := ParseShare(typed)
+			if err != nil {
+				t.Fatalf("ParseShare(%q): %v", typed, err)
+			}
+			if parsed.SetID != share.SetID || parsed.Threshold != share.Threshold || parsed.Index != share.Index || !bytes.Equal(parsed.Data, share.Data) {
+				t.Fatalf("ParseShare(%q) = %+v, want %+v", typed, parsed, share)
+			}
+		}
+	}
+}
+
+func TestShareChecksumCatchesTypos(t *testing.T) {
+	shares, err := SplitSecret([]byte("0123456789abcdef"), 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	printed := shares[0].String()
+
+	// Change each character of the body in turn.
+	for i := len(sharePrefix); i < len(printed); i++ {
+		if printed[i] == '-' {
+			continue
+		}
+		replacement := byte('A')
+		if printed[i] == 'A' {
+			replacement = 'B'
+		}
+		typo := printed[:i] + string(replacement) + printed[i+1:]
+		if _, err := ParseShare(typo); err == nil {
+			t.Fatalf("typo at position %d was not detected: %s", i, typo)
+		}
+	}
+
+	// Dropping a group must not go unnoticed either.
+	if _, err := ParseShare(printed[:len(printed)-6]); err == nil {
+		t.Fatal("truncated share was accepted")
+	}
+	if _, err := ParseShare("AVS2-" + strings.TrimPrefix(printed, sharePrefix)); err == nil {
+		t.Fatal("share with the wrong prefix was accepted")
+	}
+}
@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Types of signed statement. One key signs all of them, so the signed bytes
+// are the type, a newline and then the statement's JSON; a verifier that
+// checks the type cannot be handed one kind of statement as another.
+const (
+	StatementDeletionReceipt = "aipv-deletion-receipt-v1"
+	StatementTreeHead        = "aipv-tree-head-v1"
+	StatementVaultState      = "aipv-vault-state-v1"
+)
+
+// SigningService holds the server's long-term Ed25519 identity key, used to
+// sign statements clients may want to verify later, such as deletion receipts.
+type SigningService struct {
+	privateKey ed25519.PrivateKey
+	keyID      string
+}
+
+// LoadOrCreateSigningKey reads a PKCS#8 PEM key from path, generating and
+// persisting a new one on first start.
+func LoadOrCreateSigningKey(path string) (*SigningService, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return createSigningKey(path)
+	} else if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s does not contain a PEM private key", path)
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 key", path)
+	}
+
+	return newSigningService(privateKey), nil
+}
+
+func createSigningKey(path string) (*SigningService, error) {
+	log.Printf("Generating server signing key at %s...", path)
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	encoded := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, encoded, 0600); err != nil {
+		return nil, err
+	}
+
+	return newSigningService(privateKey), nil
+}
+
+func newSigningService(privateKey ed25519.PrivateKey) *SigningService {
+	sum := sha256.Sum256(privateKey.Public().(ed25519.PublicKey))
+	return &SigningService{
+		privateKey: privateKey,
+		keyID:      hex.EncodeToString(sum[:8]),
+	}
+}
+
+// SignStatement returns the signed bytes for statement, as described for
+// the statement types, and the base64 Ed25519 signature over them.
+func (s *SigningService) SignStatement(statementType string, statement interface{}) ([]byte, string, error) {
+	encoded, err := json.Marshal(statement)
+	if err != nil {
+		return nil, "", err
+	}
+	payload := append([]byte(statementType+"\n"), encoded...)
+	return payload, base64.StdEncoding.EncodeToString(ed25519.Sign(s.privateKey, payload)), nil
+}
+
+// OpenStatement checks that payload was signed by publicKey and is a
+// statement of statementType, and returns its JSON.
+func OpenStatement(publicKey ed25519.PublicKey, statementType string, payload []byte, signature string) ([]byte, error) {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || !ed25519.Verify(publicKey, payload, sig) {
+		return nil, errors.New("signature is invalid")
+	}
+	encoded, ok := bytes.CutPrefix(payload, []byte(statementType+"\n"))
+	if !ok {
+		return nil, fmt.Errorf("signed statement is not a %s", statementType)
+	}
+	return encoded, nil
+}
+
+func (s *SigningService) PublicKey() ed25519.PublicKey {
+	return s.privateKey.Public().(ed25519.PublicKey)
+}
+
+// KeyID is a short fingerprint of the public key so clients can tell which
+// key produced a signature.
+func (s *SigningService) KeyID() string {
+	return s.keyID
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+func TestSignedStatementsAreTyped(t *testing.T) {
+	signer, err := LoadOrCreateSigningKey(filepath.Join(t.TempDir(), "signing_key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A tree head and a vault state share no fields, so without the type a
+	// lenient decoder would read either as the other.
+	head := map[string]interface{}{"tree_size": 3, "root_hash": "ab"}
+	payload, signature, err := signer.SignStatement(StatementTreeHead, head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload[:len(StatementTreeHead)+1]) != StatementTreeHead+"\n" {
+		t.Fatalf("payload %q does not start with its type", payload)
+	}
+
+	encoded, err := OpenStatement(signer.PublicKey(), StatementTreeHead, payload, signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var opened map[string]interface{}
+	if err := json.Unmarshal(encoded, &opened); err != nil || opened["root_hash"] != "ab" {
+		t.Fatalf("opened %s (err %v)", encoded, err)
+	}
+
+	for _, other := range []string{StatementVaultState, StatementDeletionReceipt} {
+		if _, err := OpenStatement(signer.PublicKey(), other, payload, signature); err == nil {
+			t.Fatalf("a tree head was accepted as %s", other)
+		}
+	}
+
+	tampered := append([]byte{}, payload...)
+	tampered[len(tampered)-2] ^= 1
+	if _, err := OpenStatement(signer.PublicKey(), StatementTreeHead, tampered, signature); err == nil {
+		t.Fatal("a tampered statement was accepted")
+	}
+}
@@ -0,0 +1,294 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Streams are sealed in fixed-size chunks (the STREAM construction), so data
+// of any size is encrypted and decrypted in bounded memory:
+//
+//	header: 0x03 | len(key ID) | key ID | chunk size (uint32) | salt (32)
+//	chunks: AES-GCM(chunk) | tag, each holding chunk size bytes except the last
+//
+// Every stream gets its own AES key, derived with HKDF from the master key
+// and the salt. Chunk nonces are a big-endian chunk counter followed by a
+// byte that is 1 on the last chunk only, so reordered, dropped or appended
+// chunks and a stream cut at a chunk boundary all fail to authenticate. The
+// header and the EncryptionContext are authenticated with every chunk.
+const (
+	streamFormat      = 0x03
+	streamSaltSize    = 32
+	StreamChunkSize   = 64 * 1024
+	maxStreamChunk    = 16 * 1024 * 1024
+	streamTagOverhead = 16
+)
+
+var ErrStreamCorrupt = errors.New("encrypted stream is truncated, reordered or modified")
+
+// NewStreamWriter returns a writer that encrypts everything written to it
+// into dst. Close must be called to write the final chunk; it does not close
+// dst.
+func (cs *CryptoService) NewStreamWriter(dst io.Writer, ctx EncryptionContext) (io.WriteCloser, error) {
+	salt := make([]byte, streamSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, 2+len(cs.activeID)+4+streamSaltSize)
+	header = append(header, streamFormat, byte(len(cs.activeID)))
+	header = append(header, cs.activeID...)
+	header = binary.BigEndian.AppendUint32(header, StreamChunkSize)
+	header = append(header, salt...)
+
+	s, err := newStreamState(cs.keys[cs.activeID], header, salt, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dst.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &streamWriter{
+		dst:    dst,
+		state:  s,
+		buffer: make([]byte, 0, StreamChunkSize),
+		sealed: make([]byte, 0, StreamChunkSize+streamTagOverhead),
+	}, nil
+}
+
+// NewStreamReader returns a reader that decrypts a stream written by
+// NewStreamWriter with the same context. Read returns ErrStreamCorrupt as
+// soon as a chunk fails to authenticate, so callers must not trust data
+// from a stream that did not end in io.EOF.
+func (cs *CryptoService) NewStreamReader(src io.Reader, ctx EncryptionContext) (io.Reader, error) {
+	in := bufio.NewReader(src)
+
+	prefix := make([]byte, 2)
+	if _, err := io.ReadFull(in, prefix); err != nil {
+		return nil, ErrStreamCorrupt
+	}
+	if prefix[0] != streamFormat {
+		return nil, errors.New("not an encrypted stream")
+	}
+
+	rest := make([]byte, int(prefix[1])+4+streamSaltSize)
+	if _, err := io.ReadFull(in, rest); err != nil {
+		return nil, ErrStreamCorrupt
+	}
+	header := append(prefix, rest...)
+
+	keyID := string(rest[:prefix[1]])
+	chunkSize := binary.BigEndian.Uint32(rest[prefix[1]:])
+	salt := rest[int(prefix[1])+4:]
+	if chunkSize == 0 || chunkSize > maxStreamChunk {
+		return nil, fmt.Errorf("invalid stream chunk size %d", chunkSize)
+	}
+
+	key, ok := cs.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("stream was sealed with key %q, which is not loaded", keyID)
+	}
+
+	s, err := newStreamState(key, header, salt, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamReader{
+		src:    in,
+		state:  s,
+		sealed: make([]byte, int(chunkSize)+streamTagOverhead),
+	}, nil
+}
+
+// EncryptStream encrypts src into dst and returns the number of plaintext
+// bytes read.
+func (cs *CryptoService) EncryptStream(dst io.Writer, src io.Reader, ctx EncryptionContext) (int64, error) {
+	w, err := cs.NewStreamWriter(dst, ctx)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(w, src)
+	if err != nil {
+		return n, err
+	}
+	return n, w.Close()
+}
+
+// DecryptStream decrypts src into dst and returns the number of plaintext
+// bytes written. On error, dst may already hold unauthenticated data and
+// must be discarded.
+func (cs *CryptoService) DecryptStream(dst io.Writer, src io.Reader, ctx EncryptionContext) (int64, error) {
+	r, err := cs.NewStreamReader(src, ctx)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(dst, r)
+}
+
+type streamState struct {
+	aead    cipher.AEAD
+	aad     []byte
+	counter uint64
+	nonce   [nonceSize]byte
+}
+
+func newStreamState(masterKey, header, salt []byte, ctx EncryptionContext) (*streamState, error) {
+	streamKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, masterKey, salt, []byte("aiprivacyvault stream v1")), streamKey); err != nil {
+		return nil, err
+	}
+
+	aesgcm, err := newGCM(streamKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamState{
+		aead: aesgcm,
+		aad:  append(append([]byte{}, header...), ctx.associatedData()...),
+	}, nil
+}
+
+// next returns the nonce for the next chunk.
+func (s *streamState) next(final bool) ([]byte, error) {
+	if s.counter == ^uint64(0) {
+		return nil, errors.New("stream is too long")
+	}
+	binary.BigEndian.PutUint64(s.nonce[3:11], s.counter)
+	s.nonce[11] = 0
+	if final {
+		s.nonce[11] = 1
+	}
+	s.counter++
+	return s.nonce[:], nil
+}
+
+type streamWriter struct {
+	dst    io.Writer
+	state  *streamState
+	buffer []byte
+	sealed []byte
+	closed bool
+	err    error
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed stream")
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// A full buffer is only sealed once more data arrives, since until
+		// then it might be the final chunk.
+		if len(w.buffer) == StreamChunkSize {
+			if w.err = w.flush(false); w.err != nil {
+				return written, w.err
+			}
+		}
+		n := copy(w.buffer[len(w.buffer):StreamChunkSize], p)
+		w.buffer = w.buffer[:len(w.buffer)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *streamWriter) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.flush(true)
+	return w.err
+}
+
+func (w *streamWriter) flush(final bool) error {
+	nonce, err := w.state.next(final)
+	if err != nil {
+		return err
+	}
+	w.sealed = w.state.aead.Seal(w.sealed[:0], nonce, w.buffer, w.state.aad)
+	w.buffer = w.buffer[:0]
+	_, err = w.dst.Write(w.sealed)
+	return err
+}
+
+type streamReader struct {
+	src     *bufio.Reader
+	state   *streamState
+	sealed  []byte
+	plain   []byte
+	pending []byte
+	done    bool
+	err     error
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.err = r.readChunk()
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *streamReader) readChunk() error {
+	n, err := io.ReadFull(r.src, r.sealed)
+	final := false
+	switch err {
+	case nil:
+		// A full chunk is the last one only if nothing follows it.
+		if _, peekErr := r.src.Peek(1); peekErr == io.EOF {
+			final = true
+		} else if peekErr != nil {
+			return peekErr
+		}
+	case io.ErrUnexpectedEOF:
+		final = true
+	case io.EOF:
+		// The final chunk always exists, even for an empty stream.
+		return ErrStreamCorrupt
+	default:
+		return err
+	}
+	if n < streamTagOverhead {
+		return ErrStreamCorrupt
+	}
+
+	nonce, err := r.state.next(final)
+	if err != nil {
+		return err
+	}
+	r.plain, err = r.state.aead.Open(r.plain[:0], nonce, r.sealed[:n], r.state.aad)
+	if err != nil {
+		return ErrStreamCorrupt
+	}
+
+	r.pending = r.plain
+	r.done = final
+	return nil
+}
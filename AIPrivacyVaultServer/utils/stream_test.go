@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+var streamTestContext = EncryptionContext{Column: "stream test"}
+
+func newStreamTestService(t *testing.T) *CryptoService {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		t.Fatal(err)
+	}
+	return NewCryptoService(string(key))
+}
+
+// sealStream encrypts plaintext and returns the stream split into its header
+// and sealed chunks.
+func sealStream(t *testing.T, cs *CryptoService, plaintext []byte) ([]byte, [][]byte) {
+	t.Helper()
+	var sealed bytes.Buffer
+	if _, err := cs.EncryptStream(&sealed, bytes.NewReader(plaintext), streamTestContext); err != nil {
+		t.Fatalf("EncryptStream: %v", err)
+	}
+
+	data := sealed.Bytes()
+	headerLength := 2 + len(cs.activeID) + 4 + streamSaltSize
+	header, body := data[:headerLength], data[headerLength:]
+
+	var chunks [][]byte
+	for len(body) > 0 {
+		n := StreamChunkSize + streamTagOverhead
+		if n > len(body) {
+			n = len(body)
+		}
+		chunks = append(chunks, body[:n])
+		body = body[n:]
+	}
+	return header, chunks
+}
+
+func openStream(cs *CryptoService, header []byte, chunks ...[]byte) ([]byte, error) {
+	stream := append([]byte{}, header...)
+	for _, chunk := range chunks {
+		stream = append(stream, chunk...)
+	}
+	var plain bytes.Buffer
+	_, err := cs.DecryptStream(&plain, bytes.NewReader(stream), streamTestContext)
+	return plain.Bytes(), err
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	cs := newStreamTestService(t)
+
+	for _, size := range []int{0, 1, StreamChunkSize - 1, StreamChunkSize, StreamChunkSize + 1, 3*StreamChunkSize + 5} {
+		plaintext := make([]byte, size)
+		if _, err := io.ReadFull(rand.Reader, plaintext); err != nil {
+			t.Fatal(err)
+		}
+
+		header, chunks := sealStream(t, cs, plaintext)
+		got, err := openStream(cs, header, chunks...)
+		if err != nil {
+			t.Fatalf("size %d: DecryptStream: %v", size, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Fatalf("size %d: decrypted data does not match", size)
+		}
+	}
+}
+
+func TestStreamRejectsTampering(t *testing.T) {
+	cs := newStreamTestService(t)
+
+	plaintext := make([]byte, 3*StreamChunkSize+5)
+	if _, err := io.ReadFull(rand.Reader, plaintext); err != nil {
+		t.Fatal(err)
+	}
+	header, chunks := sealStream(t, cs, plaintext)
+	if len(chunks) != 4 {
+		t.Fatalf("expected 4 chunks, got %d", len(chunks))
+	}
+
+	tests := []struct {
+		name   string
+		chunks [][]byte
+	}{
+		{"final chunk dropped", chunks[:3]},
+		{"cut at first chunk", chunks[:1]},
+		{"no chunks", nil},
+		{"cut inside final chunk", [][]byte{chunks[0], chunks[1], chunks[2], chunks[3][:len(chunks[3])-1]}},
+		{"chunks reordered", [][]byte{chunks[1], chunks[0], chunks[2], chunks[3]}},
+		{"chunk dropped from the middle", [][]byte{chunks[0], chunks[2], chunks[3]}},
+		{"chunk repeated", [][]byte{chunks[0], chunks[0], chunks[1], chunks[2], chunks[3]}},
+		{"chunk appended after final", [][]byte{chunks[0], chunks[1], chunks[2], chunks[3], chunks[0]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := openStream(cs, header, tt.chunks...); !errors.Is(err, ErrStreamCorrupt) {
+				t.Fatalf("expected ErrStreamCorrupt, got %v", err)
+			}
+		})
+	}
+}
+
+func TestStreamRejectsOtherStreamsChunks(t *testing.T) {
+	cs := newStreamTestService(t)
+
+	plaintext := make([]byte, 2*StreamChunkSize+1)
+	header, chunks := sealStream(t, cs, plaintext)
+	_, otherChunks := sealStream(t, cs, plaintext)
+
+	if _, err := openStream(cs, header, chunks[0], otherChunks[1], chunks[2]); !errors.Is(err, ErrStreamCorrupt) {
+		t.Fatalf("expected ErrStreamCorrupt, got %v", err)
+	}
+}
+
+func TestStreamBindsContextAndHeader(t *testing.T) {
+	cs := newStreamTestService(t)
+	header, chunks := sealStream(t, cs, []byte("backup contents"))
+
+	var plain bytes.Buffer
+	stream := append(append([]byte{}, header...), chunks[0]...)
+	_, err := cs.DecryptStream(&plain, bytes.NewReader(stream), EncryptionContext{Column: "something else"})
+	if !errors.Is(err, ErrStreamCorrupt) {
+		t.Fatalf("wrong context: expected ErrStreamCorrupt, got %v", err)
+	}
+
+	// Changing the declared chunk size alters the header, which every
+	// chunk authenticates.
+	tampered := append([]byte{}, header...)
+	tampered[2+len(cs.activeID)+3] ^= 0x01
+	if _, err := openStream(cs, tampered, chunks...); !errors.Is(err, ErrStreamCorrupt) {
+		t.Fatalf("tampered header: expected ErrStreamCorrupt, got %v", err)
+	}
+}
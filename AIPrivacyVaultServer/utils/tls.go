@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const selfSignedValidity = 2 * 365 * 24 * time.Hour
+
+// LoadServerCertificate loads a user-supplied certificate and key pair.
+func LoadServerCertificate(certPath, keyPath string) (tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	return cert, err
+}
+
+// LoadOrCreateSelfSignedCertificate loads the server's self-signed ECDSA
+// certificate from dir, generating it on first start or once it has expired.
+// Clients pin its SHA-256 fingerprint rather than trusting a CA.
+func LoadOrCreateSelfSignedCertificate(dir string) (tls.Certificate, error) {
+	certPath := filepath.Join(dir, "server.crt")
+	keyPath := filepath.Join(dir, "server.key")
+
+	cert, err := LoadServerCertificate(certPath, keyPath)
+	if err == nil {
+		if time.Now().Before(cert.Leaf.NotAfter) {
+			return cert, nil
+		}
+		log.Printf("Warning: Server certificate expired on %v, generating a new one; clients must re-pin", cert.Leaf.NotAfter)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return tls.Certificate{}, err
+	}
+
+	log.Printf("Generating self-signed server certificate in %s...", dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	dnsNames, ips := LocalHostnames()
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: dnsNames[0], Organization: []string{"AI Privacy Vault"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(selfSignedValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     dnsNames,
+		IPAddresses:  ips,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	keyPEM, err := encodeECPrivateKeyPEM(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return LoadServerCertificate(certPath, keyPath)
+}
+
+// CertificateFingerprint is the hex SHA-256 of the leaf certificate's DER
+// encoding, the value clients pin.
+func CertificateFingerprint(cert tls.Certificate) string {
+	sum := sha256.Sum256(cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"strings"
+)
+
+var codeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateCode returns a random, human-typeable code such as
+// "ABCD-EFGH-IJKL-MNOP" built from the given number of random bytes.
+func GenerateCode(numBytes int) (string, error) {
+	raw := make([]byte, numBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+
+	encoded := codeEncoding.EncodeToString(raw)
+
+	var groups []string
+	for len(encoded) > 4 {
+		groups = append(groups, encoded[:4])
+		encoded = encoded[4:]
+	}
+	groups = append(groups, encoded)
+
+	return strings.Join(groups, "-"), nil
+}
+
+// NormalizeCode strips the separators and case differences users tend to
+// introduce when typing a code back in.
+func NormalizeCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.ReplaceAll(code, "-", "")
+	code = strings.ReplaceAll(code, " ", "")
+	return code
+}
+
+// HashCode returns the value stored in the database for a high-entropy code.
+// Codes are random, so a plain SHA-256 is sufficient and allows lookups.
+func HashCode(code string) string {
+	sum := sha256.Sum256([]byte(NormalizeCode(code)))
+	return hex.EncodeToString(sum[:])
+}
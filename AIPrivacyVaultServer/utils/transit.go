@@ -0,0 +1,251 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TransitKeyProvider keeps the master key wrapped by a KMS that speaks the
+// HashiCorp Vault Transit API. On first use it asks the KMS for a new data
+// key and stores only the wrapped copy at WrappedKeyPath; afterwards the KMS
+// unwraps that copy on every start. The plaintext key never touches disk,
+// and revoking the KMS key or token locks the server's data.
+type TransitKeyProvider struct {
+	Address        string
+	Token          string
+	Mount          string
+	KeyName        string
+	WrappedKeyPath string
+	HTTPClient     *http.Client
+}
+
+func (p *TransitKeyProvider) Name() string {
+	return fmt.Sprintf("transit key %s at %s", p.KeyName, p.Address)
+}
+
+func (p *TransitKeyProvider) MasterKey() ([]byte, error) {
+	wrapped, err := os.ReadFile(p.WrappedKeyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return p.createDataKey()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := p.call("decrypt/"+url.PathEscape(p.KeyName), map[string]interface{}{
+		"ciphertext": strings.TrimSpace(string(wrapped)),
+	}, &resp); err != nil {
+		return nil, err
+	}
+	return decodeTransitKey(resp.Plaintext)
+}
+
+func (p *TransitKeyProvider) createDataKey() ([]byte, error) {
+	var resp struct {
+		Plaintext  string `json:"plaintext"`
+		Ciphertext string `json:"ciphertext"`
+	}
+	if err := p.call("datakey/plaintext/"+url.PathEscape(p.KeyName), map[string]interface{}{
+		"bits": MasterKeySize * 8,
+	}, &resp); err != nil {
+		return nil, err
+	}
+	key, err := decodeTransitKey(resp.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Ciphertext == "" {
+		return nil, errors.New("transit did not return a wrapped data key")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p.WrappedKeyPath), 0700); err != nil {
+		return nil, err
+	}
+	// O_EXCL so a concurrent start cannot replace a key already in use.
+	file, err := os.OpenFile(p.WrappedKeyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintln(file, resp.Ciphertext); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (p *TransitKeyProvider) call(operation string, request, out interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	mount := p.Mount
+	if mount == "" {
+		mount = "transit"
+	}
+	endpoint := strings.TrimRight(p.Address, "/") + "/v1/" + strings.Trim(mount, "/") + "/" + operation
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", p.Token)
+
+	client := p.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []string        `json:"errors"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&envelope); err != nil {
+		return fmt.Errorf("transit %s returned %d", operation, resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("transit %s returned %d: %s", operation, resp.StatusCode, strings.Join(envelope.Errors, "; "))
+	}
+	return json.Unmarshal(envelope.Data, out)
+}
+
+func decodeTransitKey(plaintext string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(plaintext)
+	if err != nil {
+		return nil, errors.New("transit returned a malformed key")
+	}
+	return key, ValidateKeyLength(key)
+}
+
+// transitCiphertextPrefix matches what Vault puts in front of the
+// ciphertexts it returns.
+const transitCiphertextPrefix = "vault:v1:"
+
+// NewTransitStub returns a handler implementing the parts of the Vault
+// Transit API TransitKeyProvider uses (datakey, encrypt and decrypt) for
+// any mount and key name, so the KMS path can be exercised without a Vault
+// server. Requests must carry token in X-Vault-Token. Data keys are wrapped
+// with master, bound to the transit key name.
+func NewTransitStub(master *CryptoService, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Vault-Token")), []byte(token)) != 1 {
+			writeTransitError(w, http.StatusForbidden, "permission denied")
+			return
+		}
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			writeTransitError(w, http.StatusMethodNotAllowed, "unsupported operation")
+			return
+		}
+
+		// /v1/<mount>/<operation>/<key name>
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/"), "/")
+		if len(parts) < 3 || parts[len(parts)-1] == "" {
+			writeTransitError(w, http.StatusNotFound, "unsupported path")
+			return
+		}
+		keyName := parts[len(parts)-1]
+		operation := strings.Join(parts[1:len(parts)-1], "/")
+
+		var req struct {
+			Plaintext  string `json:"plaintext"`
+			Ciphertext string `json:"ciphertext"`
+			Bits       int    `json:"bits"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+			writeTransitError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+
+		ctx := EncryptionContext{Column: "transit:" + keyName}
+		seal := func(plaintext []byte) (string, error) {
+			sealed, err := master.EncryptWithContext(plaintext, ctx)
+			return transitCiphertextPrefix + sealed, err
+		}
+
+		switch operation {
+		case "datakey/plaintext", "datakey/wrapped":
+			if req.Bits == 0 {
+				req.Bits = 256
+			}
+			if req.Bits != 128 && req.Bits != 256 && req.Bits != 512 {
+				writeTransitError(w, http.StatusBadRequest, "invalid bits value")
+				return
+			}
+			key := make([]byte, req.Bits/8)
+			if _, err := io.ReadFull(rand.Reader, key); err != nil {
+				writeTransitError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			ciphertext, err := seal(key)
+			if err != nil {
+				writeTransitError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			data := map[string]string{"ciphertext": ciphertext}
+			if operation == "datakey/plaintext" {
+				data["plaintext"] = base64.StdEncoding.EncodeToString(key)
+			}
+			writeTransitData(w, data)
+		case "encrypt":
+			plaintext, err := base64.StdEncoding.DecodeString(req.Plaintext)
+			if err != nil {
+				writeTransitError(w, http.StatusBadRequest, "plaintext is not base64")
+				return
+			}
+			ciphertext, err := seal(plaintext)
+			if err != nil {
+				writeTransitError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			writeTransitData(w, map[string]string{"ciphertext": ciphertext})
+		case "decrypt":
+			if !strings.HasPrefix(req.Ciphertext, transitCiphertextPrefix) {
+				writeTransitError(w, http.StatusBadRequest, "invalid ciphertext")
+				return
+			}
+			plaintext, err := master.DecryptWithContext(strings.TrimPrefix(req.Ciphertext, transitCiphertextPrefix), ctx)
+			if err != nil {
+				writeTransitError(w, http.StatusBadRequest, "cipher: message authentication failed")
+				return
+			}
+			writeTransitData(w, map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plaintext)})
+		default:
+			writeTransitError(w, http.StatusNotFound, "unsupported path")
+		}
+	})
+}
+
+func writeTransitData(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+}
+
+func writeTransitError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{message}})
+}
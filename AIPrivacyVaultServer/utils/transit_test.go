@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const transitTestToken = "stub-token"
+
+func newTransitTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(NewTransitStub(NewCryptoService("0123456789abcdef0123456789abcdef"), transitTestToken))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newTransitTestProvider(server *httptest.Server, wrappedKeyPath string) *TransitKeyProvider {
+	return &TransitKeyProvider{
+		Address:        server.URL,
+		Token:          transitTestToken,
+		Mount:          "transit",
+		KeyName:        "vault-server",
+		WrappedKeyPath: wrappedKeyPath,
+		HTTPClient:     server.Client(),
+	}
+}
+
+func TestTransitCreatesAndStoresWrappedKey(t *testing.T) {
+	server := newTransitTestServer(t)
+	path := filepath.Join(t.TempDir(), "keys", "master_key.vault")
+
+	key, err := newTransitTestProvider(server, path).MasterKey()
+	if err != nil {
+		t.Fatalf("MasterKey: %v", err)
+	}
+	if len(key) != MasterKeySize {
+		t.Fatalf("expected a %d byte key, got %d", MasterKeySize, len(key))
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("wrapped key was not stored: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("wrapped key file has mode %v, want 0600", info.Mode().Perm())
+	}
+	stored, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(stored), transitCiphertextPrefix) {
+		t.Fatalf("stored value %q is not a transit ciphertext", stored)
+	}
+	if bytes.Contains(stored, key) {
+		t.Fatal("the plaintext key was written to disk")
+	}
+}
+
+func TestTransitUnwrapsStoredKeyOnNextStart(t *testing.T) {
+	server := newTransitTestServer(t)
+	path := filepath.Join(t.TempDir(), "master_key.vault")
+
+	first, err := newTransitTestProvider(server, path).MasterKey()
+	if err != nil {
+		t.Fatalf("first start: %v", err)
+	}
+	stored, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := newTransitTestProvider(server, path).MasterKey()
+	if err != nil {
+		t.Fatalf("second start: %v", err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Fatal("the key changed between starts")
+	}
+
+	again, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, again) {
+		t.Fatal("the wrapped key was replaced on the second start")
+	}
+}
+
+func TestTransitRejectsWrongToken(t *testing.T) {
+	server := newTransitTestServer(t)
+	path := filepath.Join(t.TempDir(), "master_key.vault")
+
+	provider := newTransitTestProvider(server, path)
+	provider.Token = "wrong-token"
+	if _, err := provider.MasterKey(); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("a wrapped key was stored although the KMS refused the request")
+	}
+
+	// Once a key exists, unwrapping it needs the right token too.
+	if _, err := newTransitTestProvider(server, path).MasterKey(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.MasterKey(); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("expected permission denied when unwrapping, got %v", err)
+	}
+}
+
+func TestTransitRejectsCorruptedWrappedKey(t *testing.T) {
+	server := newTransitTestServer(t)
+	path := filepath.Join(t.TempDir(), "master_key.vault")
+
+	if _, err := newTransitTestProvider(server, path).MasterKey(); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"flipped byte":   flipBase64Char(strings.TrimSpace(string(stored))),
+		"missing prefix": strings.TrimPrefix(strings.TrimSpace(string(stored)), transitCiphertextPrefix),
+		"empty":          "",
+		"not base64":     transitCiphertextPrefix + "%%%",
+	}
+	for name, corrupted := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := os.WriteFile(path, []byte(corrupted+"\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := newTransitTestProvider(server, path).MasterKey(); err == nil {
+				t.Fatal("a corrupted wrapped key was accepted")
+			}
+		})
+	}
+}
+
+func TestTransitBindsWrappedKeyToKeyName(t *testing.T) {
+	server := newTransitTestServer(t)
+	path := filepath.Join(t.TempDir(), "master_key.vault")
+
+	if _, err := newTransitTestProvider(server, path).MasterKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	provider := newTransitTestProvider(server, path)
+	provider.KeyName = "another-key"
+	if _, err := provider.MasterKey(); err == nil {
+		t.Fatal("a key wrapped under one transit key was unwrapped with another")
+	}
+}
+
+// flipBase64Char changes one character in the middle of a base64 string.
+func flipBase64Char(value string) string {
+	i := len(value) / 2
+	replacement := byte('A')
+	if value[i] == 'A' {
+		replacement = 'B'
+	}
+	return value[:i] + string(replacement) + value[i+1:]
+}
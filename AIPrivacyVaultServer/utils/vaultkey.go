@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// The app derives its vault key on the device and never sends it to the
+// server. These mirror EncryptionService in the app so a vault can still be
+// read with its password after every device is lost.
+const (
+	vaultKeySalt   = "AI_Privacy_Vault_Salt"
+	vaultKeyRounds = 100000
+)
+
+// DeriveVaultKey derives the app's vault key from the vault password, as
+// EncryptionService.deriveKeyFromPassword does.
+func DeriveVaultKey(password string) []byte {
+	key := []byte(password)
+	for i := 0; i < vaultKeyRounds; i++ {
+		sum := sha256.Sum256(append(key, vaultKeySalt...))
+		key = sum[:]
+	}
+	return key
+}
+
+// VaultKeyID is the key ID the app writes into the envelopes it seals with
+// key, as EncryptionService.envelopeKeyID computes it.
+func VaultKeyID(key []byte) string {
+	sum := sha256.Sum256(append([]byte("AIPV key id"), key...))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+)
+
+// A user's vault state is committed to as the Merkle root over one leaf per
+// item, ordered by item ID. Each leaf is
+//
+//	live item:    0x01 | len(ID) (uint32) | ID | version (uint64) | SHA-256(encrypted_data)
+//	deleted item: 0x02 | len(ID) (uint32) | ID
+//
+// with integers big-endian and encrypted_data exactly as the client sent
+// it. Clients rebuild the same root from a full sync: updated_items and the
+// updated_items of every entry in vaults are the live items, deleted_ids and
+// the vaults' deleted_ids the deleted ones, and each of shared_items is live
+// or deleted as its is_deleted says.
+//
+// Successive roots are linked into a hash chain,
+//
+//	head(n) = SHA-256("aiprivacyvault vault state v1" | head(n-1) | n (uint64) | root(n))
+//
+// starting from 32 zero bytes, so a device that remembers the last head it
+// saw can tell whether the server's current state descends from it. A
+// rolled back or forked vault cannot produce a chain that does.
+const (
+	vaultLeafLive    = 0x01
+	vaultLeafDeleted = 0x02
+)
+
+// VaultItem is the part of an item the vault state commits to.
+type VaultItem struct {
+	ID      string
+	Version int
+	Deleted bool
+	Data    string
+}
+
+// VaultGenesisHead is the chain head before a vault's first state.
+var VaultGenesisHead = make([]byte, sha256.Size)
+
+// VaultStateRoot returns the Merkle root over items.
+func VaultStateRoot(items []VaultItem) []byte {
+	sorted := append([]VaultItem(nil), items...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+
+	leaves := make([][]byte, len(sorted))
+	for i, item := range sorted {
+		leaves[i] = MerkleLeafHash(vaultLeaf(item))
+	}
+	return MerkleRoot(leaves)
+}
+
+func vaultLeaf(item VaultItem) []byte {
+	leaf := make([]byte, 0, 1+4+len(item.ID)+8+sha256.Size)
+	if item.Deleted {
+		leaf = append(leaf, vaultLeafDeleted)
+	} else {
+		leaf = append(leaf, vaultLeafLive)
+	}
+	leaf = binary.BigEndian.AppendUint32(leaf, uint32(len(item.ID)))
+	leaf = append(leaf, item.ID...)
+	if item.Deleted {
+		return leaf
+	}
+	leaf = binary.BigEndian.AppendUint64(leaf, uint64(item.Version))
+	dataHash := sha256.Sum256([]byte(item.Data))
+	return append(leaf, dataHash[:]...)
+}
+
+// NextVaultHead extends the chain ending in previous with the state root
+// at sequence.
+func NextVaultHead(previous []byte, sequence int64, root []byte) []byte {
+	buffer := make([]byte, 0, 64+len(previous)+8+len(root))
+	buffer = append(buffer, "aiprivacyvault vault state v1"...)
+	buffer = append(buffer, previous...)
+	buffer = binary.BigEndian.AppendUint64(buffer, uint64(sequence))
+	buffer = append(buffer, root...)
+	sum := sha256.Sum256(buffer)
+	return sum[:]
+}